@@ -0,0 +1,75 @@
+// Package bencode implements encoding and decoding of bencoded data as used by the BitTorrent protocol
+//
+// Decoding is strict: integers with leading zeros, negative zero, unsorted or duplicate dictionary keys
+// and strings longer than the configured limit are rejected, so only canonical data is accepted.
+// Encoding always produces canonical data with dictionary keys sorted as raw byte strings.
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const (
+	// maximum nesting of lists and dictionaries
+	DefaultMaxDepth = 64
+	// maximum length of a single string, pieces of big torrents can be a few megabytes
+	DefaultMaxStringLength = 32 * 1024 * 1024
+)
+
+// RawMessage is a raw encoded bencode value
+// when decoding it receives the exact bytes of the value, when encoding they are written as is
+type RawMessage []byte
+
+// Marshaler is implemented by types which can encode themselves into valid bencode
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types which can decode a bencoded representation of themselves
+// the data passed to UnmarshalBencode is a complete, already validated bencode value
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+// SyntaxError describes malformed bencoded data
+type SyntaxError struct {
+	Offset int64 // offset of the byte where the error was found
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// LimitError is returned when data exceeds one of the decoder limits
+type LimitError struct {
+	Offset int64
+	Limit  string
+	Value  int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bencode: %s limit of %d exceeded at offset %d", e.Limit, e.Value, e.Offset)
+}
+
+// UnmarshalTypeError describes a bencode value which can't be stored in a go type
+type UnmarshalTypeError struct {
+	Offset int64
+	Value  string // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// MarshalerError is returned when a go value can't be encoded
+type MarshalerError struct {
+	Type reflect.Type
+	Msg  string
+}
+
+func (e *MarshalerError) Error() string {
+	return fmt.Sprintf("bencode: cannot encode go value of type %s: %s", e.Type, e.Msg)
+}
@@ -0,0 +1,206 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sampleInfo struct {
+	Name   string `bencode:"name"`
+	Length int    `bencode:"length"`
+}
+
+type sample struct {
+	Announce string     `bencode:"announce"`
+	Comment  string     `bencode:"comment,omitempty"`
+	Hash     [4]byte    `bencode:"hash"`
+	Info     RawMessage `bencode:"info"`
+	Tiers    [][]string `bencode:"tiers"`
+	Private  *int       `bencode:"private"`
+	Ignored  string     `bencode:"-"`
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	data := "d8:announce9:localhost4:hash4:abcd4:infod6:lengthi10e4:name1:a5:otheri5ee" +
+		"7:privatei1e5:tiersll1:a1:bel1:ceee"
+
+	var s sample
+	err := Unmarshal([]byte(data), &s)
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost", s.Announce)
+	assert.Equal(t, [4]byte{'a', 'b', 'c', 'd'}, s.Hash)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, s.Tiers)
+	assert.Equal(t, 1, *s.Private)
+	// raw message keeps unknown keys exactly as they were
+	assert.Equal(t, "d6:lengthi10e4:name1:a5:otheri5ee", string(s.Info))
+
+	var info sampleInfo
+	require.NoError(t, Unmarshal(s.Info, &info))
+	assert.Equal(t, sampleInfo{Name: "a", Length: 10}, info)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	private := 1
+	s := sample{
+		Announce: "localhost",
+		Hash:     [4]byte{'a', 'b', 'c', 'd'},
+		Info:     RawMessage("d4:name1:ae"),
+		Tiers:    [][]string{{"x"}},
+		Private:  &private,
+		Ignored:  "not encoded",
+	}
+
+	data, err := Marshal(s)
+	require.NoError(t, err)
+	// keys are sorted, empty comment is omitted
+	assert.Equal(t, "d8:announce9:localhost4:hash4:abcd4:infod4:name1:ae7:privatei1e5:tiersll1:xeee", string(data))
+
+	var decoded sample
+	require.NoError(t, Unmarshal(data, &decoded))
+	decoded.Ignored = s.Ignored
+	assert.Equal(t, s, decoded)
+}
+
+func TestGenericValue(t *testing.T) {
+	data := "d1:ai-3e1:bl3:fooi0ee1:cdee"
+
+	var value Value
+	require.NoError(t, Unmarshal([]byte(data), &value))
+	assert.Equal(t, KindDict, value.Kind)
+
+	a, ok := value.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-3), a.Int)
+
+	var native any
+	require.NoError(t, Unmarshal([]byte(data), &native))
+	assert.Equal(t, map[string]any{
+		"a": int64(-3),
+		"b": []any{"foo", int64(0)},
+		"c": map[string]any{},
+	}, native)
+
+	encoded, err := Marshal(value)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(encoded))
+}
+
+func TestStrictDecoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"leading zero in integer", "i03e"},
+		{"negative zero", "i-0e"},
+		{"empty integer", "ie"},
+		{"integer overflow", "i99999999999999999999e"},
+		{"leading zero in string length", "02:ab"},
+		{"string longer than data", "5:ab"},
+		{"unsorted keys", "d1:bi1e1:ai2ee"},
+		{"duplicate keys", "d1:ai1e1:ai2ee"},
+		{"integer dictionary key", "di1ei2ee"},
+		{"unterminated list", "li1e"},
+		{"trailing data", "i1ei2e"},
+		{"invalid character", "x"},
+		{"empty input", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value Value
+			assert.Error(t, Unmarshal([]byte(tt.data), &value))
+		})
+	}
+}
+
+func TestUnsortedKeysAllowed(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d1:bi1e1:ai2ee"))
+	d.AllowUnsortedKeys()
+
+	var m map[string]int
+	require.NoError(t, d.Decode(&m))
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, m)
+
+	d = NewDecoder(strings.NewReader("d1:bi1e1:ai2e1:bi3ee"))
+	d.AllowUnsortedKeys()
+	assert.Error(t, d.Decode(&m), "duplicate keys are rejected even when unsorted keys are allowed")
+}
+
+func TestDecoderLimits(t *testing.T) {
+	t.Run("huge string length does not allocate", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("9999999999:abc"))
+		var s string
+		var limitErr *LimitError
+		assert.True(t, errors.As(d.Decode(&s), &limitErr))
+	})
+
+	t.Run("string length limit", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("5:hello"))
+		d.SetMaxStringLength(4)
+		var s string
+		var limitErr *LimitError
+		assert.True(t, errors.As(d.Decode(&s), &limitErr))
+	})
+
+	t.Run("nesting depth", func(t *testing.T) {
+		data := strings.Repeat("l", 100) + strings.Repeat("e", 100)
+		var value Value
+		var limitErr *LimitError
+		assert.True(t, errors.As(Unmarshal([]byte(data), &value), &limitErr))
+	})
+
+	t.Run("value size", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("l1:a1:b1:c1:de"))
+		d.SetMaxSize(8)
+		var list []string
+		var limitErr *LimitError
+		assert.True(t, errors.As(d.Decode(&list), &limitErr))
+	})
+}
+
+func TestTypeMismatch(t *testing.T) {
+	var s struct {
+		Length int `bencode:"length"`
+	}
+	var typeErr *UnmarshalTypeError
+	assert.True(t, errors.As(Unmarshal([]byte("d6:length3:abce"), &s), &typeErr))
+
+	var hash [20]byte
+	assert.True(t, errors.As(Unmarshal([]byte("3:abc"), &hash), &typeErr))
+}
+
+func TestStreamingDecoder(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:fooli2ee"))
+
+	var n int
+	require.NoError(t, d.Decode(&n))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(3), d.InputOffset())
+
+	var s string
+	require.NoError(t, d.Decode(&s))
+	assert.Equal(t, "foo", s)
+
+	var list []int
+	require.NoError(t, d.Decode(&list))
+	assert.Equal(t, []int{2}, list)
+
+	assert.Equal(t, io.EOF, d.Decode(&n))
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	require.NoError(t, e.Encode(map[string]any{"z": 1, "a": []byte("x"), "m": []int{1, 2}}))
+	assert.Equal(t, "d1:a1:x1:mli1ei2ee1:zi1ee", buf.String())
+
+	_, err := Marshal(1.5)
+	assert.Error(t, err, "floats can't be encoded")
+}
@@ -0,0 +1,532 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// strings are read in chunks of this size, so a huge length prefix can't allocate memory up front
+const readChunkSize = 64 * 1024
+
+var (
+	rawMessageType  = reflect.TypeOf(RawMessage(nil))
+	valueType       = reflect.TypeOf(Value{})
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// Decoder reads bencoded values from a stream
+// if the reader is not an io.ByteScanner it is buffered, so the decoder may read past the end of a value
+type Decoder struct {
+	r               byteScannerReader
+	offset          int64 // bytes consumed so far
+	start           int64 // offset of the value being decoded
+	maxDepth        int
+	maxStringLength int
+	maxSize         int64 // 0 means no limit
+	allowUnsorted   bool
+	raw             []byte // bytes of the values being captured
+	captures        int    // number of active raw captures
+}
+
+type byteScannerReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	scanner, ok := r.(byteScannerReader)
+	if !ok {
+		scanner = bufio.NewReader(r)
+	}
+	return &Decoder{
+		r:               scanner,
+		maxDepth:        DefaultMaxDepth,
+		maxStringLength: DefaultMaxStringLength,
+	}
+}
+
+// maximum nesting of lists and dictionaries
+func (d *Decoder) SetMaxDepth(depth int) {
+	d.maxDepth = depth
+}
+
+// maximum length of a single string
+func (d *Decoder) SetMaxStringLength(length int) {
+	d.maxStringLength = length
+}
+
+// maximum number of bytes a single decoded value can take, 0 disables the limit
+func (d *Decoder) SetMaxSize(size int64) {
+	d.maxSize = size
+}
+
+// accept dictionaries whose keys are not sorted, some old clients produce them
+// duplicate keys are still rejected
+func (d *Decoder) AllowUnsortedKeys() {
+	d.allowUnsorted = true
+}
+
+// number of bytes consumed from the input so far
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Decode reads the next bencoded value and stores it in the value pointed to by v
+// returns io.EOF if there is no more data before the value starts
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode needs a non nil pointer, got %T", v)
+	}
+
+	_, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	d.r.UnreadByte()
+
+	d.start = d.offset
+	return d.value(rv.Elem(), 0)
+}
+
+// Unmarshal decodes data into the value pointed to by v, data must contain exactly one value
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return &SyntaxError{Offset: 0, Msg: "empty input"}
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{Offset: d.offset, Msg: "trailing data after value"}
+	}
+	return nil
+}
+
+func (d *Decoder) syntaxError(msg string, args ...any) error {
+	return &SyntaxError{Offset: d.offset, Msg: fmt.Sprintf(msg, args...)}
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, d.syntaxError("unexpected end of data")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	d.offset++
+	if d.maxSize > 0 && d.offset-d.start > d.maxSize {
+		return 0, &LimitError{Offset: d.offset, Limit: "value size", Value: d.maxSize}
+	}
+	if d.captures > 0 {
+		d.raw = append(d.raw, b)
+	}
+	return b, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, d.syntaxError("unexpected end of data")
+	}
+	if err != nil {
+		return 0, err
+	}
+	d.r.UnreadByte()
+	return b, nil
+}
+
+// read digits until the terminator, validating there are no leading zeros
+func (d *Decoder) readNumber(terminator byte, allowNegative bool) (string, error) {
+	digits := make([]byte, 0, 20)
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == terminator {
+			break
+		}
+
+		switch {
+		case b == '-' && allowNegative && len(digits) == 0:
+		case b >= '0' && b <= '9':
+		default:
+			return "", d.syntaxError("invalid character %q in number", b)
+		}
+
+		digits = append(digits, b)
+		if len(digits) > 20 {
+			return "", d.syntaxError("number is too long")
+		}
+	}
+
+	number := string(digits)
+	switch {
+	case number == "" || number == "-":
+		return "", d.syntaxError("empty number")
+	case number == "-0":
+		return "", d.syntaxError("negative zero is not allowed")
+	case number[0] == '0' && len(number) > 1, number[0] == '-' && number[1] == '0':
+		return "", d.syntaxError("number %q has leading zeros", number)
+	}
+	return number, nil
+}
+
+func (d *Decoder) readInt() (int64, error) {
+	// skip 'i'
+	_, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	number, err := d.readNumber('e', true)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, d.syntaxError("integer %s does not fit in 64 bits", number)
+	}
+	return n, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	number, err := d.readNumber(':', false)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || length > int64(d.maxStringLength) {
+		return nil, &LimitError{Offset: d.offset, Limit: "string length", Value: int64(d.maxStringLength)}
+	}
+	if d.maxSize > 0 && d.offset-d.start+length > d.maxSize {
+		return nil, &LimitError{Offset: d.offset, Limit: "value size", Value: d.maxSize}
+	}
+
+	// grow the buffer as data arrives instead of trusting the length prefix
+	buf := make([]byte, 0, min(int(length), readChunkSize))
+	for len(buf) < int(length) {
+		chunk := min(int(length)-len(buf), readChunkSize)
+		buf = slices.Grow(buf, chunk)
+		n, err := io.ReadFull(d.r, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+n]
+		d.offset += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, d.syntaxError("unexpected end of data in string of length %d", length)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.captures > 0 {
+		d.raw = append(d.raw, buf...)
+	}
+	return buf, nil
+}
+
+// decode the value at current position and capture the exact bytes it was made of
+func (d *Decoder) captureRaw(depth int) ([]byte, error) {
+	start := len(d.raw)
+	d.captures++
+	err := d.value(reflect.Value{}, depth)
+	d.captures--
+
+	raw := append([]byte(nil), d.raw[start:]...)
+	if d.captures == 0 {
+		d.raw = d.raw[:0]
+	}
+	return raw, err
+}
+
+// decode next value into rv, an invalid rv means the value is validated and thrown away
+func (d *Decoder) value(rv reflect.Value, depth int) error {
+	if depth > d.maxDepth {
+		return &LimitError{Offset: d.offset, Limit: "nesting depth", Value: int64(d.maxDepth)}
+	}
+
+	if rv.IsValid() {
+		if rv.Type() == rawMessageType {
+			raw, err := d.captureRaw(depth)
+			if err != nil {
+				return err
+			}
+			rv.SetBytes(raw)
+			return nil
+		}
+
+		if rv.Kind() != reflect.Pointer && rv.CanAddr() && rv.Addr().Type().Implements(unmarshalerType) {
+			raw, err := d.captureRaw(depth)
+			if err != nil {
+				return err
+			}
+			return rv.Addr().Interface().(Unmarshaler).UnmarshalBencode(raw)
+		}
+
+		switch {
+		case rv.Kind() == reflect.Pointer:
+			if rv.IsNil() {
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			return d.value(rv.Elem(), depth)
+		case rv.Type() == valueType:
+			value, err := d.genericValue(depth)
+			if err != nil {
+				return err
+			}
+			rv.Set(reflect.ValueOf(value))
+			return nil
+		case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+			value, err := d.genericValue(depth)
+			if err != nil {
+				return err
+			}
+			rv.Set(reflect.ValueOf(value.Interface()))
+			return nil
+		}
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		offset := d.offset
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		return setInt(rv, n, offset)
+	case c >= '0' && c <= '9':
+		offset := d.offset
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return setString(rv, s, offset)
+	case c == 'l':
+		return d.list(rv, depth)
+	case c == 'd':
+		return d.dict(rv, depth)
+	default:
+		return d.syntaxError("invalid character %q at start of value", c)
+	}
+}
+
+func (d *Decoder) genericValue(depth int) (Value, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch {
+	case c == 'i':
+		n, err := d.readInt()
+		return NewInt(n), err
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return NewString(string(s)), err
+	case c == 'l':
+		list := []Value{}
+		err := d.list(reflect.ValueOf(&list).Elem(), depth)
+		return NewList(list...), err
+	case c == 'd':
+		dict := map[string]Value{}
+		err := d.dict(reflect.ValueOf(&dict).Elem(), depth)
+		return NewDict(dict), err
+	default:
+		return Value{}, d.syntaxError("invalid character %q at start of value", c)
+	}
+}
+
+func setInt(rv reflect.Value, n int64, offset int64) error {
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.OverflowInt(n) {
+			return &UnmarshalTypeError{Offset: offset, Value: "integer " + strconv.FormatInt(n, 10), Type: rv.Type()}
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return &UnmarshalTypeError{Offset: offset, Value: "integer " + strconv.FormatInt(n, 10), Type: rv.Type()}
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Bool:
+		rv.SetBool(n != 0)
+	default:
+		return &UnmarshalTypeError{Offset: offset, Value: "integer", Type: rv.Type()}
+	}
+	return nil
+}
+
+func setString(rv reflect.Value, s []byte, offset int64) error {
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(string(s))
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		rv.SetBytes(s)
+	case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8:
+		if rv.Len() != len(s) {
+			return &UnmarshalTypeError{Offset: offset, Value: fmt.Sprintf("string of length %d", len(s)), Type: rv.Type()}
+		}
+		reflect.Copy(rv, reflect.ValueOf(s))
+	default:
+		return &UnmarshalTypeError{Offset: offset, Value: "string", Type: rv.Type()}
+	}
+	return nil
+}
+
+func (d *Decoder) list(rv reflect.Value, depth int) error {
+	offset := d.offset
+	if rv.IsValid() {
+		switch {
+		case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8:
+			rv.Set(reflect.MakeSlice(rv.Type(), 0, 0))
+		case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() != reflect.Uint8:
+		default:
+			return &UnmarshalTypeError{Offset: offset, Value: "list", Type: rv.Type()}
+		}
+	}
+
+	// skip 'l'
+	_, err := d.readByte()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err = d.readByte()
+			return err
+		}
+
+		var item reflect.Value
+		if rv.IsValid() {
+			if rv.Kind() == reflect.Slice {
+				rv.Set(reflect.Append(rv, reflect.Zero(rv.Type().Elem())))
+			} else if i >= rv.Len() {
+				return &UnmarshalTypeError{Offset: offset, Value: "list with more than " + strconv.Itoa(rv.Len()) + " elements", Type: rv.Type()}
+			}
+			item = rv.Index(i)
+		}
+
+		err = d.value(item, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) dict(rv reflect.Value, depth int) error {
+	offset := d.offset
+	var fields *structFields
+	if rv.IsValid() {
+		switch {
+		case rv.Kind() == reflect.Struct:
+			fields = cachedFields(rv.Type())
+		case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String:
+			if rv.IsNil() {
+				rv.Set(reflect.MakeMap(rv.Type()))
+			}
+		default:
+			return &UnmarshalTypeError{Offset: offset, Value: "dictionary", Type: rv.Type()}
+		}
+	}
+
+	// skip 'd'
+	_, err := d.readByte()
+	if err != nil {
+		return err
+	}
+
+	var previousKey []byte
+	var seen map[string]bool
+	if d.allowUnsorted {
+		seen = map[string]bool{}
+	}
+
+	for first := true; ; first = false {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err = d.readByte()
+			return err
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("dictionary key must be a string")
+		}
+
+		keyOffset := d.offset
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+
+		if d.allowUnsorted {
+			if seen[string(key)] {
+				return &SyntaxError{Offset: keyOffset, Msg: fmt.Sprintf("duplicate dictionary key %q", key)}
+			}
+			seen[string(key)] = true
+		} else if !first {
+			switch cmp := bytes.Compare(previousKey, key); {
+			case cmp == 0:
+				return &SyntaxError{Offset: keyOffset, Msg: fmt.Sprintf("duplicate dictionary key %q", key)}
+			case cmp > 0:
+				return &SyntaxError{Offset: keyOffset, Msg: fmt.Sprintf("dictionary key %q is not sorted", key)}
+			}
+		}
+		previousKey = key
+
+		switch {
+		case !rv.IsValid():
+			err = d.value(reflect.Value{}, depth+1)
+		case fields != nil:
+			field, ok := fields.byName[string(key)]
+			if !ok {
+				// unknown keys are validated and skipped
+				err = d.value(reflect.Value{}, depth+1)
+				break
+			}
+			err = d.value(rv.FieldByIndex(field.index), depth+1)
+		default:
+			item := reflect.New(rv.Type().Elem()).Elem()
+			err = d.value(item, depth+1)
+			if err == nil {
+				rv.SetMapIndex(reflect.ValueOf(string(key)).Convert(rv.Type().Key()), item)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// Encoder writes canonical bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencoded form of v, nothing is written if v can't be encoded
+func (e *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+// Marshal returns the canonical bencoded form of v
+// integers, strings, byte slices and arrays, lists, maps with string keys, structs and Values are supported
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteByte('e')
+}
+
+func encodeValue(buf *bytes.Buffer, rv reflect.Value) error {
+	if !rv.IsValid() {
+		return &MarshalerError{Type: nil, Msg: "nil value"}
+	}
+
+	if rv.Type() == rawMessageType {
+		if rv.Len() == 0 {
+			return &MarshalerError{Type: rv.Type(), Msg: "empty raw message"}
+		}
+		buf.Write(rv.Bytes())
+		return nil
+	}
+
+	if rv.Type().Implements(marshalerType) && !(rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		data, err := rv.Interface().(Marshaler).MarshalBencode()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	if rv.Type() == valueType {
+		return encodeGeneric(buf, rv.Interface().(Value))
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return &MarshalerError{Type: rv.Type(), Msg: "nil value"}
+		}
+		return encodeValue(buf, rv.Elem())
+	case reflect.Bool:
+		if rv.Bool() {
+			writeInt(buf, 1)
+		} else {
+			writeInt(buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(rv.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.String:
+		writeString(buf, []byte(rv.String()))
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(data), rv)
+			writeString(buf, data)
+			return nil
+		}
+
+		buf.WriteByte('l')
+		for i := 0; i < rv.Len(); i++ {
+			err := encodeValue(buf, rv.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return &MarshalerError{Type: rv.Type(), Msg: "map keys must be strings"}
+		}
+
+		keys := make([]string, 0, rv.Len())
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			item := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+			if isNil(item) {
+				continue
+			}
+			writeString(buf, []byte(key))
+			err := encodeValue(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, field := range cachedFields(rv.Type()).list {
+			item := rv.FieldByIndex(field.index)
+			if isNil(item) || (field.omitEmpty && isEmpty(item)) {
+				continue
+			}
+			writeString(buf, []byte(field.name))
+			err := encodeValue(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &MarshalerError{Type: rv.Type(), Msg: "unsupported type"}
+	}
+	return nil
+}
+
+func encodeGeneric(buf *bytes.Buffer, v Value) error {
+	switch v.Kind {
+	case KindInt:
+		writeInt(buf, v.Int)
+	case KindString:
+		writeString(buf, []byte(v.Str))
+	case KindList:
+		buf.WriteByte('l')
+		for _, item := range v.List {
+			err := encodeGeneric(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case KindDict:
+		buf.WriteByte('d')
+		for _, key := range v.Keys() {
+			writeString(buf, []byte(key))
+			err := encodeGeneric(buf, v.Dict[key])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &MarshalerError{Type: valueType, Msg: "invalid value"}
+	}
+	return nil
+}
+
+// nil pointers and interfaces have no bencode representation, they are left out of dictionaries
+func isNil(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func isEmpty(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint() == 0
+	case reflect.Struct:
+		if rv.Type() == valueType {
+			return rv.Interface().(Value).Kind == KindInvalid
+		}
+	}
+	return false
+}
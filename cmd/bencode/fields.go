@@ -0,0 +1,61 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list   []field // sorted by name, the order they are encoded in
+	byName map[string]*field
+}
+
+var fieldCache sync.Map // reflect.Type -> *structFields
+
+// fields of a struct which take part in encoding, named by their `bencode:"name,omitempty"` tag
+func cachedFields(t reflect.Type) *structFields {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.(*structFields)
+	}
+
+	fields := &structFields{byName: map[string]*field{}}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields.list = append(fields.list, field{
+			name:      name,
+			index:     sf.Index,
+			omitEmpty: options == "omitempty",
+		})
+	}
+
+	sort.Slice(fields.list, func(i, j int) bool {
+		return fields.list[i].name < fields.list[j].name
+	})
+	for i := range fields.list {
+		fields.byName[fields.list[i].name] = &fields.list[i]
+	}
+
+	cached, _ := fieldCache.LoadOrStore(t, fields)
+	return cached.(*structFields)
+}
@@ -0,0 +1,142 @@
+package bencode
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Kind uint8
+
+const (
+	KindInvalid Kind = iota
+	KindInt
+	KindString
+	KindList
+	KindDict
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "integer"
+	case KindString:
+		return "string"
+	case KindList:
+		return "list"
+	case KindDict:
+		return "dictionary"
+	default:
+		return "invalid"
+	}
+}
+
+// Value is a generic bencode value, decoding into a Value keeps every key of the data
+// only the field matching Kind is meaningful
+type Value struct {
+	Kind Kind
+	Int  int64
+	Str  string
+	List []Value
+	Dict map[string]Value
+}
+
+func NewInt(n int64) Value {
+	return Value{Kind: KindInt, Int: n}
+}
+
+func NewString(s string) Value {
+	return Value{Kind: KindString, Str: s}
+}
+
+func NewList(values ...Value) Value {
+	return Value{Kind: KindList, List: values}
+}
+
+func NewDict(entries map[string]Value) Value {
+	if entries == nil {
+		entries = map[string]Value{}
+	}
+	return Value{Kind: KindDict, Dict: entries}
+}
+
+// returns value stored under key, ok is false if value is not a dictionary or key is missing
+func (v Value) Get(key string) (Value, bool) {
+	if v.Kind != KindDict {
+		return Value{}, false
+	}
+	value, ok := v.Dict[key]
+	return value, ok
+}
+
+// sorted keys of a dictionary, this is the order they are encoded in
+func (v Value) Keys() []string {
+	keys := make([]string, 0, len(v.Dict))
+	for key := range v.Dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// human readable representation, useful for debugging
+func (v Value) String() string {
+	var sb strings.Builder
+	v.writeString(&sb)
+	return sb.String()
+}
+
+func (v Value) writeString(sb *strings.Builder) {
+	switch v.Kind {
+	case KindInt:
+		sb.WriteString(strconv.FormatInt(v.Int, 10))
+	case KindString:
+		sb.WriteString(strconv.Quote(v.Str))
+	case KindList:
+		sb.WriteByte('[')
+		for i, item := range v.List {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			item.writeString(sb)
+		}
+		sb.WriteByte(']')
+	case KindDict:
+		sb.WriteByte('{')
+		for i, key := range v.Keys() {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(strconv.Quote(key))
+			sb.WriteString(": ")
+			v.Dict[key].writeString(sb)
+		}
+		sb.WriteByte('}')
+	default:
+		sb.WriteString("<invalid>")
+	}
+}
+
+// converts value into plain go types: int64, string, []any and map[string]any
+func (v Value) Interface() any {
+	switch v.Kind {
+	case KindInt:
+		return v.Int
+	case KindString:
+		return v.Str
+	case KindList:
+		list := make([]any, len(v.List))
+		for i, item := range v.List {
+			list[i] = item.Interface()
+		}
+		return list
+	case KindDict:
+		dict := make(map[string]any, len(v.Dict))
+		for key, item := range v.Dict {
+			dict[key] = item.Interface()
+		}
+		return dict
+	default:
+		return nil
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/umair-hassan2/torrent-client/cmd/common"
 	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
 	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
@@ -18,9 +20,46 @@ type Client struct {
 	Peer     types.Peer
 	BitField message.BitField
 	Choked   bool
+	// reserved bytes of the remote handshake, the extensions remote peer supports
+	Reserved Reserved
+	// remote peer speaks the extension protocol
+	SupportsExtensions bool
+	// remote peer speaks the fast extension
+	SupportsFast bool
+	// remote peer sent have all instead of a bitfield
+	HaveAll bool
+	// pieces remote peer lets us request while it chokes us
+	AllowedFast map[int]bool
+	// extension name -> message id the remote peer wants to receive it with
+	Extensions map[string]uint8
+	// size of the info dictionary as advertised by the remote peer, 0 if unknown
+	MetadataSize int
+	// client name and version of the remote peer, empty if unknown
+	Version string
+	// port remote peer listens on, 0 if unknown
+	ListenPort int
+	// requests remote peer queues without dropping any, 0 if unknown
+	RequestQueue int
+	// our ip as remote peer sees it, nil if unknown
+	YourIp net.IP
+	// remote peer connected to us, it's port is not the one it listens on
+	Incoming bool
+	// the connection is rc4 encrypted
+	Encrypted bool
+
+	// messages are read by the goroutine serving the connection
+	decoder *message.Decoder
+	// nil until BufferWrites, messages are written right away then
+	writer *message.Writer
+}
+
+// true for connections which went through an mse handshake selecting rc4
+func encrypted(con net.Conn) bool {
+	encrypted, ok := con.(*mse.Conn)
+	return ok && encrypted.Encrypted()
 }
 
-func StartHandShake(con net.Conn, infoHash, peerId [20]byte) error {
+func StartHandShake(con net.Conn, infoHash, peerId [20]byte) (*HandShake, error) {
 	con.SetDeadline(time.Now().Add(3 * time.Second))
 	defer con.SetDeadline(time.Time{})
 	// we send hand shake request with payload having info hash, peer id, pstr, pstr length, reserved bytes
@@ -29,119 +68,294 @@ func StartHandShake(con net.Conn, infoHash, peerId [20]byte) error {
 	// send handshake request
 	_, err := con.Write(handShake.Serialize())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// read from connection
 	handShakeResponse, err := ReadHandShake(con)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// verify integrity of info hash
 	if !bytes.Equal(handShake.infoHash[:], handShakeResponse.infoHash[:]) {
-		return fmt.Errorf("info hash mismatch")
+		return nil, fmt.Errorf("info hash mismatch")
 	}
 
-	return nil
+	return handShakeResponse, nil
 }
 
-func readBitFieldMessage(conn net.Conn) (message.BitField, error) {
+func (c *Client) readBitFieldMessage() (message.BitField, error) {
+	conn := c.Con
 	// set time outs
 	conn.SetDeadline(time.Now().Add(time.Second * 3))
 	defer conn.SetDeadline(time.Time{})
 
-	// Read message from the connection
-	msg, err := message.Read(conn)
+	for {
+		// Read message from the connection
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		// keep-alive
+		if msg == nil {
+			continue
+		}
+
+		// extended handshake can be sent before the bitfield
+		if msg.Id == message.MsgExtended && c.SupportsExtensions {
+			err = c.HandleExtendedMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// peers speaking the fast extension can send have all or have none instead
+		// a full bitfield needs the piece count, so have all is kept in HaveAll
+		if c.SupportsFast && msg.Id == message.MsgHaveAll {
+			c.HaveAll = true
+			return nil, nil
+		}
+		if c.SupportsFast && msg.Id == message.MsgHaveNone {
+			return message.BitField{}, nil
+		}
+
+		// verify that this message is a bitfield message
+		if msg.Id != message.MsgBitfield {
+			return nil, fmt.Errorf("expected a bit field message but received %s", message.FindMessagebyId(msg.Id))
+		}
+
+		// the payload is in the buffer of the decoder
+		return append(message.BitField{}, msg.Payload...), nil
+	}
+}
+
+// remote peers have this long to finish the mse handshake
+const encryptionTimeout = 10 * time.Second
+
+// opens the connection to a peer, e.g. Dialer.Dial
+type DialFunc func(peer types.Peer) (net.Conn, error)
+
+// open a tcp connection to a peer
+func DialTCP(peer types.Peer) (net.Conn, error) {
+	return TcpCon{}.Dial(common.PeerAdress(peer), DefaultDialTimeout)
+}
+
+// open a plaintext connection to remote peer and exchange handshakes, nothing else is read from the connection
+func Dial(peer types.Peer, peerId, infoHash [20]byte) (*Client, error) {
+	return DialWithPolicy(peer, peerId, infoHash, mse.PlaintextOnly)
+}
+
+// like Dial, the connection is encrypted as the policy says
+// peers which don't speak mse are connected to again in plaintext when encryption is only preferred
+func DialWithPolicy(peer types.Peer, peerId, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	return DialWith(DialTCP, peer, peerId, infoHash, policy)
+}
+
+// like DialWithPolicy, the connection is opened by dial
+func DialWith(dial DialFunc, peer types.Peer, peerId, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	con, err := dial(peer)
 	if err != nil {
 		return nil, err
 	}
 
-	if msg == nil {
-		return nil, fmt.Errorf("expected a bit field message but received null message")
+	if policy != mse.PlaintextOnly {
+		con.SetDeadline(time.Now().Add(encryptionTimeout))
+		encrypted, err := mse.Initiate(con, infoHash, policy)
+		if err != nil {
+			con.Close()
+			if policy == mse.PreferEncrypted {
+				return DialWith(dial, peer, peerId, infoHash, mse.PlaintextOnly)
+			}
+			return nil, err
+		}
+		con.SetDeadline(time.Time{})
+		con = encrypted
 	}
 
-	// verify that this message is a bitfield message
-	if msg.Id == message.MsgBitfield {
-		return nil, fmt.Errorf("expected a bit field message but received %s", message.FindMessagebyId(msg.Id))
+	handShake, err := StartHandShake(con, infoHash, peerId)
+	if err != nil {
+		con.Close()
+		return nil, err
 	}
 
-	return msg.Payload, nil
+	newClient := Client{
+		PeerId:             peerId,
+		Peer:               peer,
+		InfoHash:           infoHash,
+		Con:                con,
+		Choked:             true, // peer is choked by default
+		Encrypted:          encrypted(con),
+		Reserved:           handShake.Reserved(),
+		SupportsExtensions: handShake.SupportsExtensions(),
+		SupportsFast:       handShake.Reserved().Has(FastExtension),
+		AllowedFast:        map[int]bool{},
+		Extensions:         map[string]uint8{},
+	}
+	return &newClient, nil
 }
 
-func New(peer types.Peer, peerId, infoHash [20]byte) (*Client, error) {
-	// open a tcp connection
-	con, err := net.DialTimeout("tcp", common.PeerAdress(peer), 3*time.Millisecond)
+// answer the handshake of a remote peer which connected to us, remote has to be read from con already
+// our handshake is sent for the torrent remote asked for
+func Accept(con net.Conn, remote *HandShake, peerId [20]byte) (*Client, error) {
+	con.SetDeadline(time.Now().Add(3 * time.Second))
+	defer con.SetDeadline(time.Time{})
+	_, err := con.Write(NewHandShake(remote.infoHash, peerId).Serialize())
 	if err != nil {
 		return nil, err
 	}
 
-	err = StartHandShake(con, infoHash, peerId)
+	peer := types.Peer{ID: string(remote.peerId[:])}
+	switch addr := con.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		peer.IP, peer.Port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		peer.IP, peer.Port = addr.IP, addr.Port
+	default:
+		// addresses of other transports, e.g. pipes, are host:port as well
+		host, port, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			peer.IP = net.ParseIP(host)
+			peer.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return &Client{
+		PeerId:             peerId,
+		Peer:               peer,
+		InfoHash:           remote.infoHash,
+		Con:                con,
+		Choked:             true,
+		Encrypted:          encrypted(con),
+		Reserved:           remote.Reserved(),
+		SupportsExtensions: remote.SupportsExtensions(),
+		SupportsFast:       remote.Reserved().Has(FastExtension),
+		AllowedFast:        map[int]bool{},
+		Extensions:         map[string]uint8{},
+		Incoming:           true,
+	}, nil
+}
+
+// wait for the bitfield of remote peer, extended handshakes sent before it are handled on the way
+// have all leaves BitField nil and sets HaveAll
+func (c *Client) ReadBitField() error {
+	bitField, err := c.readBitFieldMessage()
+	if err != nil {
+		return err
+	}
+	c.BitField = bitField
+	return nil
+}
+
+func New(peer types.Peer, peerId, infoHash [20]byte) (*Client, error) {
+	return NewWithPolicy(peer, peerId, infoHash, mse.PlaintextOnly)
+}
+
+// like New, the connection is encrypted as the policy says
+func NewWithPolicy(peer types.Peer, peerId, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	return NewWith(DialTCP, peer, peerId, infoHash, policy)
+}
+
+// like NewWithPolicy, the connection is opened by dial
+func NewWith(dial DialFunc, peer types.Peer, peerId, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	c, err := DialWith(dial, peer, peerId, infoHash, policy)
 	if err != nil {
-		con.Close()
 		return nil, err
 	}
 
-	// read bitfield message
-	bitFieldMessage, err := readBitFieldMessage(con)
+	err = c.ReadBitField()
 	if err != nil {
-		con.Close()
+		c.Con.Close()
 		return nil, err
 	}
+	return c, nil
+}
 
-	newClient := Client{
-		PeerId:   peerId,
-		Peer:     peer,
-		InfoHash: infoHash,
-		BitField: bitFieldMessage,
-		Con:      con,
-		Choked:   true, // peer is choked by default
+// read the next message of remote peer, keep-alives are returned as nil
+// the payload is overwritten by the next read, only the goroutine serving the connection reads
+func (c *Client) ReadMessage() (*message.Message, error) {
+	if c.decoder == nil {
+		c.decoder = message.NewDecoder(c.Con)
 	}
-	return &newClient, nil
+	return c.decoder.Decode()
+}
+
+// batch the messages we send into fewer writes, called before the connection is used by more than one goroutine
+func (c *Client) BufferWrites() {
+	c.writer = message.NewWriter(c.Con)
+}
+
+// write the messages waiting in the batch
+func (c *Client) Flush() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// send a message to remote peer
+func (c *Client) Send(msg *message.Message) error {
+	if c.writer != nil {
+		return c.writer.WriteMessage(msg)
+	}
+	_, err := c.Con.Write(msg.Serialize())
+	return err
+}
+
+// tell remote peer we are still here, it's written at once even when writes are batched
+func (c *Client) SendKeepAlive() error {
+	if c.writer != nil {
+		return c.writer.WriteKeepAlive()
+	}
+	_, err := c.Con.Write(make([]byte, 4))
+	return err
 }
 
 // there are basic 9 types of messages
 func (c *Client) SendHave(pieceIndex int) error {
 	message := message.FormatHaveMessage(pieceIndex)
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(message)
+}
+
+func (c *Client) SendBitField(bitField message.BitField) error {
+	message := message.Message{
+		Id:      message.MsgBitfield,
+		Payload: bitField,
+	}
+	return c.Send(&message)
 }
 
 func (c *Client) SendChoke() error {
 	message := message.Message{
 		Id: message.MsgChoke,
 	}
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(&message)
 }
 
 func (c *Client) SendUnChoke() error {
 	message := message.Message{
 		Id: message.MsgUnChoke,
 	}
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(&message)
 }
 
 func (c *Client) SendInterested() error {
 	message := message.Message{
 		Id: message.MsgInterested,
 	}
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(&message)
 }
 
 func (c *Client) SendNotInterested() error {
 	message := message.Message{
 		Id: message.MsgNotInterested,
 	}
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(&message)
 }
 
 func (c *Client) SendRequest(pieceIndex, begin, length int) error {
 	message := message.FormatRequestMessage(pieceIndex, begin, length)
-	_, err := c.Con.Write(message.Serialize())
-	return err
+	return c.Send(message)
 }
@@ -1,44 +1,142 @@
 package client
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
 
-type Con struct {
-	timeOut int
-	tp      string
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+)
+
+// Transport opens and accepts the connections peers talk over, e.g. tcp or uTP
+type Transport interface {
+	// name in dialer stats, unique among the transports of a Dialer
+	Name() string
+	// connect to a peer at a host:port address, giving up after timeout unless it's 0
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
 }
 
-type TcpCon struct {
-	Con
+// TcpCon is the transport of plain tcp connections
+type TcpCon struct{}
+
+func (TcpCon) Name() string {
+	return "tcp"
 }
+
+func (TcpCon) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (TcpCon) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// UdpCon is the transport of uTP connections, they are dialed from the socket Listen opened
 type UdpCon struct {
-	Con
+	// set by Listen, or to share a socket which is open already
+	Socket *utp.Socket
+}
+
+func (u *UdpCon) Name() string {
+	return "utp"
+}
+
+func (u *UdpCon) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if u.Socket == nil {
+		return nil, fmt.Errorf("dial utp %s: transport is not listening", addr)
+	}
+	return u.Socket.DialTimeout(addr, timeout)
+}
+
+// the socket accepts uTP connections and is shared by the ones we dial, udp traffic of other protocols included
+func (u *UdpCon) Listen(addr string) (net.Listener, error) {
+	if u.Socket != nil {
+		return nil, fmt.Errorf("listen utp %s: transport listens on %s already", addr, u.Socket.Addr())
+	}
+	socket, err := utp.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	u.Socket = socket
+	return socket, nil
 }
 
 type HandShake struct {
 	infoHash [20]byte
 	peerId   [20]byte
 	pstr     string // BitTorrent protocol
+	reserved Reserved
 }
 
+// reserved bytes of a handshake, every set bit announces support for a protocol extension
+type Reserved [8]byte
+
+// bit of the reserved bytes, counted from the first byte
+type ReservedBit struct {
+	index int
+	mask  byte
+}
+
+var (
+	// extension protocol - https://www.bittorrent.org/beps/bep_0010.html
+	ExtensionProtocol = ReservedBit{5, 0x10}
+	// port message of the DHT - https://www.bittorrent.org/beps/bep_0005.html
+	DHTPort = ReservedBit{7, 0x01}
+	// fast extension - https://www.bittorrent.org/beps/bep_0006.html
+	FastExtension = ReservedBit{7, 0x04}
+)
+
+func (r Reserved) Has(bit ReservedBit) bool {
+	return r[bit.index]&bit.mask != 0
+}
+
+func (r *Reserved) Set(bit ReservedBit) {
+	r[bit.index] |= bit.mask
+}
+
+const protocolId = "BitTorrent protocol"
+
 func NewHandShake(infoHash, peerId [20]byte) *HandShake {
-	return &HandShake{
+	handShake := &HandShake{
 		infoHash: infoHash,
 		peerId:   peerId,
-		pstr:     "BitTorrent protocol",
+		pstr:     protocolId,
 	}
+	handShake.reserved.Set(ExtensionProtocol)
+	handShake.reserved.Set(FastExtension)
+	return handShake
+}
+
+// true if the sender of this handshake speaks the extension protocol
+func (h *HandShake) SupportsExtensions() bool {
+	return h.reserved.Has(ExtensionProtocol)
+}
+
+// extensions the sender of this handshake supports
+func (h *HandShake) Reserved() Reserved {
+	return h.reserved
+}
+
+func (h *HandShake) InfoHash() [20]byte {
+	return h.infoHash
+}
+
+func (h *HandShake) PeerId() [20]byte {
+	return h.peerId
 }
 
 // build a handshake buffer
 func (h *HandShake) Serialize() []byte {
-	var reservedBytes [8]byte
 	buf := make([]byte, len(h.pstr)+8+1+20+20)
 	// length of protocol identifier
 	buf[0] = byte(len(h.pstr))
 	//protocol identifier string
 	idx := 1
 	idx += copy(buf[idx:], h.pstr)
-	// reserved bytes - currently keeping it 0
-	idx += copy(buf[idx:], reservedBytes[:])
+	// reserved bytes - flags of supported protocol extensions
+	idx += copy(buf[idx:], h.reserved[:])
 	// info hash
 	idx += copy(buf[idx:], h.infoHash[:])
 	// peer id
@@ -60,6 +158,9 @@ func ReadHandShake(conn io.Reader) (*HandShake, error) {
 	if err != nil {
 		return nil, err
 	}
+	if string(pstrBuf) != protocolId {
+		return nil, fmt.Errorf("unknown protocol %q", pstrBuf)
+	}
 
 	// read remaining data from connection
 	handShakeBuf := make([]byte, 48)
@@ -69,12 +170,15 @@ func ReadHandShake(conn io.Reader) (*HandShake, error) {
 	}
 
 	var infoHash, peerId [20]byte
+	var reserved Reserved
+	copy(reserved[:], handShakeBuf[0:8])
 	copy(infoHash[:], handShakeBuf[8:8+20])
 	copy(peerId[:], handShakeBuf[8+20:8+20+20])
 	handShake := HandShake{
 		infoHash: infoHash,
 		peerId:   peerId,
 		pstr:     string(pstrBuf),
+		reserved: reserved,
 	}
 
 	return &handShake, nil
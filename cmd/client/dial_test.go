@@ -0,0 +1,85 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+var (
+	testInfoHash = [20]byte{1}
+	remotePeerId = [20]byte{2}
+)
+
+// answer the handshake of the first connection accepted by l
+func acceptHandShake(t *testing.T, l net.Listener) <-chan *Client {
+	accepted := make(chan *Client, 1)
+	go func() {
+		defer close(accepted)
+		con, err := l.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { con.Close() })
+		handShake, err := ReadHandShake(con)
+		if err != nil {
+			return
+		}
+		c, err := Accept(con, handShake, remotePeerId)
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	return accepted
+}
+
+func utpSocket(t *testing.T) *utp.Socket {
+	socket, err := utp.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func peerAt(addr net.Addr) types.Peer {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return types.Peer{IP: addr.IP, Port: addr.Port}
+	case *net.TCPAddr:
+		return types.Peer{IP: addr.IP, Port: addr.Port}
+	}
+	return types.Peer{}
+}
+
+func TestDialOverUTP(t *testing.T) {
+	local, remote := utpSocket(t), utpSocket(t)
+	accepted := acceptHandShake(t, remote)
+
+	c, err := DialWith(PreferUTP(local).Dial, peerAt(remote.Addr()), [20]byte{3}, testInfoHash, mse.PlaintextOnly)
+	require.NoError(t, err)
+	defer c.Con.Close()
+	assert.IsType(t, &utp.Conn{}, c.Con)
+	assert.True(t, c.SupportsFast, "handshake of the remote peer was read")
+
+	incoming := <-accepted
+	require.NotNil(t, incoming)
+	assert.Equal(t, local.Addr().(*net.UDPAddr).Port, incoming.Peer.Port, "address of uTP peers is known")
+}
+
+func TestFallBackToTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := acceptHandShake(t, l)
+
+	// nobody answers uTP on the port of the tcp listener
+	c, err := DialWith(PreferUTP(utpSocket(t)).Dial, peerAt(l.Addr()), [20]byte{3}, testInfoHash, mse.PlaintextOnly)
+	require.NoError(t, err)
+	defer c.Con.Close()
+	assert.IsType(t, &net.TCPConn{}, c.Con)
+	require.NotNil(t, <-accepted)
+}
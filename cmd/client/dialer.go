@@ -0,0 +1,220 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+const (
+	// how long a transport may take to connect when it was registered without a timeout
+	DefaultDialTimeout = 5 * time.Second
+	// peers which don't answer over uTP this fast are connected to over tcp as well
+	utpHeadStart = time.Second
+	// uTP has no handshake of it's own to tell a dead peer apart, a SYN is given up on after this
+	utpDialTimeout = 3 * time.Second
+)
+
+// Strategy decides in which order the transports of a Dialer are tried
+type Strategy int
+
+const (
+	// transports are tried one after the other in the order they were registered
+	Sequential Strategy = iota
+	// every transport is dialed at once, the first connection wins
+	Race
+	// transports start Stagger apart in the order they were registered, a failure starts the next one at once
+	Staggered
+)
+
+// TransportStats counts the dials of a transport
+type TransportStats struct {
+	Attempts  int
+	Connected int
+	Failed    int
+	TimedOut  int
+	// connected after another transport won the race, the connection was closed
+	Abandoned int
+}
+
+type registeredTransport struct {
+	transport Transport
+	timeout   time.Duration
+	stats     TransportStats
+}
+
+// Dialer connects to peers over the transports registered to it
+// Strategy and Stagger are set before the first Dial
+type Dialer struct {
+	Strategy Strategy
+	// head start of a transport over the next one with Staggered
+	Stagger time.Duration
+
+	mu         sync.Mutex
+	transports []*registeredTransport
+}
+
+func NewDialer() *Dialer {
+	return &Dialer{}
+}
+
+// dialer trying uTP over socket first and tcp when the peer doesn't answer in time, tcp only when socket is nil
+func PreferUTP(socket *utp.Socket) *Dialer {
+	d := NewDialer()
+	if socket != nil {
+		d.Strategy, d.Stagger = Staggered, utpHeadStart
+		d.Register(&UdpCon{Socket: socket}, utpDialTimeout)
+	}
+	d.Register(TcpCon{}, DefaultDialTimeout)
+	return d
+}
+
+// add a transport after the ones registered before, timeout 0 is DefaultDialTimeout
+// it panics when a transport of the same name is registered already
+func (d *Dialer) Register(t Transport, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, registered := range d.transports {
+		if registered.transport.Name() == t.Name() {
+			panic(fmt.Sprintf("transport %s is registered twice", t.Name()))
+		}
+	}
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	d.transports = append(d.transports, &registeredTransport{transport: t, timeout: timeout})
+}
+
+// transport registered under name
+func (d *Dialer) Transport(name string) (Transport, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, registered := range d.transports {
+		if registered.transport.Name() == name {
+			return registered.transport, true
+		}
+	}
+	return nil, false
+}
+
+// stats of every transport by it's name
+func (d *Dialer) Stats() map[string]TransportStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := map[string]TransportStats{}
+	for _, registered := range d.transports {
+		stats[registered.transport.Name()] = registered.stats
+	}
+	return stats
+}
+
+func (d *Dialer) record(registered *registeredTransport, count func(stats *TransportStats)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	count(&registered.stats)
+}
+
+type dialResult struct {
+	con        net.Conn
+	err        error
+	registered *registeredTransport
+}
+
+// dial one transport, transports which don't give up in time are left behind and their connection is closed
+func (d *Dialer) dialTransport(registered *registeredTransport, addr string, results chan<- dialResult) {
+	d.record(registered, func(stats *TransportStats) { stats.Attempts++ })
+	dialed := make(chan dialResult, 1)
+	go func() {
+		con, err := registered.transport.Dial(addr, registered.timeout)
+		dialed <- dialResult{con, err, registered}
+	}()
+
+	timer := time.NewTimer(registered.timeout)
+	defer timer.Stop()
+	select {
+	case result := <-dialed:
+		if result.err != nil {
+			d.record(registered, func(stats *TransportStats) { stats.Failed++ })
+			result.err = fmt.Errorf("%s: %w", registered.transport.Name(), result.err)
+		}
+		results <- result
+	case <-timer.C:
+		d.record(registered, func(stats *TransportStats) { stats.TimedOut++ })
+		go func() {
+			if late := <-dialed; late.err == nil {
+				late.con.Close()
+			}
+		}()
+		results <- dialResult{err: fmt.Errorf("%s: timed out after %v", registered.transport.Name(), registered.timeout), registered: registered}
+	}
+}
+
+// Dial connects to peer as the strategy says, it's a DialFunc
+func (d *Dialer) Dial(peer types.Peer) (net.Conn, error) {
+	addr := common.PeerAdress(peer)
+	d.mu.Lock()
+	transports := append([]*registeredTransport{}, d.transports...)
+	d.mu.Unlock()
+	if len(transports) == 0 {
+		return nil, fmt.Errorf("dial %s: no transport registered", addr)
+	}
+
+	results := make(chan dialResult, len(transports))
+	next, running := 0, 0
+	var stagger <-chan time.Time
+	startNext := func() {
+		go d.dialTransport(transports[next], addr, results)
+		next++
+		running++
+		if d.Strategy == Staggered && next < len(transports) {
+			stagger = time.After(d.Stagger)
+		}
+	}
+	startNext()
+	for d.Strategy == Race && next < len(transports) {
+		startNext()
+	}
+
+	errs := []error{}
+	for running > 0 {
+		select {
+		case <-stagger:
+			stagger = nil
+			if next < len(transports) {
+				startNext()
+			}
+		case result := <-results:
+			running--
+			if result.err != nil {
+				errs = append(errs, result.err)
+				if next < len(transports) {
+					// the next transport starts now, not when the head start of the failed one is over
+					stagger = nil
+					startNext()
+				}
+				continue
+			}
+			d.record(result.registered, func(stats *TransportStats) { stats.Connected++ })
+			go d.abandon(results, running)
+			return result.con, nil
+		}
+	}
+	return nil, fmt.Errorf("dial %s: %w", addr, errors.Join(errs...))
+}
+
+// close the connections of transports which lost the race
+func (d *Dialer) abandon(results <-chan dialResult, running int) {
+	for ; running > 0; running-- {
+		result := <-results
+		if result.err == nil {
+			d.record(result.registered, func(stats *TransportStats) { stats.Abandoned++ })
+			result.con.Close()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// transport under a name of it's own which waits before dialing
+type slowTransport struct {
+	Transport
+	name  string
+	delay time.Duration
+}
+
+func (s *slowTransport) Name() string {
+	return s.name
+}
+
+func (s *slowTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	time.Sleep(s.delay)
+	return s.Transport.Dial(addr, timeout)
+}
+
+// pipe listener at 10.0.0.1:6881 which accepts every connection
+func pipePeer(t *testing.T, pipes *PipeCon) types.Peer {
+	l, err := pipes.Listen("10.0.0.1:6881")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { con.Close() })
+		}
+	}()
+	return types.Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+}
+
+func TestPipeTransport(t *testing.T) {
+	pipes := NewPipeCon()
+	l, err := pipes.Listen("10.0.0.1:6881")
+	require.NoError(t, err)
+	_, err = pipes.Listen("10.0.0.1:6881")
+	assert.Error(t, err, "address in use")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, _ := l.Accept()
+		accepted <- con
+	}()
+	dialed, err := pipes.Dial("10.0.0.1:6881", time.Second)
+	require.NoError(t, err)
+	remote := <-accepted
+	require.NotNil(t, remote)
+	assert.Equal(t, "10.0.0.1:6881", dialed.RemoteAddr().String())
+	assert.Equal(t, dialed.LocalAddr().String(), remote.RemoteAddr().String())
+
+	go dialed.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(remote, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	_, err = pipes.Dial("10.0.0.2:6881", time.Second)
+	assert.Error(t, err, "nobody listens")
+	_, err = pipes.Dial("10.0.0.1:6881", 10*time.Millisecond)
+	assert.Error(t, err, "nobody accepts")
+	require.NoError(t, l.Close())
+	_, err = pipes.Dial("10.0.0.1:6881", time.Second)
+	assert.Error(t, err)
+}
+
+func TestSequentialDialerFallsBack(t *testing.T) {
+	pipes := NewPipeCon()
+	peer := pipePeer(t, pipes)
+
+	d := NewDialer()
+	d.Register(&slowTransport{Transport: NewPipeCon(), name: "nowhere"}, time.Second)
+	d.Register(pipes, time.Second)
+	con, err := d.Dial(peer)
+	require.NoError(t, err)
+	defer con.Close()
+
+	stats := d.Stats()
+	assert.Equal(t, TransportStats{Attempts: 1, Failed: 1}, stats["nowhere"])
+	assert.Equal(t, TransportStats{Attempts: 1, Connected: 1}, stats["pipe"])
+
+	_, err = d.Dial(types.Peer{IP: net.ParseIP("10.0.0.9"), Port: 1})
+	assert.ErrorContains(t, err, "nowhere")
+	assert.ErrorContains(t, err, "pipe")
+}
+
+func TestRaceDialerTakesFirstConnection(t *testing.T) {
+	pipes := NewPipeCon()
+	peer := pipePeer(t, pipes)
+
+	d := NewDialer()
+	d.Strategy = Race
+	d.Register(&slowTransport{Transport: pipes, name: "slow", delay: 100 * time.Millisecond}, time.Second)
+	d.Register(pipes, time.Second)
+	start := time.Now()
+	con, err := d.Dial(peer)
+	require.NoError(t, err)
+	defer con.Close()
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return d.Stats()["slow"] == TransportStats{Attempts: 1, Abandoned: 1}
+	}, time.Second, 10*time.Millisecond, "connection of the loser is closed")
+	assert.Equal(t, 1, d.Stats()["pipe"].Connected)
+}
+
+func TestStaggeredDialerStartsNextTransport(t *testing.T) {
+	pipes := NewPipeCon()
+	peer := pipePeer(t, pipes)
+
+	d := NewDialer()
+	d.Strategy, d.Stagger = Staggered, 50*time.Millisecond
+	d.Register(&slowTransport{Transport: pipes, name: "hanging", delay: time.Hour}, time.Hour)
+	d.Register(pipes, time.Second)
+	start := time.Now()
+	con, err := d.Dial(peer)
+	require.NoError(t, err)
+	defer con.Close()
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestStaggeredDialerAfterEarlyFailure(t *testing.T) {
+	pipes := NewPipeCon()
+	peer := pipePeer(t, pipes)
+
+	d := NewDialer()
+	d.Strategy, d.Stagger = Staggered, 20*time.Millisecond
+	d.Register(&slowTransport{Transport: NewPipeCon(), name: "refused"}, time.Second)
+	d.Register(&slowTransport{Transport: pipes, name: "slow", delay: 100 * time.Millisecond}, time.Second)
+	con, err := d.Dial(peer)
+	require.NoError(t, err, "the head start of the failed transport runs out while the next one dials")
+	defer con.Close()
+
+	stats := d.Stats()
+	assert.Equal(t, TransportStats{Attempts: 1, Failed: 1}, stats["refused"])
+	assert.Equal(t, TransportStats{Attempts: 1, Connected: 1}, stats["slow"])
+}
+
+func TestDialerTimeout(t *testing.T) {
+	pipes := NewPipeCon()
+	peer := pipePeer(t, pipes)
+
+	d := NewDialer()
+	d.Register(&slowTransport{Transport: pipes, name: "hanging", delay: time.Hour}, 20*time.Millisecond)
+	_, err := d.Dial(peer)
+	assert.ErrorContains(t, err, "timed out")
+	assert.Equal(t, TransportStats{Attempts: 1, TimedOut: 1}, d.Stats()["hanging"])
+}
+
+func TestRegisterTransportTwice(t *testing.T) {
+	d := NewDialer()
+	d.Register(TcpCon{}, 0)
+	assert.Panics(t, func() { d.Register(TcpCon{}, 0) })
+	transport, ok := d.Transport("tcp")
+	assert.True(t, ok)
+	assert.Equal(t, TcpCon{}, transport)
+	_, err := NewDialer().Dial(types.Peer{IP: net.ParseIP("10.0.0.1"), Port: 1})
+	assert.Error(t, err, "no transport registered")
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+)
+
+func (c *Client) SendExtendedHandshake(handshake message.ExtendedHandshake) error {
+	msg, err := message.FormatExtendedHandshake(handshake)
+	if err != nil {
+		return err
+	}
+	return c.Send(msg)
+}
+
+// send payload of an extension using the message id remote peer asked for in it's handshake
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id, ok := c.Extensions[name]
+	if !ok {
+		return fmt.Errorf("remote peer does not support extension %q", name)
+	}
+	msg := message.FormatExtendedMessage(id, payload)
+	return c.Send(msg)
+}
+
+// remember what remote peer told us in it's extended handshake
+// other extended messages are left for the caller
+func (c *Client) HandleExtendedMessage(msg *message.Message) error {
+	id, payload, err := message.ParseExtendedMessage(msg)
+	if err != nil {
+		return err
+	}
+	if id != message.ExtendedHandshakeId {
+		return nil
+	}
+
+	handshake, err := message.ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	// an id of 0 means the extension is disabled
+	for name, id := range handshake.M {
+		if id <= 0 || id > 255 {
+			delete(c.Extensions, name)
+			continue
+		}
+		c.Extensions[name] = uint8(id)
+	}
+	if handshake.MetadataSize > 0 {
+		c.MetadataSize = handshake.MetadataSize
+	}
+	// handshakes can be sent again to update a single value, missing keys keep what we know
+	if handshake.V != "" {
+		c.Version = handshake.V
+	}
+	if handshake.P > 0 && handshake.P <= 65535 {
+		c.ListenPort = handshake.P
+	}
+	if handshake.Reqq > 0 {
+		c.RequestQueue = handshake.Reqq
+	}
+	if len(handshake.YourIp) == net.IPv4len || len(handshake.YourIp) == net.IPv6len {
+		c.YourIp = net.IP(handshake.YourIp)
+	}
+	return nil
+}
+
+// handles the payload of an extended message, the remote peer sent it with the id the extension was registered with
+type ExtensionHandler func(c *Client, payload []byte) error
+
+// extensions we speak, extended messages are routed to their handlers by the message id we picked for them
+type ExtensionRegistry struct {
+	mu       sync.Mutex
+	names    map[uint8]string
+	handlers map[uint8]ExtensionHandler
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{names: map[uint8]string{}, handlers: map[uint8]ExtensionHandler{}}
+}
+
+// register an extension under the message id remote peers should send it to us with
+// id 0 belongs to the extended handshake, registering a name or an id twice panics
+func (r *ExtensionRegistry) Register(name string, id uint8, handler ExtensionHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == message.ExtendedHandshakeId {
+		panic(fmt.Sprintf("extension %q can't use the id of the extended handshake", name))
+	}
+	if registered, ok := r.names[id]; ok {
+		panic(fmt.Sprintf("extension %q uses id %d of extension %q", name, id, registered))
+	}
+	for _, registered := range r.names {
+		if registered == name {
+			panic(fmt.Sprintf("extension %q is registered twice", name))
+		}
+	}
+	r.names[id] = name
+	r.handlers[id] = handler
+}
+
+// m dictionary of our extended handshake
+func (r *ExtensionRegistry) M() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := map[string]int{}
+	for id, name := range r.names {
+		m[name] = int(id)
+	}
+	return m
+}
+
+// route an extended message to it's extension, an extended handshake updates what we know about the remote peer
+// messages with an id we never handed out are ignored
+func (r *ExtensionRegistry) Handle(c *Client, msg *message.Message) error {
+	id, payload, err := message.ParseExtendedMessage(msg)
+	if err != nil {
+		return err
+	}
+	if id == message.ExtendedHandshakeId {
+		return c.HandleExtendedMessage(msg)
+	}
+
+	r.mu.Lock()
+	handler, ok := r.handlers[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return handler(c, payload)
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+)
+
+func TestReservedBitsSurviveHandshake(t *testing.T) {
+	var infoHash, peerId [20]byte
+	handShake := NewHandShake(infoHash, peerId)
+	handShake.reserved.Set(FastExtension)
+
+	read, err := ReadHandShake(bytes.NewReader(handShake.Serialize()))
+	require.NoError(t, err)
+	assert.True(t, read.SupportsExtensions())
+	assert.True(t, read.Reserved().Has(ExtensionProtocol))
+	assert.True(t, read.Reserved().Has(FastExtension))
+	assert.False(t, read.Reserved().Has(DHTPort))
+	assert.Equal(t, Reserved{0, 0, 0, 0, 0, 0x10, 0, 0x04}, read.Reserved())
+}
+
+func extendedHandshakeMessage(t *testing.T, handshake message.ExtendedHandshake) *message.Message {
+	msg, err := message.FormatExtendedHandshake(handshake)
+	require.NoError(t, err)
+	return msg
+}
+
+func TestExtendedHandshakeFields(t *testing.T) {
+	c := &Client{Extensions: map[string]uint8{"ut_pex": 1}}
+	require.NoError(t, c.HandleExtendedMessage(extendedHandshakeMessage(t, message.ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": 3, "ut_pex": 0},
+		MetadataSize: 1234,
+		V:            "other client 1.0",
+		P:            51413,
+		Reqq:         500,
+		YourIp:       string(net.ParseIP("203.0.113.7").To4()),
+	})))
+
+	assert.Equal(t, map[string]uint8{"ut_metadata": 3}, c.Extensions)
+	assert.Equal(t, 1234, c.MetadataSize)
+	assert.Equal(t, "other client 1.0", c.Version)
+	assert.Equal(t, 51413, c.ListenPort)
+	assert.Equal(t, 500, c.RequestQueue)
+	assert.Equal(t, "203.0.113.7", c.YourIp.String())
+
+	// a later handshake only changes what it carries
+	require.NoError(t, c.HandleExtendedMessage(extendedHandshakeMessage(t, message.ExtendedHandshake{
+		M:      map[string]int{},
+		YourIp: "bad",
+	})))
+	assert.Equal(t, 51413, c.ListenPort)
+	assert.Equal(t, "203.0.113.7", c.YourIp.String())
+}
+
+func TestExtensionRegistryRoutesMessages(t *testing.T) {
+	registry := NewExtensionRegistry()
+	received := map[string][]byte{}
+	for name, id := range map[string]uint8{"ut_metadata": 2, "ut_pex": 1} {
+		name := name
+		registry.Register(name, id, func(c *Client, payload []byte) error {
+			received[name] = payload
+			return nil
+		})
+	}
+	assert.Equal(t, map[string]int{"ut_metadata": 2, "ut_pex": 1}, registry.M())
+
+	c := &Client{Extensions: map[string]uint8{}}
+	require.NoError(t, registry.Handle(c, message.FormatExtendedMessage(1, []byte("peers"))))
+	require.NoError(t, registry.Handle(c, message.FormatExtendedMessage(9, []byte("unknown"))))
+	assert.Equal(t, map[string][]byte{"ut_pex": []byte("peers")}, received)
+
+	require.NoError(t, registry.Handle(c, extendedHandshakeMessage(t, message.ExtendedHandshake{
+		M: map[string]int{"ut_pex": 7},
+	})))
+	assert.Equal(t, uint8(7), c.Extensions["ut_pex"])
+
+	assert.Error(t, registry.Handle(c, &message.Message{Id: message.MsgExtended}))
+}
+
+func TestExtensionRegistryRejectsConflicts(t *testing.T) {
+	registry := NewExtensionRegistry()
+	handler := func(c *Client, payload []byte) error { return nil }
+	registry.Register("ut_pex", 1, handler)
+
+	assert.Panics(t, func() { registry.Register("ut_metadata", 1, handler) })
+	assert.Panics(t, func() { registry.Register("ut_pex", 2, handler) })
+	assert.Panics(t, func() { registry.Register("ut_metadata", message.ExtendedHandshakeId, handler) })
+}
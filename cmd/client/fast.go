@@ -0,0 +1,28 @@
+package client
+
+import (
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+)
+
+// messages of the fast extension, only sent to peers with SupportsFast
+
+func (c *Client) SendHaveAll() error {
+	return c.Send(message.FormatHaveAllMessage())
+}
+
+func (c *Client) SendHaveNone() error {
+	return c.Send(message.FormatHaveNoneMessage())
+}
+
+func (c *Client) SendReject(pieceIndex, begin, length int) error {
+	return c.Send(message.FormatRejectMessage(pieceIndex, begin, length))
+}
+
+func (c *Client) SendAllowedFast(pieceIndex int) error {
+	return c.Send(message.FormatAllowedFastMessage(pieceIndex))
+}
+
+// true if remote peer has the piece
+func (c *Client) HasPiece(pieceIndex int) bool {
+	return c.HaveAll || c.BitField.HasPiece(pieceIndex)
+}
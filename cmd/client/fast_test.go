@@ -0,0 +1,35 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+)
+
+// remote end writes msg, the client reads it as the first message after the handshake
+func readFirstMessage(t *testing.T, supportsFast bool, msg *message.Message) (*Client, error) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	go remote.Write(msg.Serialize())
+
+	c := &Client{Con: local, SupportsFast: supportsFast}
+	return c, c.ReadBitField()
+}
+
+func TestHaveAllReplacesBitField(t *testing.T) {
+	c, err := readFirstMessage(t, true, message.FormatHaveAllMessage())
+	require.NoError(t, err)
+	assert.True(t, c.HaveAll)
+	assert.True(t, c.HasPiece(1000))
+
+	c, err = readFirstMessage(t, true, message.FormatHaveNoneMessage())
+	require.NoError(t, err)
+	assert.False(t, c.HaveAll)
+	assert.False(t, c.HasPiece(0))
+
+	_, err = readFirstMessage(t, false, message.FormatHaveAllMessage())
+	assert.Error(t, err, "have all without the fast extension")
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// PipeCon is an in-memory transport, connections are net.Pipes between the dialer and a listener
+// addresses are any host:port, nothing touches the network
+type PipeCon struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+	dialed    int
+}
+
+func NewPipeCon() *PipeCon {
+	return &PipeCon{listeners: map[string]*pipeListener{}}
+}
+
+func (p *PipeCon) Name() string {
+	return "pipe"
+}
+
+func (p *PipeCon) Listen(addr string) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen pipe %s: address already in use", addr)
+	}
+	l := &pipeListener{
+		pipes:  p,
+		addr:   pipeAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	p.listeners[addr] = l
+	return l, nil
+}
+
+// the dialed end gets an ephemeral port of it's own, so connections from the same dialer can be told apart
+func (p *PipeCon) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	p.mu.Lock()
+	l, ok := p.listeners[addr]
+	p.dialed++
+	local := pipeAddr(fmt.Sprintf("127.0.0.1:%d", 49152+p.dialed))
+	p.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial pipe %s: connection refused", addr)
+	}
+
+	dialed, accepted := net.Pipe()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case l.conns <- &pipeConn{Conn: accepted, local: l.addr, remote: local}:
+		return &pipeConn{Conn: dialed, local: local, remote: l.addr}, nil
+	case <-l.closed:
+		err = fmt.Errorf("dial pipe %s: connection refused", addr)
+	case <-expired:
+		err = fmt.Errorf("dial pipe %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+	dialed.Close()
+	accepted.Close()
+	return nil, err
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type pipeListener struct {
+	pipes *PipeCon
+	addr  pipeAddr
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case con := <-l.conns:
+		return con, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.pipes.mu.Lock()
+		delete(l.pipes.listeners, string(l.addr))
+		l.pipes.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,349 @@
+// Package dht implements a node of the mainline DHT, used to find peers of torrents without a tracker
+//
+// Nodes talk KRPC over udp - https://www.bittorrent.org/beps/bep_0005.html
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/dht/routing"
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	DefaultQueryTimeout = 2 * time.Second
+	// nodes which have to report the same external ip before we believe it
+	externalIPVotes = 3
+)
+
+type Config struct {
+	// udp address to listen on, e.g. ":6881"
+	Addr string
+	// socket shared with other protocols used instead of listening on Addr, e.g. the one of uTP
+	Conn net.PacketConn
+	// zero picks the saved id, or one derived from ExternalIP
+	Id routing.Id
+	// ip other nodes see us at, learned from other nodes when nil
+	ExternalIP net.IP
+	// routing table is restored from this file at start and saved to it on Close, empty to start cold
+	StatePath string
+	// host:port of nodes used to join the network while the routing table is empty
+	BootstrapNodes []string
+	QueryTimeout   time.Duration
+}
+
+// Node is a DHT node, it answers queries of other nodes and runs lookups for us
+type Node struct {
+	Id     routing.Id
+	config Config
+	conn   net.PacketConn
+
+	table  *routing.Table
+	tokens *tokens
+	peers  *peerStore
+
+	mu              sync.Mutex
+	pending         map[string]*pendingQuery // by transaction id
+	nextTransaction uint16
+	ipVotes         map[string]int // external ips reported by other nodes
+
+	now func() time.Time
+}
+
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *Msg
+}
+
+func New(config Config) (*Node, error) {
+	if config.QueryTimeout <= 0 {
+		config.QueryTimeout = DefaultQueryTimeout
+	}
+
+	var saved *routing.Table
+	if config.StatePath != "" {
+		var err error
+		saved, err = routing.Load(config.StatePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Default().Printf("Failed to restore DHT routing table, starting cold: %v", err)
+		}
+	}
+
+	externalIP := config.ExternalIP
+	if externalIP == nil && saved != nil {
+		externalIP = saved.ExternalIP()
+	}
+	// ids which don't match our ip get us rejected by other nodes - https://www.bittorrent.org/beps/bep_0042.html
+	if config.Id == (routing.Id{}) {
+		switch {
+		case saved != nil && (externalIP == nil || routing.ValidId(saved.Self(), externalIP)):
+			config.Id = saved.Self()
+		case externalIP != nil:
+			config.Id = routing.IdForIP(externalIP)
+		default:
+			config.Id = routing.RandomId()
+		}
+	}
+
+	table := routing.New(config.Id)
+	if saved != nil {
+		table = saved.Rebase(config.Id)
+	}
+	if externalIP != nil {
+		table.SetExternalIP(externalIP)
+	}
+
+	conn := config.Conn
+	if conn == nil {
+		var err error
+		conn, err = net.ListenPacket("udp", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n := &Node{
+		Id:      config.Id,
+		config:  config,
+		conn:    conn,
+		table:   table,
+		tokens:  newTokens(time.Now()),
+		peers:   newPeerStore(),
+		pending: map[string]*pendingQuery{},
+		ipVotes: map[string]int{},
+		now:     time.Now,
+	}
+	go n.serve()
+	return n, nil
+}
+
+// address the node listens on
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// stop the node, the routing table is saved when the node has a state path
+func (n *Node) Close() error {
+	if n.config.StatePath != "" {
+		err := n.table.Save(n.config.StatePath)
+		if err != nil {
+			log.Default().Printf("Failed to save DHT routing table: %v", err)
+		}
+	}
+	return n.conn.Close()
+}
+
+// number of nodes in the routing table
+func (n *Node) Nodes() int {
+	return n.table.Len()
+}
+
+func (n *Node) serve() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		size, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Default().Printf("DHT node stopped reading: %v", err)
+			}
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := ParseMsg(buf[:size])
+		if err != nil {
+			continue
+		}
+		n.handle(msg, udpAddr)
+	}
+}
+
+func (n *Node) handle(msg *Msg, addr *net.UDPAddr) {
+	if msg.Y == typeQuery {
+		n.seen(msg.A.Id, addr)
+		n.handleQuery(msg, addr)
+		return
+	}
+
+	n.mu.Lock()
+	pending, ok := n.pending[msg.T]
+	// responses must come from the node we asked
+	if ok && sameAddr(pending.addr, addr) {
+		delete(n.pending, msg.T)
+	} else {
+		ok = false
+	}
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if msg.Y == typeResponse {
+		n.seen(msg.R.Id, addr)
+		n.voteExternalIP(msg.Ip)
+	}
+	pending.response <- msg
+}
+
+// nodes with ids that don't match their ip are still answered, they just don't make it into the routing table
+func (n *Node) seen(id string, addr *net.UDPAddr) {
+	info := routing.NodeInfo{Addr: addr}
+	copy(info.Id[:], id)
+	n.table.Add(info, n.now())
+}
+
+// a node told us the address it sees us at, once enough nodes agree on a public ip it's taken as ours
+// a node id which doesn't match it is replaced at the next start, changing it now would empty the routing table
+func (n *Node) voteExternalIP(compact string) {
+	if len(compact) != net.IPv4len+2 && len(compact) != net.IPv6len+2 {
+		return
+	}
+	ip := net.IP([]byte(compact[:len(compact)-2]))
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return
+	}
+
+	n.mu.Lock()
+	n.ipVotes[ip.String()]++
+	votes := n.ipVotes[ip.String()]
+	n.mu.Unlock()
+
+	if votes < externalIPVotes || ip.Equal(n.table.ExternalIP()) {
+		return
+	}
+	n.table.SetExternalIP(ip)
+	if !routing.ValidId(n.Id, ip) {
+		log.Default().Printf("DHT node id does not match external ip %s, a new one is used from the next start", ip)
+	}
+}
+
+func (n *Node) handleQuery(msg *Msg, addr *net.UDPAddr) {
+	reply := &Msg{T: msg.T, Y: typeResponse, R: &Return{Id: string(n.Id[:])}, Ip: encodePeer(addr)}
+	args := msg.A
+
+	switch msg.Q {
+	case queryPing:
+	case queryFindNode:
+		if len(args.Target) != routing.IdLength {
+			n.sendError(msg.T, addr, ErrorProtocol, "invalid target")
+			return
+		}
+		reply.R.Nodes = routing.EncodeNodes(n.table.Closest(routing.Id([]byte(args.Target)), routing.K))
+	case queryGetPeers:
+		if len(args.InfoHash) != routing.IdLength {
+			n.sendError(msg.T, addr, ErrorProtocol, "invalid info_hash")
+			return
+		}
+		infoHash := routing.Id([]byte(args.InfoHash))
+		reply.R.Token = n.tokens.create(addr.IP, n.now())
+		reply.R.Values = n.peers.get(infoHash, n.now())
+		// nodes let the asking node keep looking even when we know some peers
+		reply.R.Nodes = routing.EncodeNodes(n.table.Closest(infoHash, routing.K))
+	case queryAnnouncePeer:
+		if len(args.InfoHash) != routing.IdLength {
+			n.sendError(msg.T, addr, ErrorProtocol, "invalid info_hash")
+			return
+		}
+		if !n.tokens.valid(args.Token, addr.IP, n.now()) {
+			n.sendError(msg.T, addr, ErrorProtocol, "bad token")
+			return
+		}
+		port := args.Port
+		if args.ImpliedPort == 1 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.sendError(msg.T, addr, ErrorProtocol, "invalid port")
+			return
+		}
+		peer := encodePeer(&net.UDPAddr{IP: addr.IP, Port: port})
+		if peer != "" {
+			n.peers.add(routing.Id([]byte(args.InfoHash)), peer, n.now())
+		}
+	default:
+		n.sendError(msg.T, addr, ErrorMethodUnknown, "method unknown")
+		return
+	}
+	n.send(reply, addr)
+}
+
+func (n *Node) sendError(transaction string, addr *net.UDPAddr, code int, message string) {
+	n.send(&Msg{T: transaction, Y: typeError, E: &KrpcError{Code: code, Msg: message}}, addr)
+}
+
+func (n *Node) send(msg *Msg, addr *net.UDPAddr) error {
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteTo(data, addr)
+	return err
+}
+
+// send a query and wait for it's response
+// remote is counted as failing in the routing table when it doesn't answer in time
+func (n *Node) query(remote routing.NodeInfo, method string, args MsgArgs) (*Return, error) {
+	args.Id = string(n.Id[:])
+
+	n.mu.Lock()
+	n.nextTransaction++
+	transaction := string(binary.BigEndian.AppendUint16(nil, n.nextTransaction))
+	pending := &pendingQuery{addr: remote.Addr, response: make(chan *Msg, 1)}
+	n.pending[transaction] = pending
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, transaction)
+		n.mu.Unlock()
+	}()
+
+	err := n.send(&Msg{T: transaction, Y: typeQuery, Q: method, A: &args}, remote.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.config.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-pending.response:
+		if msg.Y == typeError {
+			return nil, msg.E
+		}
+		return msg.R, nil
+	case <-timer.C:
+		if remote.Id != (routing.Id{}) {
+			n.table.Failed(remote.Id)
+		}
+		return nil, fmt.Errorf("%s query to %s timed out", method, remote.Addr)
+	}
+}
+
+// check a node is alive, it's added to the routing table when it answers
+func (n *Node) Ping(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = n.query(routing.NodeInfo{Addr: udpAddr}, queryPing, MsgArgs{})
+	return err
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
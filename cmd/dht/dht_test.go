@@ -0,0 +1,202 @@
+package dht
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/dht/routing"
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+)
+
+// nodes on loopback, all of them bootstrap from the first one
+func startCluster(t *testing.T, size int) []*Node {
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		config := Config{Addr: "127.0.0.1:0", QueryTimeout: 200 * time.Millisecond}
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		node, err := New(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { node.Close() })
+		nodes[i] = node
+	}
+
+	for _, node := range nodes[1:] {
+		require.NoError(t, node.Bootstrap())
+	}
+	return nodes
+}
+
+func TestClusterAnnounceAndGetPeers(t *testing.T) {
+	nodes := startCluster(t, 20)
+	infoHash := [20]byte(routing.RandomId())
+
+	_, err := nodes[5].Announce(infoHash, 6881)
+	require.NoError(t, err)
+
+	peers, err := nodes[15].GetPeers(infoHash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "127.0.0.1", peers[0].IP.String())
+	assert.Equal(t, 6881, peers[0].Port)
+
+	t.Run("implied port", func(t *testing.T) {
+		infoHash := [20]byte(routing.RandomId())
+		_, err := nodes[3].Announce(infoHash, 0)
+		require.NoError(t, err)
+
+		peers, err := nodes[12].GetPeers(infoHash)
+		require.NoError(t, err)
+		require.Len(t, peers, 1)
+		assert.Equal(t, nodes[3].Addr().Port, peers[0].Port)
+	})
+
+	t.Run("unknown torrent", func(t *testing.T) {
+		peers, err := nodes[8].GetPeers([20]byte(routing.RandomId()))
+		require.NoError(t, err)
+		assert.Empty(t, peers)
+	})
+}
+
+func TestBootstrapFillsRoutingTable(t *testing.T) {
+	nodes := startCluster(t, 10)
+	for _, node := range nodes {
+		assert.Greater(t, node.Nodes(), 1)
+	}
+}
+
+func TestBootstrapWithoutNodes(t *testing.T) {
+	node, err := New(Config{Addr: "127.0.0.1:0", QueryTimeout: 50 * time.Millisecond, BootstrapNodes: []string{"127.0.0.1:1"}})
+	require.NoError(t, err)
+	defer node.Close()
+
+	assert.Error(t, node.Bootstrap())
+	_, err = node.GetPeers([20]byte{1})
+	assert.Error(t, err)
+}
+
+func TestSocketSharedWithUTP(t *testing.T) {
+	socket, err := utp.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer socket.Close()
+	node, err := New(Config{Conn: socket.PacketConn(), QueryTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, socket.Addr().String(), node.Addr().String())
+
+	other, err := New(Config{Addr: "127.0.0.1:0", QueryTimeout: 200 * time.Millisecond, BootstrapNodes: []string{node.Addr().String()}})
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, other.Bootstrap())
+
+	// closing the node leaves the socket to uTP
+	require.NoError(t, node.Close())
+	dialer, err := utp.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer dialer.Close()
+	go socket.Accept()
+	con, err := dialer.DialTimeout(socket.Addr().String(), time.Second)
+	require.NoError(t, err)
+	con.Close()
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	nodes := startCluster(t, 2)
+	remote := routing.NodeInfo{Id: nodes[0].Id, Addr: nodes[0].Addr()}
+
+	_, err := nodes[1].query(remote, queryAnnouncePeer, MsgArgs{InfoHash: string(make([]byte, 20)), Port: 6881, Token: "forged"})
+	var krpcError *KrpcError
+	require.ErrorAs(t, err, &krpcError)
+	assert.Equal(t, ErrorProtocol, krpcError.Code)
+
+	_, err = nodes[1].query(remote, "vote", MsgArgs{})
+	require.ErrorAs(t, err, &krpcError)
+	assert.Equal(t, ErrorMethodUnknown, krpcError.Code)
+}
+
+func TestKrpcMessages(t *testing.T) {
+	msg := &Msg{T: "aa", Y: typeError, E: &KrpcError{Code: ErrorGeneric, Msg: "A Generic Error Ocurred"}}
+	data, err := msg.Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee", string(data))
+
+	// example query of BEP 5
+	parsed, err := ParseMsg([]byte("d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"))
+	require.NoError(t, err)
+	assert.Equal(t, queryFindNode, parsed.Q)
+	assert.Equal(t, "mnopqrstuvwxyz123456", parsed.A.Target)
+
+	_, err = ParseMsg([]byte("d1:t2:aa1:y1:qe"))
+	assert.Error(t, err, "query without arguments")
+}
+
+func TestTokens(t *testing.T) {
+	now := time.Now()
+	tokens := newTokens(now)
+	ip := net.ParseIP("10.0.0.1")
+
+	token := tokens.create(ip, now)
+	assert.True(t, tokens.valid(token, ip, now))
+	assert.False(t, tokens.valid(token, net.ParseIP("10.0.0.2"), now))
+	assert.True(t, tokens.valid(token, ip, now.Add(tokenRotation)), "previous token is still accepted")
+	assert.False(t, tokens.valid(token, ip, now.Add(3*tokenRotation)))
+}
+
+func TestPeerStoreLimits(t *testing.T) {
+	now := time.Now()
+	store := newPeerStore()
+	var infoHash routing.Id
+	for i := 0; i < maxStoredPeers+1; i++ {
+		store.add(infoHash, string(rune(i)), now.Add(time.Duration(i)))
+	}
+	peers := store.peers[infoHash]
+	assert.Len(t, peers, maxStoredPeers)
+	assert.NotContains(t, peers, string(rune(0)), "oldest peer makes room")
+
+	for i := 1; i < maxStoredInfoHashes+1; i++ {
+		store.add(routing.Id{byte(i), byte(i >> 8)}, "peer", now)
+	}
+	assert.Len(t, store.peers, maxStoredInfoHashes)
+
+	// expired info hashes are forgotten without anybody asking for them
+	later := now.Add(peerLifetime + time.Minute)
+	store.add(routing.Id{0xff, 0xff}, "peer", later)
+	assert.Len(t, store.peers, 1)
+	assert.Equal(t, []string{"peer"}, store.get(routing.Id{0xff, 0xff}, later))
+}
+
+func TestRoutingTableSurvivesRestart(t *testing.T) {
+	nodes := startCluster(t, 5)
+	statePath := filepath.Join(t.TempDir(), "dht.state")
+
+	node, err := New(Config{Addr: "127.0.0.1:0", StatePath: statePath, BootstrapNodes: []string{nodes[0].Addr().String()}})
+	require.NoError(t, err)
+	require.NoError(t, node.Bootstrap())
+	known := node.Nodes()
+	node.Close()
+
+	restarted, err := New(Config{Addr: "127.0.0.1:0", StatePath: statePath})
+	require.NoError(t, err)
+	defer restarted.Close()
+	assert.Equal(t, node.Id, restarted.Id)
+	assert.Equal(t, known, restarted.Nodes())
+	assert.NoError(t, restarted.Bootstrap(), "restored nodes are enough to join without bootstrap nodes")
+}
+
+func TestExternalIPVotes(t *testing.T) {
+	node, err := New(Config{Addr: "127.0.0.1:0", Id: routing.Id{1}})
+	require.NoError(t, err)
+	defer node.Close()
+
+	external := &net.UDPAddr{IP: net.ParseIP("124.31.75.21"), Port: 6881}
+	for i := 0; i < externalIPVotes; i++ {
+		assert.Nil(t, node.table.ExternalIP())
+		node.voteExternalIP(encodePeer(external))
+		node.voteExternalIP(encodePeer(&net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 6881}))
+	}
+	assert.Equal(t, "124.31.75.21", node.table.ExternalIP().String(), "private addresses are ignored")
+}
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+	"github.com/umair-hassan2/torrent-client/cmd/dht/routing"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// KRPC protocol - https://www.bittorrent.org/beps/bep_0005.html#krpc-protocol
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	queryPing         = "ping"
+	queryFindNode     = "find_node"
+	queryGetPeers     = "get_peers"
+	queryAnnouncePeer = "announce_peer"
+
+	// a KRPC message never gets close to this, bigger packets are dropped
+	maxMessageSize = 8 * 1024
+)
+
+const (
+	ErrorGeneric       = 201
+	ErrorServer        = 202
+	ErrorProtocol      = 203
+	ErrorMethodUnknown = 204
+)
+
+type Msg struct {
+	T  string     `bencode:"t"`
+	Y  string     `bencode:"y"`
+	Q  string     `bencode:"q,omitempty"`
+	A  *MsgArgs   `bencode:"a,omitempty"`
+	R  *Return    `bencode:"r,omitempty"`
+	E  *KrpcError `bencode:"e,omitempty"`
+	Ip string     `bencode:"ip,omitempty"` // compact address of the node a response goes to - https://www.bittorrent.org/beps/bep_0042.html
+}
+
+// arguments of a query
+type MsgArgs struct {
+	Id          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"` // 1 when the source port of the packet should be announced
+}
+
+// values of a response
+type Return struct {
+	Id     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node infos
+	Values []string `bencode:"values,omitempty"` // compact peers
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// KrpcError is the error a remote node answered with, it's encoded as a list of code and message
+type KrpcError struct {
+	Code int
+	Msg  string
+}
+
+func (e *KrpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Msg)
+}
+
+func (e KrpcError) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal([]any{e.Code, e.Msg})
+}
+
+func (e *KrpcError) UnmarshalBencode(data []byte) error {
+	var list []bencode.Value
+	err := bencode.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	if len(list) != 2 || list[0].Kind != bencode.KindInt || list[1].Kind != bencode.KindString {
+		return fmt.Errorf("krpc error must be a list of code and message")
+	}
+	e.Code, e.Msg = int(list[0].Int), list[1].Str
+	return nil
+}
+
+func (m *Msg) Serialize() ([]byte, error) {
+	return bencode.Marshal(m)
+}
+
+// nodes are free to order keys the way they want, so decoding is lenient about it
+func ParseMsg(data []byte) (*Msg, error) {
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("krpc message of %d bytes is too big", len(data))
+	}
+
+	msg := &Msg{}
+	decoder := bencode.NewDecoder(bytes.NewReader(data))
+	decoder.AllowUnsortedKeys()
+	decoder.SetMaxDepth(8)
+	err := decoder.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Y {
+	case typeQuery:
+		if msg.A == nil || len(msg.A.Id) != routing.IdLength {
+			return nil, fmt.Errorf("krpc query without a valid id")
+		}
+	case typeResponse:
+		if msg.R == nil || len(msg.R.Id) != routing.IdLength {
+			return nil, fmt.Errorf("krpc response without a valid id")
+		}
+	case typeError:
+		if msg.E == nil {
+			return nil, fmt.Errorf("krpc error without an error")
+		}
+	default:
+		return nil, fmt.Errorf("unknown krpc message type %q", msg.Y)
+	}
+	return msg, nil
+}
+
+// peers of a get_peers response, entries which aren't compact IPv4 peers are skipped
+func DecodePeers(values []string) []*types.Peer {
+	peers := []*types.Peer{}
+	for _, value := range values {
+		parsed, err := torrent_file.ParseCompactPeers([]byte(value), net.IPv4len)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, parsed...)
+	}
+	return peers
+}
+
+func encodePeer(addr *net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port)))
+}
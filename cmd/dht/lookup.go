@@ -0,0 +1,212 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/dht/routing"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// queries running at the same time during a lookup
+const alpha = 3
+
+type lookupResult struct {
+	// closest nodes which answered, with the token each of them gave
+	nodes  []routing.NodeInfo
+	tokens map[routing.Id]string
+	peers  []*types.Peer
+}
+
+// iterative lookup - https://www.bittorrent.org/beps/bep_0005.html#routing-table
+// nodes closest to target are asked for closer nodes until the K closest known nodes have all answered or failed
+// with getPeers set get_peers is sent instead of find_node and the peers found on the way are collected
+func (n *Node) lookup(target routing.Id, getPeers bool) lookupResult {
+	candidates := n.table.Closest(target, routing.K)
+	if len(candidates) == 0 {
+		candidates = n.bootstrapNodes()
+	}
+
+	result := lookupResult{tokens: map[routing.Id]string{}}
+	asked := map[string]bool{}
+	seenPeers := map[string]bool{}
+	var mu sync.Mutex
+
+	// peers announced to us count as well, no other node may know about them
+	if getPeers {
+		for _, peer := range DecodePeers(n.peers.get(target, n.now())) {
+			seenPeers[common.PeerAdress(*peer)] = true
+			result.peers = append(result.peers, peer)
+		}
+	}
+
+	for {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return routing.Closer(target, candidates[i].Id, candidates[j].Id)
+		})
+
+		// next ones to ask are the closest not asked yet, among the K closest
+		batch := []routing.NodeInfo{}
+		for _, candidate := range candidates[:min(routing.K, len(candidates))] {
+			if !asked[candidate.Addr.String()] && len(batch) < alpha {
+				batch = append(batch, candidate)
+			}
+		}
+		// nodes further away are only asked while the closest ones didn't give anything better
+		if len(batch) == 0 {
+			for _, candidate := range candidates {
+				if !asked[candidate.Addr.String()] && len(result.nodes) < routing.K && len(batch) < alpha {
+					batch = append(batch, candidate)
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		found := []routing.NodeInfo{}
+		var wg sync.WaitGroup
+		for _, candidate := range batch {
+			asked[candidate.Addr.String()] = true
+			wg.Add(1)
+			go func(remote routing.NodeInfo) {
+				defer wg.Done()
+				args := MsgArgs{Target: string(target[:])}
+				method := queryFindNode
+				if getPeers {
+					args = MsgArgs{InfoHash: string(target[:])}
+					method = queryGetPeers
+				}
+
+				response, err := n.query(remote, method, args)
+				if err != nil {
+					return
+				}
+				nodes, err := routing.DecodeNodes(response.Nodes)
+				if err != nil {
+					return
+				}
+
+				// bootstrap nodes are asked before their id is known
+				copy(remote.Id[:], response.Id)
+
+				mu.Lock()
+				defer mu.Unlock()
+				result.nodes = append(result.nodes, remote)
+				if response.Token != "" {
+					result.tokens[remote.Id] = response.Token
+				}
+				for _, peer := range DecodePeers(response.Values) {
+					address := common.PeerAdress(*peer)
+					if !seenPeers[address] {
+						seenPeers[address] = true
+						result.peers = append(result.peers, peer)
+					}
+				}
+				found = append(found, nodes...)
+			}(candidate)
+		}
+		wg.Wait()
+
+		// candidates are keyed by address, asked nodes can't come back under another id
+		known := map[string]bool{}
+		for _, candidate := range candidates {
+			known[candidate.Addr.String()] = true
+		}
+		for _, node := range found {
+			if node.Id == n.Id || node.Addr.Port == 0 || known[node.Addr.String()] || asked[node.Addr.String()] {
+				continue
+			}
+			known[node.Addr.String()] = true
+			candidates = append(candidates, node)
+		}
+		// answered nodes keep their place under their real id
+		for i, candidate := range candidates {
+			for _, answered := range result.nodes {
+				if sameAddr(candidate.Addr, answered.Addr) {
+					candidates[i] = answered
+				}
+			}
+		}
+	}
+
+	sort.Slice(result.nodes, func(i, j int) bool {
+		return routing.Closer(target, result.nodes[i].Id, result.nodes[j].Id)
+	})
+	result.nodes = result.nodes[:min(routing.K, len(result.nodes))]
+	return result
+}
+
+// configured bootstrap nodes, names which don't resolve are skipped
+func (n *Node) bootstrapNodes() []routing.NodeInfo {
+	nodes := []routing.NodeInfo{}
+	for _, address := range n.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, routing.NodeInfo{Addr: addr})
+	}
+	return nodes
+}
+
+// join the network by looking up our own id, which fills the routing table with nodes close to us
+func (n *Node) Bootstrap() error {
+	n.lookup(n.Id, false)
+	if n.table.Len() == 0 {
+		return fmt.Errorf("no DHT node answered")
+	}
+	return nil
+}
+
+// find peers of a torrent
+func (n *Node) GetPeers(infoHash [20]byte) ([]*types.Peer, error) {
+	result := n.lookup(infoHash, true)
+	if len(result.nodes) == 0 {
+		return nil, fmt.Errorf("no DHT node answered")
+	}
+	return result.peers, nil
+}
+
+// find peers of a torrent and tell the closest nodes we are one of them
+// port 0 announces the port our DHT node listens on
+func (n *Node) Announce(infoHash [20]byte, port int) ([]*types.Peer, error) {
+	result := n.lookup(infoHash, true)
+	if len(result.nodes) == 0 {
+		return nil, fmt.Errorf("no DHT node answered")
+	}
+
+	args := MsgArgs{InfoHash: string(infoHash[:]), Port: port}
+	if port == 0 {
+		args.ImpliedPort = 1
+	}
+	announced := 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, remote := range result.nodes {
+		token, ok := result.tokens[remote.Id]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(remote routing.NodeInfo, args MsgArgs, token string) {
+			defer wg.Done()
+			args.Token = token
+			_, err := n.query(remote, queryAnnouncePeer, args)
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(remote, args, token)
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return result.peers, fmt.Errorf("no DHT node accepted the announce")
+	}
+	return result.peers, nil
+}
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/crc32"
+	"math/bits"
+	"net"
+)
+
+// node ids are as wide as peer ids and info hashes
+const IdLength = 20
+
+// Id of a node or an info hash, both live in the same 160 bit space
+type Id [IdLength]byte
+
+func RandomId() Id {
+	var id Id
+	rand.Read(id[:])
+	return id
+}
+
+func (id Id) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// distance between two ids is their xor
+func (id Id) Distance(other Id) Id {
+	var distance Id
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// number of leading bits two ids share
+func (id Id) CommonPrefixLength(other Id) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IdLength * 8
+}
+
+// true when a is closer to target than b
+func Closer(target, a, b Id) bool {
+	da, db := target.Distance(a), target.Distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// node id restriction - https://www.bittorrent.org/beps/bep_0042.html
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	v4Mask     = []byte{0x03, 0x0f, 0x3f, 0xff}
+	v6Mask     = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// random id which is valid for a node reachable at ip
+func IdForIP(ip net.IP) Id {
+	id := RandomId()
+	prefix, ok := idPrefix(ip, id[19]&0x7)
+	if !ok {
+		return id
+	}
+	id[0], id[1] = prefix[0], prefix[1]
+	id[2] = prefix[2] | id[2]&0x7
+	return id
+}
+
+// false when id was not derived from ip
+// nodes on local networks can pick any id, their address means nothing outside of it
+func ValidId(id Id, ip net.IP) bool {
+	if isLocal(ip) {
+		return true
+	}
+	prefix, ok := idPrefix(ip, id[19]&0x7)
+	if !ok {
+		return false
+	}
+	return id[0] == prefix[0] && id[1] == prefix[1] && id[2]&0xf8 == prefix[2]
+}
+
+// first 21 bits of an id valid for ip and random number r of 3 bits
+func idPrefix(ip net.IP, r byte) ([3]byte, bool) {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = append(masked, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		masked = append(masked, ip16[:8]...)
+	} else {
+		return [3]byte{}, false
+	}
+
+	mask := v4Mask
+	if len(masked) == len(v6Mask) {
+		mask = v6Mask
+	}
+	for i := range masked {
+		masked[i] &= mask[i]
+	}
+	masked[0] |= r << 5
+
+	crc := crc32.Checksum(masked, castagnoli)
+	return [3]byte{byte(crc >> 24), byte(crc >> 16), byte(crc>>8) & 0xf8}, true
+}
+
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
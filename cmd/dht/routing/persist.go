@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+)
+
+// compact node info is a 20 byte id followed by a compact IPv4 address
+const compactNodeLength = 26
+
+// table as it is saved to disk
+type savedTable struct {
+	Id         string `bencode:"id"`
+	ExternalIP string `bencode:"ip,omitempty"` // 4 or 16 bytes
+	Nodes      string `bencode:"nodes"`        // compact node infos
+}
+
+// write our id, external ip and known nodes to path
+// the file is replaced at once, a crash while saving leaves the old one
+func (t *Table) Save(path string) error {
+	saved := savedTable{Id: string(t.self[:])}
+	if ip := t.ExternalIP(); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		saved.ExternalIP = string(ip)
+	}
+	infos := []NodeInfo{}
+	for _, known := range t.nodes() {
+		if known.failures < maxFailures {
+			infos = append(infos, known.NodeInfo)
+		}
+	}
+	saved.Nodes = EncodeNodes(infos)
+
+	data, err := bencode.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// table saved at path by Save
+// restored nodes are questionable until they answer, so fresh nodes replace them easily
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := savedTable{}
+	err = bencode.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(saved.Id) != IdLength {
+		return nil, fmt.Errorf("%s: invalid node id", path)
+	}
+	infos, err := DecodeNodes(saved.Nodes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	t := New(Id([]byte(saved.Id)))
+	if len(saved.ExternalIP) == net.IPv4len || len(saved.ExternalIP) == net.IPv6len {
+		t.externalIP = net.IP([]byte(saved.ExternalIP))
+	}
+	for _, info := range infos {
+		if info.Id == t.self || !ValidId(info.Id, info.Addr.IP) {
+			continue
+		}
+		t.add(&node{NodeInfo: info, lastSeen: time.Time{}}, time.Now())
+	}
+	return t, nil
+}
+
+func EncodeNodes(nodes []NodeInfo) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLength)
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, node.Id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(node.Addr.Port))
+	}
+	return string(buf)
+}
+
+func DecodeNodes(data string) ([]NodeInfo, error) {
+	if len(data)%compactNodeLength != 0 {
+		return nil, fmt.Errorf("compact nodes of %d bytes are not a multiple of %d", len(data), compactNodeLength)
+	}
+
+	nodes := make([]NodeInfo, 0, len(data)/compactNodeLength)
+	for offset := 0; offset < len(data); offset += compactNodeLength {
+		entry := data[offset : offset+compactNodeLength]
+		node := NodeInfo{Addr: &net.UDPAddr{
+			IP:   net.IP([]byte(entry[20:24])),
+			Port: int(binary.BigEndian.Uint16([]byte(entry[24:26]))),
+		}}
+		copy(node.Id[:], entry[:20])
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
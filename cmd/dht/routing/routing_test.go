@@ -0,0 +1,133 @@
+package routing
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// example ids of BEP 42 - https://www.bittorrent.org/beps/bep_0042.html
+var bep42Examples = []struct {
+	ip string
+	id string
+}{
+	{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func parseId(t *testing.T, hexId string) Id {
+	decoded, err := hex.DecodeString(hexId)
+	require.NoError(t, err)
+	return Id(decoded)
+}
+
+func TestBep42Ids(t *testing.T) {
+	for _, example := range bep42Examples {
+		ip := net.ParseIP(example.ip)
+		id := parseId(t, example.id)
+		assert.True(t, ValidId(id, ip), example.ip)
+
+		generated := IdForIP(ip)
+		assert.True(t, ValidId(generated, ip), example.ip)
+
+		id[0] ^= 0xff
+		assert.False(t, ValidId(id, ip), example.ip)
+	}
+
+	assert.False(t, ValidId(Id{1}, net.ParseIP("2001:db8::1")))
+	assert.True(t, ValidId(Id{1}, net.ParseIP("192.168.1.2")), "local addresses can use any id")
+}
+
+func TestTableRejectsInvalidIds(t *testing.T) {
+	table := New(RandomId())
+	now := time.Now()
+	addr := &net.UDPAddr{IP: net.ParseIP(bep42Examples[0].ip), Port: 6881}
+
+	assert.ErrorIs(t, table.Add(NodeInfo{Id: Id{1}, Addr: addr}, now), ErrInvalidId)
+	assert.ErrorIs(t, table.Add(NodeInfo{Id: table.Self(), Addr: addr}, now), ErrSelf)
+	assert.NoError(t, table.Add(NodeInfo{Id: parseId(t, bep42Examples[0].id), Addr: addr}, now))
+	assert.Equal(t, 1, table.Len())
+}
+
+func localNode(id Id, port int) NodeInfo {
+	return NodeInfo{Id: id, Addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}}
+}
+
+func TestBuckets(t *testing.T) {
+	table := New(Id{})
+	now := time.Now()
+
+	// every id starting with a 1 bit lands in bucket 0
+	for i := 0; i < K+2; i++ {
+		require.NoError(t, table.Add(localNode(Id{0x80, byte(i)}, i+1), now))
+	}
+	assert.Equal(t, K, table.Len(), "full bucket drops new good nodes")
+
+	table.Failed(Id{0x80, 0})
+	table.Failed(Id{0x80, 0})
+	table.Add(localNode(Id{0x80, 0xff}, 100), now)
+	assert.Equal(t, K, table.Len())
+	closest := table.Closest(Id{0x80, 0xff}, 1)
+	assert.Equal(t, Id{0x80, 0xff}, closest[0].Id, "failing node is replaced")
+
+	table.Add(localNode(Id{0x80, 0xfe}, 101), now.Add(nodeGoodFor))
+	assert.Contains(t, table.Closest(Id{0x80, 0xfe}, 1), localNode(Id{0x80, 0xfe}, 101), "questionable node is replaced")
+
+	table.Add(localNode(Id{0x01}, 200), now)
+	closest = table.Closest(Id{0x01, 0x01}, 2)
+	assert.Equal(t, Id{0x01}, closest[0].Id)
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	table := New(IdForIP(net.ParseIP(bep42Examples[1].ip)))
+	table.SetExternalIP(net.ParseIP(bep42Examples[1].ip))
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		table.Add(localNode(RandomId(), 6881+i), now)
+	}
+	require.NoError(t, table.Save(path))
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, table.Self(), loaded.Self())
+	assert.Equal(t, bep42Examples[1].ip, loaded.ExternalIP().String())
+	assert.ElementsMatch(t, addresses(table.Closest(Id{}, 100)), addresses(loaded.Closest(Id{}, 100)))
+
+	// restored nodes haven't answered yet, so fresh ones take their place
+	for _, restored := range loaded.nodes() {
+		assert.False(t, restored.good(now))
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o644))
+	_, err = Load(path)
+	assert.Error(t, err)
+}
+
+func addresses(nodes []NodeInfo) []string {
+	addresses := []string{}
+	for _, node := range nodes {
+		addresses = append(addresses, node.Id.String()+"@"+node.Addr.String())
+	}
+	return addresses
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []NodeInfo{localNode(Id{1}, 6881)}
+	decoded, err := DecodeNodes(EncodeNodes(nodes))
+	require.NoError(t, err)
+	assert.Equal(t, Id{1}, decoded[0].Id)
+	assert.Equal(t, "10.0.0.1:6881", decoded[0].Addr.String())
+
+	_, err = DecodeNodes("short")
+	assert.Error(t, err)
+}
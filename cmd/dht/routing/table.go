@@ -0,0 +1,183 @@
+// Package routing implements the routing table of a DHT node
+//
+// The table keeps nodes in Kademlia buckets by distance to our own id, rejects nodes whose id doesn't match
+// their ip as BEP 42 requires, and can be saved to disk so a node doesn't start cold.
+package routing
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// nodes per bucket, also the number of closest nodes a lookup ends with
+	K = 8
+	// nodes which didn't answer this many queries in a row are replaced first
+	maxFailures = 2
+	// nodes not heard from for this long are questionable
+	nodeGoodFor = 15 * time.Minute
+)
+
+var (
+	ErrSelf      = errors.New("node has our own id")
+	ErrInvalidId = errors.New("node id does not match it's ip")
+)
+
+// NodeInfo is a node as it is exchanged between nodes
+type NodeInfo struct {
+	Id   Id
+	Addr *net.UDPAddr
+}
+
+type node struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) good(now time.Time) bool {
+	return n.failures == 0 && now.Sub(n.lastSeen) < nodeGoodFor
+}
+
+// routing table - https://www.bittorrent.org/beps/bep_0005.html#routing-table
+// bucket i holds nodes sharing exactly i leading bits with our id, every bucket holds at most K nodes
+type Table struct {
+	self Id
+
+	mu         sync.Mutex
+	buckets    [IdLength*8 + 1][]*node
+	externalIP net.IP // ip other nodes see us at, our id is derived from it
+}
+
+func New(self Id) *Table {
+	return &Table{self: self}
+}
+
+// our own id
+func (t *Table) Self() Id {
+	return t.self
+}
+
+// add a node we heard from, or refresh it if it's known
+// when it's bucket is full the node is only added in place of a bad one
+func (t *Table) Add(info NodeInfo, now time.Time) error {
+	if info.Id == t.self {
+		return ErrSelf
+	}
+	if !ValidId(info.Id, info.Addr.IP) {
+		return ErrInvalidId
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(&node{NodeInfo: info, lastSeen: now}, now)
+	return nil
+}
+
+func (t *Table) add(entry *node, now time.Time) {
+	index := t.self.CommonPrefixLength(entry.Id)
+	bucket := t.buckets[index]
+	for _, known := range bucket {
+		if known.Id == entry.Id {
+			known.Addr = entry.Addr
+			known.lastSeen = entry.lastSeen
+			known.failures = 0
+			return
+		}
+	}
+
+	if len(bucket) < K {
+		t.buckets[index] = append(bucket, entry)
+		return
+	}
+	for i, known := range bucket {
+		if known.failures >= maxFailures || !known.good(now) {
+			bucket[i] = entry
+			return
+		}
+	}
+}
+
+// a query to the node timed out
+func (t *Table) Failed(id Id) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.self.CommonPrefixLength(id)
+	for _, known := range t.buckets[index] {
+		if known.Id == id {
+			known.failures++
+			return
+		}
+	}
+}
+
+// up to count nodes closest to target, nodes which keep failing are left out
+func (t *Table) Closest(target Id, count int) []NodeInfo {
+	nodes := []NodeInfo{}
+	for _, known := range t.nodes() {
+		if known.failures < maxFailures {
+			nodes = append(nodes, known.NodeInfo)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return Closer(target, nodes[i].Id, nodes[j].Id)
+	})
+	return nodes[:min(count, len(nodes))]
+}
+
+// number of nodes in the table
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	size := 0
+	for _, bucket := range t.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+func (t *Table) nodes() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := []node{}
+	for _, bucket := range t.buckets {
+		for _, known := range bucket {
+			nodes = append(nodes, *known)
+		}
+	}
+	return nodes
+}
+
+// ip other nodes see us at, nil while unknown
+func (t *Table) ExternalIP() net.IP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.externalIP
+}
+
+func (t *Table) SetExternalIP(ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.externalIP = ip
+}
+
+// table with the same nodes and external ip around another id, nodes are sorted into buckets again
+func (t *Table) Rebase(self Id) *Table {
+	rebased := New(self)
+	rebased.externalIP = t.ExternalIP()
+	now := time.Now()
+	for _, known := range t.nodes() {
+		if known.Id != self {
+			entry := known
+			rebased.add(&entry, now)
+		}
+	}
+	return rebased
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/dht/routing"
+)
+
+const (
+	// tokens handed out with get_peers are accepted for two rotations
+	tokenRotation = 5 * time.Minute
+	// announced peers are forgotten when they don't announce again
+	peerLifetime = 30 * time.Minute
+	// most peers returned for one info hash
+	maxReturnedPeers = 50
+	// anybody with a token can announce, so what we keep for them is limited
+	maxStoredInfoHashes = 2000
+	maxStoredPeers      = 500
+)
+
+// tokens prove an announcing node asked us for peers from the same ip before
+type tokens struct {
+	mu       sync.Mutex
+	current  [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokens(now time.Time) *tokens {
+	t := &tokens{rotated: now}
+	rand.Read(t.current[:])
+	rand.Read(t.previous[:])
+	return t
+}
+
+func (t *tokens) rotate(now time.Time) {
+	if now.Sub(t.rotated) < tokenRotation {
+		return
+	}
+	t.previous = t.current
+	rand.Read(t.current[:])
+	t.rotated = now
+}
+
+func (t *tokens) create(ip net.IP, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	return tokenFor(t.current, ip)
+}
+
+func (t *tokens) valid(token string, ip net.IP, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	return token == tokenFor(t.current, ip) || token == tokenFor(t.previous, ip)
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	hash := sha1.New()
+	hash.Write(secret[:])
+	hash.Write(ip.To16())
+	return string(hash.Sum(nil)[:8])
+}
+
+// peers announced to us, by info hash
+// expired peers of every info hash are dropped once a token rotation
+type peerStore struct {
+	mu     sync.Mutex
+	peers  map[routing.Id]map[string]time.Time // compact peer to time of it's last announce
+	pruned time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: map[routing.Id]map[string]time.Time{}}
+}
+
+func (s *peerStore) add(infoHash routing.Id, peer string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) >= tokenRotation {
+		s.prune(now)
+	}
+
+	swarm := s.peers[infoHash]
+	if swarm == nil {
+		// announces of new info hashes are ignored while we are full
+		if len(s.peers) >= maxStoredInfoHashes {
+			return
+		}
+		swarm = map[string]time.Time{}
+		s.peers[infoHash] = swarm
+	}
+	if _, ok := swarm[peer]; !ok && len(swarm) >= maxStoredPeers {
+		// the peer which announced longest ago makes room
+		oldest := ""
+		for candidate, announced := range swarm {
+			if oldest == "" || announced.Before(swarm[oldest]) {
+				oldest = candidate
+			}
+		}
+		delete(swarm, oldest)
+	}
+	swarm[peer] = now
+}
+
+// drop expired peers and the info hashes left without peers, s.mu is held
+func (s *peerStore) prune(now time.Time) {
+	s.pruned = now
+	for infoHash, swarm := range s.peers {
+		for peer, announced := range swarm {
+			if now.Sub(announced) > peerLifetime {
+				delete(swarm, peer)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+// compact peers of an info hash, expired ones are dropped on the way
+func (s *peerStore) get(infoHash routing.Id, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := []string{}
+	for peer, announced := range s.peers[infoHash] {
+		if now.Sub(announced) > peerLifetime {
+			delete(s.peers[infoHash], peer)
+			continue
+		}
+		if len(values) < maxReturnedPeers {
+			values = append(values, peer)
+		}
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return values
+}
@@ -0,0 +1,148 @@
+// Package listener accepts connections of remote peers and hands each of them to the torrent it asks for
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+)
+
+// remote peers have this long to send their handshake
+const handshakeTimeout = 10 * time.Second
+
+// Torrent is a torrent remote peers can connect to
+type Torrent interface {
+	// peer id we use for the torrent
+	PeerId() [20]byte
+	// serve a connection after handshakes were exchanged, returns when the connection is done
+	ServeIncoming(c *client.Client) error
+}
+
+// Listener routes incoming connections by the info hash of their handshake
+type Listener struct {
+	// which connections are accepted, encrypted or plaintext ones, set before Serve
+	Policy   mse.Policy
+	listener net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]Torrent
+}
+
+// listen on a tcp address, e.g. ":6881"
+func Listen(addr string) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(l), nil
+}
+
+func New(l net.Listener) *Listener {
+	return &Listener{listener: l, torrents: map[[20]byte]Torrent{}}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// port other peers can connect to us on
+func (l *Listener) Port() int {
+	if addr, ok := l.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// accept connections for a torrent
+func (l *Listener) Add(infoHash [20]byte, t Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[infoHash] = t
+}
+
+// stop accepting connections for a torrent, connections it serves already are left alone
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// info hashes of the torrents we accept connections for, encrypted connections name theirs by a hash of it
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	infoHashes := [][20]byte{}
+	for infoHash := range l.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+func (l *Listener) torrent(infoHash [20]byte) (Torrent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.torrents[infoHash]
+	return t, ok
+}
+
+// accept connections until the listener is closed, every connection is served by a goroutine of it's own
+func (l *Listener) Serve() error {
+	return l.ServeFrom(l.listener)
+}
+
+// like Serve for connections accepted by another listener, e.g. a uTP socket
+// it's closed by it's owner, Close only closes the tcp listener
+func (l *Listener) ServeFrom(nl net.Listener) error {
+	for {
+		con, err := nl.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go l.handle(con)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) handle(con net.Conn) {
+	err := l.serveConnection(con)
+	if err != nil {
+		log.Default().Printf("Closing incoming connection from %s: %v", con.RemoteAddr(), err)
+	}
+	con.Close()
+}
+
+func (l *Listener) serveConnection(con net.Conn) error {
+	con.SetDeadline(time.Now().Add(handshakeTimeout))
+	stream, err := mse.Accept(con, l.Policy, l.infoHashes)
+	if err != nil {
+		return err
+	}
+	handShake, err := client.ReadHandShake(stream)
+	if err != nil {
+		return err
+	}
+	con.SetDeadline(time.Time{})
+
+	// connections for torrents we don't have are closed without a handshake
+	t, ok := l.torrent(handShake.InfoHash())
+	if !ok {
+		return fmt.Errorf("unknown info hash %x", handShake.InfoHash())
+	}
+	c, err := client.Accept(stream, handShake, t.PeerId())
+	if err != nil {
+		return err
+	}
+	return t.ServeIncoming(c)
+}
@@ -0,0 +1,170 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// torrent which hands every connection it gets to a channel
+type fakeTorrent struct {
+	peerId  [20]byte
+	clients chan *client.Client
+}
+
+func (f *fakeTorrent) PeerId() [20]byte {
+	return f.peerId
+}
+
+func (f *fakeTorrent) ServeIncoming(c *client.Client) error {
+	f.clients <- c
+	return nil
+}
+
+func startListener(t *testing.T) *Listener {
+	return startListenerWithPolicy(t, mse.PlaintextOnly)
+}
+
+func startListenerWithPolicy(t *testing.T, policy mse.Policy) *Listener {
+	l, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	l.Policy = policy
+	t.Cleanup(func() { l.Close() })
+	go l.Serve()
+	return l
+}
+
+func dial(t *testing.T, l *Listener, infoHash [20]byte) net.Conn {
+	con, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { con.Close() })
+	con.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var peerId [20]byte
+	copy(peerId[:], "remote-peer-01234567")
+	_, err = con.Write(client.NewHandShake(infoHash, peerId).Serialize())
+	require.NoError(t, err)
+	return con
+}
+
+func TestRoutesByInfoHash(t *testing.T) {
+	l := startListener(t)
+	first := &fakeTorrent{peerId: [20]byte{1}, clients: make(chan *client.Client, 1)}
+	second := &fakeTorrent{peerId: [20]byte{2}, clients: make(chan *client.Client, 1)}
+	l.Add([20]byte{0xa}, first)
+	l.Add([20]byte{0xb}, second)
+
+	con := dial(t, l, [20]byte{0xb})
+	reply, err := client.ReadHandShake(con)
+	require.NoError(t, err)
+	assert.Equal(t, [20]byte{0xb}, reply.InfoHash())
+	assert.Equal(t, [20]byte{2}, reply.PeerId(), "torrent's own peer id is used")
+
+	c := <-second.clients
+	assert.True(t, c.Incoming)
+	assert.True(t, c.SupportsExtensions)
+	assert.Equal(t, "remote-peer-01234567", c.Peer.ID)
+	assert.Equal(t, con.LocalAddr().(*net.TCPAddr).Port, c.Peer.Port)
+	assert.Empty(t, first.clients)
+}
+
+func TestAcceptsUTPConnections(t *testing.T) {
+	l := startListener(t)
+	socket, err := utp.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer socket.Close()
+	go l.ServeFrom(socket)
+	torrent := &fakeTorrent{peerId: [20]byte{1}, clients: make(chan *client.Client, 1)}
+	l.Add([20]byte{0xa}, torrent)
+
+	dialer, err := utp.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer dialer.Close()
+	con, err := dialer.DialTimeout(socket.Addr().String(), 2*time.Second)
+	require.NoError(t, err)
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = con.Write(client.NewHandShake([20]byte{0xa}, [20]byte{2}).Serialize())
+	require.NoError(t, err)
+
+	reply, err := client.ReadHandShake(con)
+	require.NoError(t, err)
+	assert.Equal(t, [20]byte{1}, reply.PeerId())
+	c := <-torrent.clients
+	assert.Equal(t, dialer.Addr().(*net.UDPAddr).Port, c.Peer.Port)
+}
+
+func TestRejectsUnknownInfoHash(t *testing.T) {
+	l := startListener(t)
+	l.Add([20]byte{0xa}, &fakeTorrent{clients: make(chan *client.Client, 1)})
+	l.Remove([20]byte{0xa})
+
+	con := dial(t, l, [20]byte{0xa})
+	_, err := con.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "connection is closed without a handshake")
+}
+
+func TestRejectsOtherProtocols(t *testing.T) {
+	l := startListener(t)
+	con, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// rest of the bytes aren't read, so the close can come as a reset
+	con.Write(append([]byte("\x04HTTP"), make([]byte, 48)...))
+	_, err = con.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	l := startListenerWithPolicy(t, mse.RequireEncrypted)
+	torrent := &fakeTorrent{peerId: [20]byte{1}, clients: make(chan *client.Client, 1)}
+	l.Add([20]byte{0xa}, torrent)
+
+	var peerId [20]byte
+	copy(peerId[:], "remote-peer-01234567")
+	peer := types.Peer{IP: net.ParseIP("127.0.0.1"), Port: l.Port()}
+	dialed, err := client.DialWithPolicy(peer, peerId, [20]byte{0xa}, mse.PreferEncrypted)
+	require.NoError(t, err)
+	defer dialed.Con.Close()
+	assert.True(t, dialed.Encrypted)
+	assert.Equal(t, [20]byte{0xa}, dialed.InfoHash)
+
+	accepted := <-torrent.clients
+	assert.True(t, accepted.Encrypted)
+	assert.Equal(t, "remote-peer-01234567", accepted.Peer.ID)
+}
+
+func TestPlaintextRefusedWhenEncryptionIsRequired(t *testing.T) {
+	l := startListenerWithPolicy(t, mse.RequireEncrypted)
+	l.Add([20]byte{0xa}, &fakeTorrent{clients: make(chan *client.Client, 1)})
+
+	con := dial(t, l, [20]byte{0xa})
+	_, err := con.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestPreferFallsBackToPlaintext(t *testing.T) {
+	l := startListenerWithPolicy(t, mse.PlaintextOnly)
+	torrent := &fakeTorrent{peerId: [20]byte{1}, clients: make(chan *client.Client, 1)}
+	l.Add([20]byte{0xa}, torrent)
+
+	peer := types.Peer{IP: net.ParseIP("127.0.0.1"), Port: l.Port()}
+	dialed, err := client.DialWithPolicy(peer, [20]byte{2}, [20]byte{0xa}, mse.PreferEncrypted)
+	require.NoError(t, err)
+	defer dialed.Con.Close()
+	assert.False(t, dialed.Encrypted)
+	assert.False(t, (<-torrent.clients).Encrypted)
+
+	_, err = client.DialWithPolicy(peer, [20]byte{2}, [20]byte{0xa}, mse.RequireEncrypted)
+	assert.Error(t, err)
+}
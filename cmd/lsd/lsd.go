@@ -0,0 +1,230 @@
+// Package lsd implements local service discovery, peers on the same network find each other through multicast
+//
+// https://www.bittorrent.org/beps/bep_0014.html
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+const (
+	DefaultGroup4 = "239.192.152.143:6771"
+	DefaultGroup6 = "[ff15::efc0:988f]:6771"
+	// torrents are announced at least every 5 minutes
+	DefaultInterval = 5 * time.Minute
+	// and at most once a minute
+	MinInterval = time.Minute
+	// announces have to fit in one datagram
+	maxMessageSize = 1400
+)
+
+var DefaultGroups = []string{DefaultGroup4, DefaultGroup6}
+
+type Config struct {
+	// bittorrent port announced to other peers
+	Port int
+	// multicast groups to announce in and listen to, DefaultGroups when empty
+	Groups []string
+	// interface to listen on, nil lets the system pick
+	Interface *net.Interface
+	// time between announces of a torrent, DefaultInterval when 0
+	Interval time.Duration
+}
+
+// Service announces our torrents to the local network and reports peers announcing the same torrents
+type Service struct {
+	config Config
+	// sent with our announces, so we can drop them when they loop back to us
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type group struct {
+	addr     *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+}
+
+type torrent struct {
+	found     func(peers []*types.Peer)
+	announced time.Time
+}
+
+// join the configured groups, groups which can't be joined are skipped
+// e.g. hosts without IPv6 still find peers over IPv4
+func New(config Config) (*Service, error) {
+	if config.Port <= 0 || config.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", config.Port)
+	}
+	if len(config.Groups) == 0 {
+		config.Groups = DefaultGroups
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	config.Interval = max(config.Interval, MinInterval)
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	s := &Service{
+		config:   config,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: map[[20]byte]*torrent{},
+		done:     make(chan struct{}),
+	}
+
+	var errs []error
+	for _, address := range config.Groups {
+		g, err := joinGroup(address, config.Interface)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", address, err))
+			continue
+		}
+		s.groups = append(s.groups, g)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("no multicast group could be joined: %w", errors.Join(errs...))
+	}
+	for _, err := range errs {
+		log.Default().Printf("Local service discovery skips a group: %v", err)
+	}
+
+	for _, g := range s.groups {
+		go s.serve(g)
+	}
+	go s.run()
+	return s, nil
+}
+
+func joinGroup(address string, ifi *net.Interface) (*group, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("not a multicast address")
+	}
+
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	listener, err := net.ListenMulticastUDP(network, ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &group{addr: addr, listener: listener, sender: sender}, nil
+}
+
+// announce infoHash to the local network until it's removed
+// peers announcing it are passed to found, which is called from the goroutine reading the group
+func (s *Service) Add(infoHash [20]byte, found func(peers []*types.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{found: found}
+	s.mu.Unlock()
+	s.announceDue(time.Now())
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, g := range s.groups {
+			g.listener.Close()
+			g.sender.Close()
+		}
+	})
+	return nil
+}
+
+func (s *Service) run() {
+	// due torrents are looked for every MinInterval, so new ones don't wait for a whole interval
+	ticker := time.NewTicker(MinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.announceDue(now)
+		}
+	}
+}
+
+// announce every torrent which wasn't announced for an interval, in as few datagrams as possible
+func (s *Service) announceDue(now time.Time) {
+	s.mu.Lock()
+	due := [][20]byte{}
+	for infoHash, t := range s.torrents {
+		if t.announced.IsZero() || now.Sub(t.announced) >= s.config.Interval {
+			t.announced = now
+			due = append(due, infoHash)
+		}
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		batch := due[:min(len(due), maxInfoHashes)]
+		due = due[len(batch):]
+		for _, g := range s.groups {
+			msg := FormatAnnounce(&Announce{Host: g.addr.String(), Port: s.config.Port, InfoHashes: batch, Cookie: s.cookie})
+			_, err := g.sender.WriteTo(msg, g.addr)
+			if err != nil {
+				log.Default().Printf("Failed to announce to %s: %v", g.addr, err)
+			}
+		}
+	}
+}
+
+func (s *Service) serve(g *group) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		size, addr, err := g.listener.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Default().Printf("Local service discovery stopped reading %s: %v", g.addr, err)
+			}
+			return
+		}
+
+		announce, err := ParseAnnounce(buf[:size])
+		if err != nil || announce.Cookie == s.cookie {
+			continue
+		}
+		peer := common.NewPeer("", addr.IP, announce.Port)
+		for _, infoHash := range announce.InfoHashes {
+			s.mu.Lock()
+			t, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+			if ok {
+				t.found([]*types.Peer{peer})
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lsd
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+func TestAnnounceMessage(t *testing.T) {
+	announce := &Announce{Host: DefaultGroup4, Port: 6881, InfoHashes: [][20]byte{{1}, {2}}, Cookie: "abc"}
+	parsed, err := ParseAnnounce(FormatAnnounce(announce))
+	require.NoError(t, err)
+	assert.Equal(t, announce, parsed)
+
+	// other clients capitalize headers their own way and send upper case hex
+	parsed, err = ParseAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nHOST: 239.192.152.143:6771\r\nport: 51413\r\nInfoHash: 0A00000000000000000000000000000000000000\r\n\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 51413, parsed.Port)
+	assert.Equal(t, [][20]byte{{0x0a}}, parsed.InfoHashes)
+
+	for _, packet := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: 0a00000000000000000000000000000000000000\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\n\r\n\r\n",
+	} {
+		_, err := ParseAnnounce([]byte(packet))
+		assert.Error(t, err, packet)
+	}
+}
+
+// peers found by a service, safe to read while the service reports more
+type foundPeers struct {
+	mu    sync.Mutex
+	peers []*types.Peer
+}
+
+func (f *foundPeers) add(peers []*types.Peer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peers = append(f.peers, peers...)
+}
+
+func (f *foundPeers) get() []*types.Peer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*types.Peer(nil), f.peers...)
+}
+
+// multicast group on a free port, announces loop back to the services of this host
+func testGroup(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+	return "239.192.152.143:" + strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestServicesFindEachOther(t *testing.T) {
+	group := testGroup(t)
+	first, err := New(Config{Port: 6881, Groups: []string{group}})
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	defer first.Close()
+	second, err := New(Config{Port: 6882, Groups: []string{group}})
+	require.NoError(t, err)
+	defer second.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+	firstFound, secondFound := &foundPeers{}, &foundPeers{}
+	first.Add(infoHash, firstFound.add)
+	second.Add([20]byte{9}, func([]*types.Peer) { t.Error("nobody else announces this torrent") })
+	second.Add(infoHash, secondFound.add)
+
+	require.Eventually(t, func() bool { return len(firstFound.get()) > 0 && len(secondFound.get()) > 0 }, 2*time.Second, 10*time.Millisecond)
+	for _, peer := range firstFound.get() {
+		assert.Equal(t, 6882, peer.Port, "own announces are dropped")
+	}
+	for _, peer := range secondFound.get() {
+		assert.Equal(t, 6881, peer.Port, "own announces are dropped")
+	}
+}
+
+func TestAnnounceRateLimit(t *testing.T) {
+	s, err := New(Config{Port: 6881, Groups: []string{testGroup(t)}, Interval: time.Second})
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	defer s.Close()
+	assert.Equal(t, MinInterval, s.config.Interval)
+
+	s.Add([20]byte{1}, func([]*types.Peer) {})
+	announced := s.torrents[[20]byte{1}].announced
+	s.announceDue(announced.Add(time.Second))
+	assert.Equal(t, announced, s.torrents[[20]byte{1}].announced, "announced again too soon")
+	s.announceDue(announced.Add(MinInterval))
+	assert.Equal(t, announced.Add(MinInterval), s.torrents[[20]byte{1}].announced)
+}
+
+func TestNewRejectsUnicastGroups(t *testing.T) {
+	_, err := New(Config{Port: 6881, Groups: []string{"127.0.0.1:6771"}})
+	assert.Error(t, err)
+}
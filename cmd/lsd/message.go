@@ -0,0 +1,92 @@
+package lsd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BT-SEARCH message, an http request over udp:
+//
+//	BT-SEARCH * HTTP/1.1\r\n
+//	Host: <group>\r\n
+//	Port: <port>\r\n
+//	Infohash: <hex info hash>\r\n
+//	cookie: <cookie>\r\n
+//	\r\n
+//	\r\n
+//
+// one Infohash header is sent for every announced torrent
+type Announce struct {
+	Host       string
+	Port       int
+	InfoHashes [][20]byte
+	Cookie     string // optional
+}
+
+const (
+	requestLine = "BT-SEARCH * HTTP/1.1"
+	// info hashes in one datagram, 40 bytes of hex each
+	maxInfoHashes = 25
+)
+
+func FormatAnnounce(a *Announce) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(requestLine + "\r\n")
+	buf.WriteString("Host: " + a.Host + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(a.Port) + "\r\n")
+	for _, infoHash := range a.InfoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n")
+	}
+	if a.Cookie != "" {
+		buf.WriteString("cookie: " + a.Cookie + "\r\n")
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// header names are case insensitive, unknown headers and malformed info hashes are skipped
+func ParseAnnounce(packet []byte) (*Announce, error) {
+	lines := strings.Split(string(packet), "\r\n")
+	if lines[0] != requestLine {
+		return nil, fmt.Errorf("not a BT-SEARCH message")
+	}
+
+	a := &Announce{}
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(name) {
+		case "host":
+			a.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			a.Port = port
+		case "infohash":
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != 20 {
+				continue
+			}
+			a.InfoHashes = append(a.InfoHashes, [20]byte(decoded))
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+
+	if a.Port == 0 {
+		return nil, fmt.Errorf("BT-SEARCH message without a port")
+	}
+	return a, nil
+}
@@ -0,0 +1,135 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// Magnet is a parsed magnet link
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string
+	Trackers    []string
+	Peers       []types.Peer // peers given with x.pe
+}
+
+const btihPrefix = "urn:btih:"
+
+func IsMagnet(uri string) bool {
+	return strings.HasPrefix(uri, "magnet:")
+}
+
+func Parse(uri string) (*Magnet, error) {
+	if !IsMagnet(uri) {
+		return nil, fmt.Errorf("%q is not a magnet link", uri)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	params, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	magnet := &Magnet{
+		DisplayName: params.Get("dn"),
+		Trackers:    params["tr"],
+	}
+
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+		magnet.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no urn:btih info hash")
+	}
+
+	for _, address := range params["x.pe"] {
+		peer, err := parsePeer(address)
+		if err != nil {
+			return nil, err
+		}
+		magnet.Peers = append(magnet.Peers, peer)
+	}
+	return magnet, nil
+}
+
+// info hash is either 40 hex characters or 32 base32 characters
+func parseInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("info hash %q has invalid length", encoded)
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash %q: %w", encoded, err)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+func parsePeer(address string) (types.Peer, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return types.Peer{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return types.Peer{}, fmt.Errorf("invalid port in peer address %q", address)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return types.Peer{}, fmt.Errorf("can't resolve peer address %q", address)
+		}
+		ip = ips[0]
+	}
+	return types.Peer{IP: ip, Port: port}, nil
+}
+
+// build a magnet link, useful to share a torrent without the .torrent file
+func (m *Magnet) String() string {
+	params := url.Values{}
+	if m.DisplayName != "" {
+		params.Set("dn", m.DisplayName)
+	}
+	for _, tracker := range m.Trackers {
+		params.Add("tr", tracker)
+	}
+	for _, peer := range m.Peers {
+		params.Add("x.pe", net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port)))
+	}
+
+	link := "magnet:?xt=" + btihPrefix + hex.EncodeToString(m.InfoHash[:])
+	if len(params) > 0 {
+		link += "&" + params.Encode()
+	}
+	return link
+}
@@ -0,0 +1,57 @@
+package magnet
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("hex info hash with name, trackers and peers", func(t *testing.T) {
+		link := "magnet:?xt=urn:btih:565db305a27ffb321fcc7b064afd7bd73aedda2b&dn=Big+Buck+Bunny" +
+			"&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80%2Fannounce&tr=http%3A%2F%2Ftracker.local%2Fannounce" +
+			"&x.pe=127.0.0.1:6881&x.pe=[::1]:6882"
+
+		m, err := Parse(link)
+		require.NoError(t, err)
+		assert.Equal(t, "565db305a27ffb321fcc7b064afd7bd73aedda2b", hex.EncodeToString(m.InfoHash[:]))
+		assert.Equal(t, "Big Buck Bunny", m.DisplayName)
+		assert.Equal(t, []string{"udp://tracker.openbittorrent.com:80/announce", "http://tracker.local/announce"}, m.Trackers)
+		require.Len(t, m.Peers, 2)
+		assert.True(t, m.Peers[0].IP.Equal(net.ParseIP("127.0.0.1")))
+		assert.Equal(t, 6881, m.Peers[0].Port)
+		assert.True(t, m.Peers[1].IP.Equal(net.ParseIP("::1")))
+	})
+
+	t.Run("base32 info hash", func(t *testing.T) {
+		m, err := Parse("magnet:?xt=urn:btih:KZO3GBNCP75TEH6MPMDEV7L3245O3WRL")
+		require.NoError(t, err)
+		assert.Equal(t, "565db305a27ffb321fcc7b064afd7bd73aedda2b", hex.EncodeToString(m.InfoHash[:]))
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		m, err := Parse("magnet:?xt=urn:btih:565db305a27ffb321fcc7b064afd7bd73aedda2b&dn=bunny&tr=http%3A%2F%2Ftracker.local%2Fannounce")
+		require.NoError(t, err)
+
+		parsed, err := Parse(m.String())
+		require.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	})
+
+	invalid := []string{
+		"http://example.com",
+		"magnet:?dn=no-hash",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:zz5db305a27ffb321fcc7b064afd7bd73aedda2b",
+		"magnet:?xt=urn:btih:565db305a27ffb321fcc7b064afd7bd73aedda2b&x.pe=127.0.0.1:0",
+	}
+	for _, link := range invalid {
+		t.Run("invalid "+link, func(t *testing.T) {
+			_, err := Parse(link)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// longest frame we read, a piece of MaxBlockLength and the bitfield of a torrent with millions of pieces fit
+	DefaultMaxFrameLength = 1 << 20
+	// buffered messages are written once they add up to this many bytes
+	DefaultFlushSize = MaxBlockLength
+	// or when the first of them waited this long
+	DefaultFlushInterval = 5 * time.Millisecond
+)
+
+var (
+	// the length prefix of a frame is above the limit of the decoder
+	ErrFrameTooLong = fmt.Errorf("frame too long")
+	// the payload doesn't have the length the message id requires
+	ErrPayloadLength = fmt.Errorf("invalid payload length")
+)
+
+// ParseError is returned for frames a well behaved peer doesn't send, the connection should be dropped
+type ParseError struct {
+	Id uint8
+	// length prefix of the frame, id included
+	Length uint32
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if errors.Is(e.Err, ErrFrameTooLong) {
+		return fmt.Sprintf("frame of %d bytes: %v", e.Length, e.Err)
+	}
+	return fmt.Sprintf("%s with a payload of %d bytes: %v", FindMessagebyId(e.Id), e.Length-1, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// true when err tells the peer broke the protocol rather than the connection
+func IsParseError(err error) bool {
+	var parseError *ParseError
+	return errors.As(err, &parseError)
+}
+
+// check the payload length of a message by it's id, unknown ids are left to whoever handles them
+// the bitfield length depends on the torrent, it's checked by the caller
+func validatePayload(id uint8, length int) error {
+	valid := true
+	switch id {
+	case MsgChoke, MsgUnChoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		valid = length == 0
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		valid = length == 4
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		valid = length == 12
+	case MsgPiece:
+		valid = length >= 8
+	case MsgPort:
+		valid = length == 2
+	case MsgExtended:
+		valid = length >= 1
+	}
+	if !valid {
+		return &ParseError{Id: id, Length: uint32(length + 1), Err: ErrPayloadLength}
+	}
+	return nil
+}
+
+// Decoder reads the messages of a stream into one buffer
+// the payload of a message is only valid until the next Decode, callers copy what they keep
+type Decoder struct {
+	// frames longer than this are refused, DefaultMaxFrameLength when 0
+	MaxFrameLength uint32
+
+	reader io.Reader
+	header [4]byte
+	buf    []byte
+}
+
+func NewDecoder(reader io.Reader) *Decoder {
+	return &Decoder{reader: reader}
+}
+
+// read the next message, keep-alives have no id and are returned as nil
+// nothing is read past the message, the stream can be read by others in between
+func (d *Decoder) Decode() (*Message, error) {
+	_, err := io.ReadFull(d.reader, d.header[:])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(d.header[:])
+	if length == 0 {
+		return nil, nil
+	}
+	maxLength := d.MaxFrameLength
+	if maxLength == 0 {
+		maxLength = DefaultMaxFrameLength
+	}
+	if length > maxLength {
+		return nil, &ParseError{Length: length, Err: ErrFrameTooLong}
+	}
+
+	if uint32(cap(d.buf)) < length {
+		d.buf = make([]byte, length)
+	}
+	buf := d.buf[:length]
+	_, err = io.ReadFull(d.reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePayload(buf[0], len(buf)-1)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Length: length, Id: buf[0], Payload: buf[1:]}, nil
+}
+
+// Writer batches messages into fewer writes, a batch is written when it reaches FlushSize or after FlushInterval
+// it's safe for many goroutines, errors of a write on the timer are returned by the next call
+type Writer struct {
+	// set before the first message is written, DefaultFlushSize and DefaultFlushInterval when 0
+	FlushSize     int
+	FlushInterval time.Duration
+
+	mu     sync.Mutex
+	writer io.Writer
+	buf    []byte
+	timer  *time.Timer
+	err    error
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer}
+}
+
+// append a message to the batch
+func (w *Writer) WriteMessage(m *Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(len(m.Payload)+1))
+	w.buf = append(w.buf, m.Id)
+	w.buf = append(w.buf, m.Payload...)
+
+	flushSize := w.FlushSize
+	if flushSize <= 0 {
+		flushSize = DefaultFlushSize
+	}
+	if len(w.buf) >= flushSize {
+		return w.flush()
+	}
+	if w.timer == nil {
+		interval := w.FlushInterval
+		if interval <= 0 {
+			interval = DefaultFlushInterval
+		}
+		w.timer = time.AfterFunc(interval, func() { w.Flush() })
+	}
+	return nil
+}
+
+// write a keep-alive, peers drop connections which are silent for two minutes
+func (w *Writer) WriteKeepAlive() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	return w.flush()
+}
+
+// write the messages of the batch now
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flush()
+}
+
+// w.mu is held, the buffer is kept for the next batch
+func (w *Writer) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.writer.Write(w.buf)
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
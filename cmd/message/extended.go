@@ -0,0 +1,64 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+)
+
+// dictionary sent in the extended handshake
+// m maps extension names to the message ids the sender wants to receive them with
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`      // tcp port the sender listens on
+	Reqq         int            `bencode:"reqq,omitempty"`   // requests the sender queues without dropping any
+	YourIp       string         `bencode:"yourip,omitempty"` // ip of the receiver as the sender sees it, 4 or 16 bytes
+}
+
+// extended message payload:
+//  1. Extended message id - 1 byte
+//  2. Extension specific payload - variable length
+func FormatExtendedMessage(extendedId uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extendedId
+	copy(buf[1:], payload)
+	return &Message{
+		Id:      MsgExtended,
+		Length:  uint32(len(buf) + 1),
+		Payload: buf,
+	}
+}
+
+func FormatExtendedHandshake(handshake ExtendedHandshake) (*Message, error) {
+	payload, err := bencode.Marshal(handshake)
+	if err != nil {
+		return nil, err
+	}
+	return FormatExtendedMessage(ExtendedHandshakeId, payload), nil
+}
+
+// returns extended message id and the payload following it
+func ParseExtendedMessage(message *Message) (uint8, []byte, error) {
+	if message.Id != MsgExtended {
+		return 0, nil, fmt.Errorf("expected an extended message but received %s", FindMessagebyId(message.Id))
+	}
+	if len(message.Payload) == 0 {
+		return 0, nil, fmt.Errorf("extended message payload is empty")
+	}
+	return message.Payload[0], message.Payload[1:], nil
+}
+
+func ParseExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	handshake := ExtendedHandshake{}
+	// peers add their own keys to the handshake and not every client sorts them
+	decoder := bencode.NewDecoder(bytes.NewReader(payload))
+	decoder.AllowUnsortedKeys()
+	err := decoder.Decode(&handshake)
+	if err != nil {
+		return ExtendedHandshake{}, err
+	}
+	return handshake, nil
+}
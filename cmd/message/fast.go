@@ -0,0 +1,79 @@
+package message
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// have all and have none replace the bitfield, they have no payload
+func FormatHaveAllMessage() *Message {
+	return &Message{Id: MsgHaveAll, Length: 1}
+}
+
+func FormatHaveNoneMessage() *Message {
+	return &Message{Id: MsgHaveNone, Length: 1}
+}
+
+// suggest and allowed fast payload is the index of a piece like the one of have
+func FormatSuggestMessage(pieceIndex int) *Message {
+	message := FormatHaveMessage(pieceIndex)
+	message.Id = MsgSuggest
+	return message
+}
+
+func FormatAllowedFastMessage(pieceIndex int) *Message {
+	message := FormatHaveMessage(pieceIndex)
+	message.Id = MsgAllowedFast
+	return message
+}
+
+// reject payload is the one of the request it refuses
+func FormatRejectMessage(pieceIndex, beg, len int) *Message {
+	message := FormatRequestMessage(pieceIndex, beg, len)
+	message.Id = MsgRejectRequest
+	return message
+}
+
+// piece index of a have, suggest or allowed fast message
+func ParsePieceIndex(message *Message) (int, error) {
+	if message.Id != MsgHave && message.Id != MsgSuggest && message.Id != MsgAllowedFast {
+		return 0, fmt.Errorf("expected a message with a piece index but received %s", FindMessagebyId(message.Id))
+	}
+	err := validatePayload(message.Id, len(message.Payload))
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(message.Payload)), nil
+}
+
+// allowed fast set of a peer, the k pieces it may request while choked
+// every client computes the same set for the same ip and torrent, only ipv4 peers get one
+func AllowedFastSet(k, numPieces int, ip net.IP, infoHash [20]byte) []int {
+	ip = ip.To4()
+	if ip == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	// the last byte of the ip is masked, peers behind one /24 share a set
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := []int{}
+	seen := map[int]bool{}
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -16,8 +16,22 @@ const (
 	MsgRequest       uint8 = 6
 	MsgPiece         uint8 = 7
 	MsgCancel        uint8 = 8
+	MsgPort          uint8 = 9 // udp port of the DHT node of a peer - https://www.bittorrent.org/beps/bep_0005.html
+	// fast extension - https://www.bittorrent.org/beps/bep_0006.html
+	MsgSuggest       uint8 = 13
+	MsgHaveAll       uint8 = 14
+	MsgHaveNone      uint8 = 15
+	MsgRejectRequest uint8 = 16
+	MsgAllowedFast   uint8 = 17
+	MsgExtended      uint8 = 20 // extension protocol - https://www.bittorrent.org/beps/bep_0010.html
 )
 
+// id of the extended handshake inside an extended message
+const ExtendedHandshakeId uint8 = 0
+
+// largest block a peer may ask for, bigger requests are refused
+const MaxBlockLength = 16 * 1024
+
 // bit torrent message has three main parts
 // 1. length of message - 4 bytes
 // 2. message id - 1 byte
@@ -48,23 +62,10 @@ func (m *Message) Serialize() []byte {
 }
 
 // read message from stream
+// keep-alive messages have no id and are returned as nil
+// the payload is the message's own, connections reading many messages use a Decoder instead
 func Read(stream io.Reader) (*Message, error) {
-	var length uint32
-	err := binary.Read(stream, binary.BigEndian, &length)
-	if err != nil {
-		return nil, err
-	}
-	buf := make([]byte, length)
-	_, err = io.ReadFull(stream, buf)
-	if err != nil {
-		return &Message{}, err
-	}
-
-	return &Message{
-		Length:  length,
-		Id:      uint8(buf[0]),
-		Payload: buf[1:],
-	}, nil
+	return NewDecoder(stream).Decode()
 }
 
 // check if bit field has certain piece
@@ -108,6 +109,20 @@ func FindMessagebyId(messageId uint8) (ans string) {
 		ans = "Piece Message"
 	case MsgCancel:
 		ans = "Cancel Message"
+	case MsgPort:
+		ans = "Port Message"
+	case MsgSuggest:
+		ans = "Suggest Piece Message"
+	case MsgHaveAll:
+		ans = "Have All Message"
+	case MsgHaveNone:
+		ans = "Have None Message"
+	case MsgRejectRequest:
+		ans = "Reject Request Message"
+	case MsgAllowedFast:
+		ans = "Allowed Fast Message"
+	case MsgExtended:
+		ans = "Extended Message"
 	default:
 		ans = "Not Supported Message"
 	}
@@ -140,13 +155,54 @@ func FormatRequestMessage(pieceIndex, beg, len int) *Message {
 	}
 }
 
-func FormatPieceMessage() *Message {
-	return nil
+// cancel payload is the one of the request it cancels
+func FormatCancelMessage(pieceIndex, beg, len int) *Message {
+	message := FormatRequestMessage(pieceIndex, beg, len)
+	message.Id = MsgCancel
+	return message
+}
+
+// piece payload:
+//  1. Piece Index - 4 bytes
+//  2. Offset - 4 bytes
+//  3. Block Data - variable length
+func FormatPieceMessage(pieceIndex, beg int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(beg))
+	copy(payload[8:], block)
+	return &Message{
+		Id:      MsgPiece,
+		Length:  uint32(1 + len(payload)),
+		Payload: payload,
+	}
+}
+
+// block asked for by a request message, or the one a cancel or reject message refers to
+type RequestMessage struct {
+	PieceIndex int
+	Begin      int
+	Length     int
+}
+
+func ParseRequestMessage(message *Message) (RequestMessage, error) {
+	if message.Id != MsgRequest && message.Id != MsgCancel && message.Id != MsgRejectRequest {
+		return RequestMessage{}, fmt.Errorf("expected a request message but received %s", FindMessagebyId(message.Id))
+	}
+	err := validatePayload(message.Id, len(message.Payload))
+	if err != nil {
+		return RequestMessage{}, err
+	}
+	return RequestMessage{
+		PieceIndex: int(binary.BigEndian.Uint32(message.Payload[0:4])),
+		Begin:      int(binary.BigEndian.Uint32(message.Payload[4:8])),
+		Length:     int(binary.BigEndian.Uint32(message.Payload[8:12])),
+	}, nil
 }
 
 // returns the piece sent by remote peer
-func ParseHaveMessage(message *Message) int {
-	return int(binary.BigEndian.Uint32(message.Payload))
+func ParseHaveMessage(message *Message) (int, error) {
+	return ParsePieceIndex(message)
 }
 
 // payload:
@@ -155,7 +211,7 @@ func ParseHaveMessage(message *Message) int {
 //  3. Block Data - variable length
 func ParsePieceMessage(message *Message) (PieceMessage, error) {
 	if len(message.Payload) < 8 {
-		return PieceMessage{}, fmt.Errorf("piece message payload is too short")
+		return PieceMessage{}, &ParseError{Id: MsgPiece, Length: uint32(len(message.Payload) + 1), Err: ErrPayloadLength}
 	}
 
 	// parse payload
@@ -0,0 +1,210 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// metadata exchange extension - https://www.bittorrent.org/beps/bep_0009.html
+const (
+	ExtensionName = "ut_metadata"
+	// message id we want to receive ut_metadata messages with
+	LocalId uint8 = 1
+	// metadata is exchanged in blocks of 16KiB, only the last block can be smaller
+	BlockSize = 16 * 1024
+	// info dictionaries bigger than this are refused, no sane torrent gets close to it
+	MaxSize = 16 * 1024 * 1024
+)
+
+const (
+	MsgRequest = 0
+	MsgData    = 1
+	MsgReject  = 2
+)
+
+// ut_metadata message, data messages carry the block right after the bencoded dictionary
+type Message struct {
+	Type      int    `bencode:"msg_type"`
+	Piece     int    `bencode:"piece"`
+	TotalSize int    `bencode:"total_size,omitempty"`
+	Data      []byte `bencode:"-"`
+}
+
+func (m *Message) Serialize() []byte {
+	// struct only contains integers so encoding can't fail
+	dict, _ := bencode.Marshal(m)
+	return append(dict, m.Data...)
+}
+
+func ParseMessage(payload []byte) (*Message, error) {
+	msg := &Message{}
+	reader := bytes.NewReader(payload)
+	decoder := bencode.NewDecoder(reader)
+	decoder.AllowUnsortedKeys()
+	err := decoder.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Data = payload[decoder.InputOffset():]
+	if msg.Type != MsgData && len(msg.Data) > 0 {
+		return nil, fmt.Errorf("unexpected data after ut_metadata message of type %d", msg.Type)
+	}
+	return msg, nil
+}
+
+// number of blocks metadata of given size is split into
+func BlockCount(size int) int {
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// answer a request from remote peer, info is nil while we don't have the metadata ourselves
+func Respond(info []byte, request *Message) *Message {
+	if request.Type != MsgRequest {
+		return nil
+	}
+
+	if info == nil || request.Piece < 0 || request.Piece >= BlockCount(len(info)) {
+		return &Message{Type: MsgReject, Piece: request.Piece}
+	}
+
+	start := request.Piece * BlockSize
+	end := min(start+BlockSize, len(info))
+	return &Message{
+		Type:      MsgData,
+		Piece:     request.Piece,
+		TotalSize: len(info),
+		Data:      info[start:end],
+	}
+}
+
+// download the info dictionary of a torrent, peers are tried one by one until one of them serves it
+// connections are opened by dial and encrypted as the policy says, returned bytes are verified against the info hash
+func Fetch(dial client.DialFunc, infoHash, peerId [20]byte, peers []types.Peer, policy mse.Policy) ([]byte, error) {
+	for _, peer := range peers {
+		info, err := fetchFromPeer(dial, peer, peerId, infoHash, policy)
+		if err != nil {
+			log.Default().Printf("Failed to fetch metadata from peer %v: %v", peer, err)
+			continue
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("none of %d peers served the metadata", len(peers))
+}
+
+func fetchFromPeer(dial client.DialFunc, peer types.Peer, peerId, infoHash [20]byte, policy mse.Policy) ([]byte, error) {
+	c, err := client.DialWith(dial, peer, peerId, infoHash, policy)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Con.Close()
+
+	if !c.SupportsExtensions {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	err = c.SendExtendedHandshake(message.ExtendedHandshake{
+		M: map[string]int{ExtensionName: int(LocalId)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.Con.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Con.SetDeadline(time.Time{})
+
+	var info []byte
+	var have []bool
+	received := 0
+	for {
+		msg, err := message.Read(c.Con)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.Id != message.MsgExtended {
+			continue
+		}
+
+		id, payload, err := message.ParseExtendedMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case message.ExtendedHandshakeId:
+			err = c.HandleExtendedMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			if info != nil {
+				continue
+			}
+
+			if _, ok := c.Extensions[ExtensionName]; !ok {
+				return nil, fmt.Errorf("peer does not support %s", ExtensionName)
+			}
+			if c.MetadataSize <= 0 || c.MetadataSize > MaxSize {
+				return nil, fmt.Errorf("peer advertised invalid metadata size %d", c.MetadataSize)
+			}
+
+			// request every block at once, they are small
+			info = make([]byte, c.MetadataSize)
+			have = make([]bool, BlockCount(len(info)))
+			for piece := 0; piece < BlockCount(len(info)); piece++ {
+				request := Message{Type: MsgRequest, Piece: piece}
+				err = c.SendExtended(ExtensionName, request.Serialize())
+				if err != nil {
+					return nil, err
+				}
+			}
+		case LocalId:
+			if info == nil {
+				continue
+			}
+
+			reply, err := ParseMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			switch reply.Type {
+			case MsgReject:
+				return nil, fmt.Errorf("peer rejected metadata piece %d", reply.Piece)
+			case MsgRequest:
+				// we don't have the metadata yet
+				c.SendExtended(ExtensionName, Respond(nil, reply).Serialize())
+				continue
+			case MsgData:
+			default:
+				continue
+			}
+
+			start := reply.Piece * BlockSize
+			end := min(start+BlockSize, len(info))
+			if reply.Piece < 0 || start >= len(info) || len(reply.Data) != end-start {
+				return nil, fmt.Errorf("peer sent invalid metadata piece %d", reply.Piece)
+			}
+			copy(info[start:end], reply.Data)
+			if !have[reply.Piece] {
+				have[reply.Piece] = true
+				received++
+			}
+
+			if received == BlockCount(len(info)) {
+				if sha1.Sum(info) != infoHash {
+					return nil, fmt.Errorf("metadata does not match the info hash")
+				}
+				return info, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// peer which only knows how to serve metadata
+func startMetadataPeer(t *testing.T, infoHash [20]byte, info []byte) types.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// it only speaks plaintext, connections which don't start with a handshake are given up on
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.ReadHandShake(conn)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		var peerId [20]byte
+		copy(peerId[:], "metadata-test-peer00")
+		conn.Write(client.NewHandShake(infoHash, peerId).Serialize())
+
+		// remote id of ut_metadata differs from ours on purpose
+		handshake, _ := message.FormatExtendedHandshake(message.ExtendedHandshake{
+			M:            map[string]int{ExtensionName: 3},
+			MetadataSize: len(info),
+		})
+		conn.Write(handshake.Serialize())
+
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			id, payload, err := message.ParseExtendedMessage(msg)
+			if err != nil || id != 3 {
+				continue
+			}
+			request, err := ParseMessage(payload)
+			if err != nil {
+				return
+			}
+			reply := Respond(info, request)
+			conn.Write(message.FormatExtendedMessage(LocalId, reply.Serialize()).Serialize())
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return types.Peer{IP: net.ParseIP(host), Port: port}
+}
+
+func TestFetch(t *testing.T) {
+	// spans three blocks with a short last one
+	info := []byte("d4:name4:test6:pieces" + strconv.Itoa(2*BlockSize+100) + ":" + string(bytes.Repeat([]byte("x"), 2*BlockSize+100)) + "e")
+	infoHash := sha1.Sum(info)
+	peer := startMetadataPeer(t, infoHash, info)
+
+	var peerId [20]byte
+	fetched, err := Fetch(client.DialTCP, infoHash, peerId, []types.Peer{peer}, mse.PlaintextOnly)
+	require.NoError(t, err)
+	assert.Equal(t, info, fetched)
+}
+
+func TestFetchRejectsWrongMetadata(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	var infoHash [20]byte
+	copy(infoHash[:], "not-the-right-hash!!")
+	peer := startMetadataPeer(t, infoHash, info)
+
+	var peerId [20]byte
+	_, err := Fetch(client.DialTCP, infoHash, peerId, []types.Peer{peer}, mse.PlaintextOnly)
+	assert.Error(t, err)
+}
+
+func TestFetchRequiringEncryption(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	infoHash := sha1.Sum(info)
+	peer := startMetadataPeer(t, infoHash, info)
+
+	var peerId [20]byte
+	_, err := Fetch(client.DialTCP, infoHash, peerId, []types.Peer{peer}, mse.RequireEncrypted)
+	assert.Error(t, err, "peer only speaks plaintext")
+}
+
+func TestMessage(t *testing.T) {
+	info := bytes.Repeat([]byte("a"), BlockSize+10)
+
+	reply := Respond(info, &Message{Type: MsgRequest, Piece: 1})
+	parsed, err := ParseMessage(reply.Serialize())
+	require.NoError(t, err)
+	assert.Equal(t, MsgData, parsed.Type)
+	assert.Equal(t, len(info), parsed.TotalSize)
+	assert.Equal(t, info[BlockSize:], parsed.Data)
+
+	assert.Equal(t, MsgReject, Respond(info, &Message{Type: MsgRequest, Piece: 2}).Type)
+	assert.Equal(t, MsgReject, Respond(nil, &Message{Type: MsgRequest, Piece: 0}).Type)
+}
@@ -0,0 +1,252 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// handshake of the peer opening the connection, skey is the info hash of the torrent
+//
+//	A->B: Ya, PadA
+//	B->A: Yb, PadB
+//	A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+//	B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+//
+// we send no initial payload, the bittorrent handshake follows on the returned connection
+func Initiate(con net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = con.Write(append(public, pad...))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(con)
+	remotePublic := make([]byte, keyLength)
+	_, err = io.ReadFull(reader, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := newCipher("keyA", secret, skey)
+	decrypt := newCipher("keyB", secret, skey)
+
+	buf := bytes.Buffer{}
+	buf.Write(hash([]byte("req1"), secret))
+	buf.Write(xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), secret)))
+	header := append([]byte{}, vc...)
+	header = binary.BigEndian.AppendUint32(header, policy.provide())
+	header = binary.BigEndian.AppendUint16(header, 0) // len(PadC)
+	header = binary.BigEndian.AppendUint16(header, 0) // len(IA)
+	encrypt.XORKeyStream(header, header)
+	buf.Write(header)
+	_, err = con.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// PadB ends where the encrypted VC starts
+	encryptedVC := make([]byte, len(vc))
+	newCipher("keyB", secret, skey).XORKeyStream(encryptedVC, vc)
+	err = synchronize(reader, encryptedVC, maxPad+len(vc))
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(make([]byte, len(vc)), encryptedVC)
+
+	selectHeader := make([]byte, 6)
+	_, err = io.ReadFull(reader, selectHeader)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(selectHeader, selectHeader)
+	selected := binary.BigEndian.Uint32(selectHeader[0:4])
+	padLength := int(binary.BigEndian.Uint16(selectHeader[4:6]))
+	if padLength > maxPad {
+		return nil, fmt.Errorf("padD of %d bytes is too long", padLength)
+	}
+	_, err = readEncrypted(reader, decrypt, padLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected&policy.provide() == 0 || (selected != CryptoRC4 && selected != CryptoPlaintext) {
+		return nil, fmt.Errorf("peer selected crypto method %#x we didn't provide", selected)
+	}
+	conn := &Conn{Conn: con, reader: reader}
+	if selected == CryptoRC4 {
+		conn.encrypt, conn.decrypt = encrypt, decrypt
+	}
+	return conn, nil
+}
+
+// the start of a plaintext bittorrent handshake
+var plaintextHandshake = append([]byte{19}, "BitTorrent protocol"...)
+
+// accept a connection a peer opened to us, plaintext ones are told apart by their first bytes
+// skeys returns the info hashes of the torrents peers may ask for
+// the returned connection gives the initial payload of the peer first, e.g. it's bittorrent handshake
+func Accept(con net.Conn, policy Policy, skeys func() [][20]byte) (*Conn, error) {
+	reader := bufio.NewReader(con)
+	start, err := reader.Peek(len(plaintextHandshake))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, plaintextHandshake) {
+		if policy == RequireEncrypted {
+			return nil, fmt.Errorf("plaintext connection refused, encryption is required")
+		}
+		return &Conn{Conn: con, reader: reader}, nil
+	}
+	if policy == PlaintextOnly {
+		return nil, fmt.Errorf("encrypted connection refused, encryption is disabled")
+	}
+	return receive(con, reader, policy, skeys)
+}
+
+// handshake of the peer which was connected to, see Initiate
+func receive(con net.Conn, reader *bufio.Reader, policy Policy, skeys func() [][20]byte) (*Conn, error) {
+	remotePublic := make([]byte, keyLength)
+	_, err := io.ReadFull(reader, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = con.Write(append(public, pad...))
+	if err != nil {
+		return nil, err
+	}
+
+	// PadA ends where HASH('req1', S) starts
+	req1 := hash([]byte("req1"), secret)
+	err = synchronize(reader, req1, maxPad+len(req1))
+	if err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, 20)
+	_, err = io.ReadFull(reader, obfuscated)
+	if err != nil {
+		return nil, err
+	}
+	skeyHash := xor(obfuscated, hash([]byte("req3"), secret))
+	var skey [20]byte
+	found := false
+	for _, candidate := range skeys() {
+		if bytes.Equal(hash([]byte("req2"), candidate[:]), skeyHash) {
+			skey, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("peer asked for a torrent we don't have")
+	}
+
+	encrypt := newCipher("keyB", secret, skey)
+	decrypt := newCipher("keyA", secret, skey)
+
+	header := make([]byte, len(vc)+4+2)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:len(vc)], vc) {
+		return nil, fmt.Errorf("invalid verification constant")
+	}
+	provided := binary.BigEndian.Uint32(header[len(vc):])
+	padLength := int(binary.BigEndian.Uint16(header[len(vc)+4:]))
+	if padLength > maxPad {
+		return nil, fmt.Errorf("padC of %d bytes is too long", padLength)
+	}
+	_, err = readEncrypted(reader, decrypt, padLength)
+	if err != nil {
+		return nil, err
+	}
+	length, err := readEncrypted(reader, decrypt, 2)
+	if err != nil {
+		return nil, err
+	}
+	initialPayload, err := readEncrypted(reader, decrypt, int(binary.BigEndian.Uint16(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := policy.selectCrypto(provided)
+	if err != nil {
+		return nil, err
+	}
+	reply := append([]byte{}, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, 0) // len(padD)
+	encrypt.XORKeyStream(reply, reply)
+	_, err = con.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &Conn{Conn: con, reader: reader, pending: initialPayload}
+	if selected == CryptoRC4 {
+		conn.encrypt, conn.decrypt = encrypt, decrypt
+	}
+	return conn, nil
+}
+
+// read and discard bytes until pattern was read, at most max bytes
+func synchronize(reader *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer didn't synchronize within %d bytes", max)
+}
+
+func readEncrypted(reader *bufio.Reader, decrypt *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+// Package mse implements message stream encryption, the obfuscation of peer connections
+// https://wiki.vuze.com/w/Message_Stream_Encryption
+package mse
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides which connections are encrypted
+type Policy int
+
+const (
+	// connections are never encrypted, encrypted incoming ones are refused
+	PlaintextOnly Policy = iota
+	// outgoing connections are encrypted and opened again in plaintext when the peer doesn't speak mse
+	// incoming connections are accepted either way
+	PreferEncrypted
+	// plaintext connections are refused
+	RequireEncrypted
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PlaintextOnly:
+		return "plaintext"
+	case PreferEncrypted:
+		return "prefer"
+	case RequireEncrypted:
+		return "require"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// policy by the name String gives it
+func ParsePolicy(name string) (Policy, error) {
+	for _, p := range []Policy{PlaintextOnly, PreferEncrypted, RequireEncrypted} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy %q, expected plaintext, prefer or require", name)
+}
+
+// crypto methods offered in crypto_provide and picked in crypto_select
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+// methods we offer to peers we connect to
+func (p Policy) provide() uint32 {
+	if p == RequireEncrypted {
+		return CryptoRC4
+	}
+	return CryptoRC4 | CryptoPlaintext
+}
+
+// method we pick from the ones offered by a peer connecting to us, rc4 when we can
+func (p Policy) selectCrypto(provided uint32) (uint32, error) {
+	if provided&CryptoRC4 != 0 {
+		return CryptoRC4, nil
+	}
+	if provided&CryptoPlaintext != 0 && p != RequireEncrypted {
+		return CryptoPlaintext, nil
+	}
+	return 0, fmt.Errorf("peer provides no crypto method we accept: %#x", provided)
+}
+
+const (
+	keyLength = 96 // bytes of a public key and the shared secret
+	maxPad    = 512
+	// rc4 key streams start after discarding this many bytes
+	discard = 1024
+)
+
+// prime and generator of the diffie-hellman key exchange
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+// verification constant, 8 zero bytes
+var vc = make([]byte, 8)
+
+// private key of 160 random bits and the public key sent to the peer
+func newKeys() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, public.FillBytes(make([]byte, keyLength)), nil
+}
+
+func sharedSecret(private *big.Int, remotePublic []byte) ([]byte, error) {
+	remote := new(big.Int).SetBytes(remotePublic)
+	if remote.Cmp(big.NewInt(1)) <= 0 || remote.Cmp(prime) >= 0 {
+		return nil, fmt.Errorf("invalid public key of peer")
+	}
+	secret := new(big.Int).Exp(remote, private, prime)
+	return secret.FillBytes(make([]byte, keyLength)), nil
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// rc4 cipher of HASH(name, S, SKEY), keyA encrypts what the connecting peer sends and keyB the other way
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+	buf := make([]byte, discard)
+	cipher.XORKeyStream(buf, buf)
+	return cipher
+}
+
+// random padding of up to maxPad bytes
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, (int(n[0])<<8|int(n[1]))%(maxPad+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// Conn is a connection after the mse handshake, it reads and writes plaintext
+// writes are safe from many goroutines like the ones of net.Conn
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte // initial payload of the peer, read before the stream
+
+	writeMu sync.Mutex
+	encrypt *rc4.Cipher // nil when plaintext was selected
+	decrypt *rc4.Cipher
+}
+
+// true when the stream is rc4 encrypted, false when the peers agreed on plaintext
+func (c *Conn) Encrypted() bool {
+	return c.encrypt != nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
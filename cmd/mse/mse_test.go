@@ -0,0 +1,176 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connection which remembers every byte written to it
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// both ends of a tcp connection on loopback, the pipe of net.Pipe has no buffer for the pads
+func tcpPair(t *testing.T) (*recordingConn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, err := l.Accept()
+		if err == nil {
+			accepted <- con
+		}
+		close(accepted)
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	remote := <-accepted
+	require.NotNil(t, remote)
+
+	t.Cleanup(func() { dialed.Close(); remote.Close() })
+	dialed.SetDeadline(time.Now().Add(5 * time.Second))
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	return &recordingConn{Conn: dialed}, remote
+}
+
+var (
+	skey  = [20]byte{1, 2, 3}
+	other = [20]byte{4, 5, 6}
+)
+
+func skeys() [][20]byte {
+	return [][20]byte{other, skey}
+}
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+func accept(con net.Conn, policy Policy) <-chan result {
+	results := make(chan result, 1)
+	go func() {
+		conn, err := Accept(con, policy, skeys)
+		results <- result{conn, err}
+	}()
+	return results
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	dialed, remote := tcpPair(t)
+	accepted := accept(remote, PreferEncrypted)
+
+	initiated, err := Initiate(dialed, skey, PreferEncrypted)
+	require.NoError(t, err)
+	receiver := <-accepted
+	require.NoError(t, receiver.err)
+	assert.True(t, initiated.Encrypted())
+	assert.True(t, receiver.conn.Encrypted())
+
+	secret := []byte("\x13BitTorrent protocol and a secret")
+	_, err = initiated.Write(secret)
+	require.NoError(t, err)
+	buf := make([]byte, len(secret))
+	_, err = io.ReadFull(receiver.conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, secret, buf)
+
+	_, err = receiver.conn.Write([]byte("reply"))
+	require.NoError(t, err)
+	buf = make([]byte, 5)
+	_, err = io.ReadFull(initiated, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buf))
+
+	assert.NotContains(t, dialed.written.String(), "BitTorrent protocol", "nothing is sent in plaintext")
+}
+
+func TestRequireEncryptedAgainstPrefer(t *testing.T) {
+	dialed, remote := tcpPair(t)
+	accepted := accept(remote, RequireEncrypted)
+
+	initiated, err := Initiate(dialed, skey, PreferEncrypted)
+	require.NoError(t, err)
+	require.NoError(t, (<-accepted).err)
+	assert.True(t, initiated.Encrypted())
+}
+
+func TestAcceptPlaintextConnection(t *testing.T) {
+	handshake := append(append([]byte{}, plaintextHandshake...), make([]byte, 48)...)
+	for _, policy := range []Policy{PlaintextOnly, PreferEncrypted} {
+		dialed, remote := tcpPair(t)
+		accepted := accept(remote, policy)
+		_, err := dialed.Write(handshake)
+		require.NoError(t, err)
+
+		receiver := <-accepted
+		require.NoError(t, receiver.err, policy.String())
+		assert.False(t, receiver.conn.Encrypted())
+		buf := make([]byte, len(handshake))
+		_, err = io.ReadFull(receiver.conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, handshake, buf, "peeked bytes are read again")
+	}
+
+	dialed, remote := tcpPair(t)
+	accepted := accept(remote, RequireEncrypted)
+	_, err := dialed.Write(handshake)
+	require.NoError(t, err)
+	assert.Error(t, (<-accepted).err)
+}
+
+func TestAcceptRefusesEncryptionWhenDisabled(t *testing.T) {
+	dialed, remote := tcpPair(t)
+	accepted := accept(remote, PlaintextOnly)
+	go Initiate(dialed, skey, PreferEncrypted)
+	assert.Error(t, (<-accepted).err)
+}
+
+func TestAcceptUnknownTorrent(t *testing.T) {
+	dialed, remote := tcpPair(t)
+	accepted := accept(remote, PreferEncrypted)
+	go Initiate(dialed, [20]byte{9}, PreferEncrypted)
+	assert.Error(t, (<-accepted).err)
+}
+
+func TestSelectCrypto(t *testing.T) {
+	selected, err := PreferEncrypted.selectCrypto(CryptoPlaintext | CryptoRC4)
+	require.NoError(t, err)
+	assert.Equal(t, CryptoRC4, selected)
+
+	selected, err = PreferEncrypted.selectCrypto(CryptoPlaintext)
+	require.NoError(t, err)
+	assert.Equal(t, CryptoPlaintext, selected)
+
+	_, err = RequireEncrypted.selectCrypto(CryptoPlaintext)
+	assert.Error(t, err)
+	assert.Equal(t, CryptoRC4, RequireEncrypted.provide())
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{PlaintextOnly, PreferEncrypted, RequireEncrypted} {
+		parsed, err := ParsePolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParsePolicy("always")
+	assert.Error(t, err)
+}
@@ -1,32 +1,288 @@
 package p2p
 
 import (
+	"fmt"
+	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 
+	"github.com/umair-hassan2/torrent-client/cmd/client"
 	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/dht"
+	"github.com/umair-hassan2/torrent-client/cmd/listener"
+	"github.com/umair-hassan2/torrent-client/cmd/lsd"
+	"github.com/umair-hassan2/torrent-client/cmd/magnet"
+	"github.com/umair-hassan2/torrent-client/cmd/metadata"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
 	"github.com/umair-hassan2/torrent-client/cmd/torrent"
 	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/utp"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
 const ClientId = "zero-net"
 
+// download a torrent given by the path of a .torrent file or a magnet link
+// blocks until the download is finished
 func Begin(fileName string) {
+	BeginWithOptions(fileName, Options{})
+}
+
+type Options struct {
+	// tcp address other peers connect to us on, DefaultListenAddr when empty
+	ListenAddr string
+	// metadata fetched for a magnet link is saved as a .torrent file at this path, empty to skip
+	SaveTorrentPath string
+	// udp address of our DHT node, DefaultDhtAddr when empty
+	DhtAddr string
+	// routing table of our DHT node is kept in this file between runs, DefaultDhtStatePath when empty
+	DhtStatePath string
+	DisableDHT   bool
+	// don't look for peers on the local network
+	DisableLSD bool
+	// keep uploading after the download finished, until the process is interrupted
+	Seed bool
+	// peers unchoked for their rate besides the optimistic unchoke, torrent.DefaultUploadSlots when 0
+	UploadSlots int
+	// encryption of incoming and outgoing connections
+	Encryption mse.Policy
+	// connect to peers and accept them over tcp only
+	DisableUTP bool
+}
+
+const (
+	DefaultListenAddr = ":6881"
+	DefaultDhtAddr    = ":6881"
+)
+
+// dht.state in the user's cache directory, empty when there is none
+func DefaultDhtStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, ClientId, "dht.state")
+}
+
+func BeginWithOptions(source string, options Options) {
+	peerId, err := RandomPeerId()
+	if err != nil {
+		panic(err)
+	}
+	peerListener, err := startListener(options.ListenAddr)
+	if err != nil {
+		panic(err)
+	}
+	defer peerListener.Close()
+	peerListener.Policy = options.Encryption
+	go peerListener.Serve()
+	currentPeer := common.NewPeer(peerId, net.ParseIP("127.0.0.1"), peerListener.Port())
+
+	// uTP listens on the udp port of the same number as the tcp one, peers expect it there
+	utpTransport := &client.UdpCon{}
+	if !options.DisableUTP {
+		utpListener, err := utpTransport.Listen(fmt.Sprintf(":%d", peerListener.Port()))
+		if err != nil {
+			log.Default().Printf("Failed to start uTP, continuing with tcp only: %v", err)
+		} else {
+			defer utpListener.Close()
+			go peerListener.ServeFrom(utpListener)
+		}
+	}
+	socket := utpTransport.Socket
+	dialer := client.PreferUTP(socket)
+	defer func() {
+		log.Default().Printf("Connections to peers by transport: %+v", dialer.Stats())
+	}()
+
+	var node *dht.Node
+	if !options.DisableDHT {
+		node, err = startDht(options.DhtAddr, options.DhtStatePath, socket)
+		if err != nil {
+			log.Default().Printf("Failed to start DHT node, continuing without it: %v", err)
+		} else {
+			defer node.Close()
+		}
+	}
+
+	var torrentFile *torrent_file.TorrentFile
+	var extraPeers []*types.Peer
+	if magnet.IsMagnet(source) {
+		torrentFile, extraPeers, err = resolveMagnet(source, *currentPeer, node, dialer, options)
+	} else {
+		torrentFile, err = readTorrentFile(source)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	torrent := torrent.New(*currentPeer, torrentFile)
+	torrent.DHT = node
+	torrent.Seed = options.Seed
+	torrent.UploadSlots = options.UploadSlots
+	torrent.Encryption = options.Encryption
+	torrent.Dialer = dialer
+	if !options.DisableLSD {
+		service, err := lsd.New(lsd.Config{Port: currentPeer.Port})
+		if err != nil {
+			log.Default().Printf("Failed to start local service discovery, continuing without it: %v", err)
+		} else {
+			defer service.Close()
+			torrent.LSD = service
+		}
+	}
+	torrent.AddPeers(extraPeers)
+	peerListener.Add(torrent.InfoHash, torrent)
+	defer peerListener.Remove(torrent.InfoHash)
+	if options.Seed {
+		go stopOnInterrupt(torrent)
+	}
+	err = torrent.Start()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ctrl+c ends seeding, trackers are told we stopped
+func stopOnInterrupt(t *torrent.Torrent) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	signal.Stop(interrupt)
+	t.Stop()
+}
+
+// listen for other peers, a busy port is replaced by any free one so we can still be reached
+func startListener(addr string) (*listener.Listener, error) {
+	if addr == "" {
+		addr = DefaultListenAddr
+	}
+	peerListener, err := listener.Listen(addr)
+	if err == nil {
+		return peerListener, nil
+	}
+	log.Default().Printf("Failed to listen on %s, using a free port instead: %v", addr, err)
+	return listener.Listen(":0")
+}
+
+// the DHT node shares the socket of uTP when it's on the same port, socket may be nil
+func startDht(addr string, statePath string, socket *utp.Socket) (*dht.Node, error) {
+	if addr == "" {
+		addr = DefaultDhtAddr
+	}
+	if statePath == "" {
+		statePath = DefaultDhtStatePath()
+	}
+	if statePath != "" {
+		err := os.MkdirAll(filepath.Dir(statePath), 0o755)
+		if err != nil {
+			log.Default().Printf("DHT routing table won't be saved: %v", err)
+			statePath = ""
+		}
+	}
+	config := dht.Config{Addr: addr, StatePath: statePath, BootstrapNodes: dht.DefaultBootstrapNodes}
+	if socket != nil && samePort(addr, socket.Addr()) {
+		config.Conn = socket.PacketConn()
+	}
+	return dht.New(config)
+}
+
+// true when addr names the port socketAddr is bound to
+func samePort(addr string, socketAddr net.Addr) bool {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil || udpAddr.Port == 0 {
+		return false
+	}
+	bound, ok := socketAddr.(*net.UDPAddr)
+	return ok && bound.Port == udpAddr.Port
+}
+
+func readTorrentFile(fileName string) (*torrent_file.TorrentFile, error) {
 	// TODO: UI interface to upload file
 	file, err := os.Open(fileName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	defer file.Close()
 
 	fileContent, err := torrent_file.DecodeFile(file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	torrentFile := torrent_file.FromBencodeToTorrentFile(fileContent)
-	currentPeer := common.NewPeer("", net.IP("127.0.0.1"), 3000)
-	torrent := torrent.New(*currentPeer, torrentFile)
-	go torrent.Start()
+	return torrent_file.FromBencodeToTorrentFile(fileContent), nil
+}
+
+// fetch the info dictionary of a magnet link from peers
+// returns the torrent file and the peers known so far
+// node is used to find peers when it's not nil, peers are connected to with dialer
+func resolveMagnet(link string, currentPeer types.Peer, node *dht.Node, dialer *client.Dialer, options Options) (*torrent_file.TorrentFile, []*types.Peer, error) {
+	m, err := magnet.Parse(link)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peers := []*types.Peer{}
+	for i := range m.Peers {
+		peers = append(peers, &m.Peers[i])
+	}
+
+	// without metadata we only know the info hash, which is enough to ask trackers for peers
+	// every tracker of a magnet link is a tier of it's own so peers of all of them are used
+	if len(m.Trackers) > 0 {
+		partial := &torrent_file.TorrentFile{InfoHash: m.InfoHash}
+		for _, trackerUrl := range m.Trackers {
+			partial.AnnounceList = append(partial.AnnounceList, []string{trackerUrl})
+		}
+		announcing := torrent.New(currentPeer, partial)
+		trackerPeers, err := announcing.AnnounceToTracker()
+		announcing.Stop()
+		if err != nil {
+			log.Default().Printf("Failed to announce to trackers: %v", err)
+		}
+		peers = append(peers, trackerPeers...)
+	}
+	if node != nil {
+		dhtPeers, err := node.GetPeers(m.InfoHash)
+		if err != nil {
+			log.Default().Printf("Failed to get peers from the DHT: %v", err)
+		}
+		peers = append(peers, dhtPeers...)
+	}
+
+	if len(peers) == 0 {
+		return nil, nil, fmt.Errorf("no peers found for magnet link")
+	}
+
+	var peerId [20]byte
+	copy(peerId[:], currentPeer.ID)
+	candidates := make([]types.Peer, len(peers))
+	for i, peer := range peers {
+		candidates[i] = *peer
+	}
+	info, err := metadata.Fetch(dialer.Dial, m.InfoHash, peerId, candidates, options.Encryption)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	btf, err := torrent_file.FromInfo(info, m.Trackers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if options.SaveTorrentPath != "" {
+		data, err := btf.Encode()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = os.WriteFile(options.SaveTorrentPath, data, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return torrent_file.FromBencodeToTorrentFile(btf), peers, nil
 }
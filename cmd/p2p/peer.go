@@ -0,0 +1,21 @@
+package p2p
+
+import (
+	"crypto/rand"
+)
+
+const peerIdAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// generate a 20 byte peer id, prefixed with our client id so other peers can recognise us
+func RandomPeerId() (string, error) {
+	random := make([]byte, 20-len(ClientId))
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range random {
+		random[i] = peerIdAlphabet[int(random[i])%len(peerIdAlphabet)]
+	}
+	return ClientId + string(random), nil
+}
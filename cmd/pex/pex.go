@@ -0,0 +1,178 @@
+// Package pex implements peer exchange, connected peers tell each other about the other peers they are connected to
+//
+// https://www.bittorrent.org/beps/bep_0011.html
+package pex
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+const (
+	ExtensionName = "ut_pex"
+	// message id we want to receive ut_pex messages with
+	LocalId uint8 = 2
+	// a peer sends at most one message a minute
+	Interval = time.Minute
+	// most added and most dropped peers in one message
+	MaxPeers = 50
+)
+
+// flags of an added peer
+const (
+	FlagEncryption  byte = 0x01 // prefers encrypted connections
+	FlagSeed        byte = 0x02 // has every piece
+	FlagUtp         byte = 0x04
+	FlagHolepunch   byte = 0x08
+	FlagConnectable byte = 0x10 // accepts incoming connections
+)
+
+// ut_pex message, every field holds compact peers or one flags byte per added peer
+type Message struct {
+	Added       []byte `bencode:"added,omitempty"`
+	AddedFlags  []byte `bencode:"added.f,omitempty"`
+	Added6      []byte `bencode:"added6,omitempty"`
+	Added6Flags []byte `bencode:"added6.f,omitempty"`
+	Dropped     []byte `bencode:"dropped,omitempty"`
+	Dropped6    []byte `bencode:"dropped6,omitempty"`
+}
+
+// Peer is an exchanged peer together with it's flags
+type Peer struct {
+	types.Peer
+	Flags byte
+}
+
+func NewMessage(added []Peer, dropped []*types.Peer) *Message {
+	m := &Message{}
+	for _, peer := range added {
+		if peer.IP.To4() != nil {
+			m.Added = appendCompact(m.Added, &peer.Peer)
+			m.AddedFlags = append(m.AddedFlags, peer.Flags)
+		} else if peer.IP.To16() != nil {
+			m.Added6 = appendCompact(m.Added6, &peer.Peer)
+			m.Added6Flags = append(m.Added6Flags, peer.Flags)
+		}
+	}
+	m.Dropped, m.Dropped6 = torrent_file.CompactPeers(dropped)
+	return m
+}
+
+func appendCompact(buf []byte, peer *types.Peer) []byte {
+	peers4, peers6 := torrent_file.CompactPeers([]*types.Peer{peer})
+	return append(append(buf, peers4...), peers6...)
+}
+
+func (m *Message) Serialize() []byte {
+	// struct only contains byte strings so encoding can't fail
+	data, _ := bencode.Marshal(m)
+	return data
+}
+
+// clients add their own keys and don't always sort them
+func ParseMessage(payload []byte) (*Message, error) {
+	m := &Message{}
+	decoder := bencode.NewDecoder(bytes.NewReader(payload))
+	decoder.AllowUnsortedKeys()
+	err := decoder.Decode(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// added peers, IPv4 ones first, peers without flags get none
+func (m *Message) AddedPeers() ([]Peer, error) {
+	peers := []Peer{}
+	for _, family := range []struct {
+		compact  []byte
+		flags    []byte
+		ipLength int
+	}{{m.Added, m.AddedFlags, net.IPv4len}, {m.Added6, m.Added6Flags, net.IPv6len}} {
+		parsed, err := torrent_file.ParseCompactPeers(family.compact, family.ipLength)
+		if err != nil {
+			return nil, err
+		}
+		for i, peer := range parsed {
+			added := Peer{Peer: *peer}
+			if i < len(family.flags) {
+				added.Flags = family.flags[i]
+			}
+			peers = append(peers, added)
+		}
+	}
+	return peers, nil
+}
+
+func (m *Message) DroppedPeers() ([]*types.Peer, error) {
+	peers, err := torrent_file.ParseCompactPeers(m.Dropped, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := torrent_file.ParseCompactPeers(m.Dropped6, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+// State is the exchange with one connected peer
+// it remembers what the remote peer was told so every message only carries changes
+type State struct {
+	sent         map[string]*types.Peer // by address
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+func NewState() *State {
+	return &State{sent: map[string]*types.Peer{}}
+}
+
+// message telling the remote peer how connected changed since the last message
+// nil while the last message is less than Interval ago or nothing changed
+func (s *State) Next(connected []Peer, now time.Time) *Message {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < Interval {
+		return nil
+	}
+
+	current := map[string]bool{}
+	added := []Peer{}
+	for _, peer := range connected {
+		address := common.PeerAdress(peer.Peer)
+		current[address] = true
+		if s.sent[address] == nil && len(added) < MaxPeers {
+			added = append(added, peer)
+			sent := peer.Peer
+			s.sent[address] = &sent
+		}
+	}
+	dropped := []*types.Peer{}
+	for address, peer := range s.sent {
+		if !current[address] && len(dropped) < MaxPeers {
+			dropped = append(dropped, peer)
+			delete(s.sent, address)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	s.lastSent = now
+	return NewMessage(added, dropped)
+}
+
+// false when the remote peer sends messages faster than it should, such messages are ignored
+// half an interval is allowed for peers whose timers run a bit early
+func (s *State) Receive(now time.Time) bool {
+	if !s.lastReceived.IsZero() && now.Sub(s.lastReceived) < Interval/2 {
+		return false
+	}
+	s.lastReceived = now
+	return true
+}
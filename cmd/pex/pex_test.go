@@ -0,0 +1,105 @@
+package pex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+func peer(ip string, port int, flags byte) Peer {
+	return Peer{Peer: types.Peer{IP: net.ParseIP(ip), Port: port}, Flags: flags}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	added := []Peer{peer("10.0.0.1", 6881, FlagSeed|FlagConnectable), peer("2001:db8::1", 6882, FlagUtp)}
+	dropped := []*types.Peer{{IP: net.ParseIP("10.0.0.2"), Port: 6883}, {IP: net.ParseIP("2001:db8::2"), Port: 6884}}
+
+	msg, err := ParseMessage(NewMessage(added, dropped).Serialize())
+	require.NoError(t, err)
+	assert.Len(t, msg.Added, 6)
+	assert.Len(t, msg.Added6, 18)
+
+	parsed, err := msg.AddedPeers()
+	require.NoError(t, err)
+	require.Len(t, parsed, 2)
+	assert.Equal(t, "10.0.0.1", parsed[0].IP.String())
+	assert.Equal(t, 6881, parsed[0].Port)
+	assert.Equal(t, FlagSeed|FlagConnectable, parsed[0].Flags)
+	assert.Equal(t, "2001:db8::1", parsed[1].IP.String())
+	assert.Equal(t, FlagUtp, parsed[1].Flags)
+
+	droppedPeers, err := msg.DroppedPeers()
+	require.NoError(t, err)
+	require.Len(t, droppedPeers, 2)
+	assert.Equal(t, "10.0.0.2", droppedPeers[0].IP.String())
+	assert.Equal(t, "2001:db8::2", droppedPeers[1].IP.String())
+}
+
+func TestParseMessage(t *testing.T) {
+	// unsorted keys, an unknown key and no flags
+	msg, err := ParseMessage([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe11:v3:abc7:dropped0:e"))
+	require.NoError(t, err)
+	added, err := msg.AddedPeers()
+	require.NoError(t, err)
+	require.Len(t, added, 1)
+	assert.Equal(t, byte(0), added[0].Flags)
+
+	msg, err = ParseMessage([]byte("d5:added5:\x0a\x00\x00\x01\x1ae"))
+	require.NoError(t, err)
+	_, err = msg.AddedPeers()
+	assert.Error(t, err, "truncated compact peer")
+
+	_, err = ParseMessage([]byte("not bencode"))
+	assert.Error(t, err)
+}
+
+func TestStateSendsChanges(t *testing.T) {
+	state := NewState()
+	now := time.Now()
+	first, second := peer("10.0.0.1", 6881, 0), peer("10.0.0.2", 6882, 0)
+
+	msg := state.Next([]Peer{first, second}, now)
+	require.NotNil(t, msg)
+	added, _ := msg.AddedPeers()
+	assert.Len(t, added, 2)
+
+	assert.Nil(t, state.Next([]Peer{first}, now.Add(Interval/2)), "at most one message a minute")
+
+	msg = state.Next([]Peer{first}, now.Add(Interval))
+	require.NotNil(t, msg)
+	added, _ = msg.AddedPeers()
+	assert.Empty(t, added, "first peer was sent already")
+	dropped, _ := msg.DroppedPeers()
+	require.Len(t, dropped, 1)
+	assert.Equal(t, "10.0.0.2", dropped[0].IP.String())
+
+	assert.Nil(t, state.Next([]Peer{first}, now.Add(3*Interval)), "nothing changed")
+}
+
+func TestStateLimitsPeersPerMessage(t *testing.T) {
+	state := NewState()
+	connected := []Peer{}
+	for i := 0; i < MaxPeers+10; i++ {
+		connected = append(connected, peer("10.0.1.1", 1000+i, 0))
+	}
+
+	msg := state.Next(connected, time.Now())
+	added, _ := msg.AddedPeers()
+	assert.Len(t, added, MaxPeers)
+
+	msg = state.Next(connected, time.Now().Add(Interval))
+	added, _ = msg.AddedPeers()
+	assert.Len(t, added, 10, "the rest follows with the next message")
+}
+
+func TestStateReceiveRateLimit(t *testing.T) {
+	state := NewState()
+	now := time.Now()
+	assert.True(t, state.Receive(now))
+	assert.False(t, state.Receive(now.Add(time.Second)))
+	assert.True(t, state.Receive(now.Add(Interval)))
+}
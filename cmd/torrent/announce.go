@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"log"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+const (
+	// used when a tracker does not say how often it wants to hear from us
+	defaultAnnounceInterval = 30 * time.Minute
+	// wait before trying again when no tracker answered
+	announceRetryInterval = time.Minute
+	// how long Stop waits for the stopped event to reach trackers
+	stoppedAnnounceTimeout = 5 * time.Second
+	// DHT nodes forget peers after 30 minutes, so we announce again before that
+	dhtAnnounceInterval = 15 * time.Minute
+)
+
+// announce to trackers for the whole life of the torrent
+// started is sent first, then periodic updates, completed once the last piece is verified and stopped on shutdown
+func (t *Torrent) runTrackerSession() {
+	defer close(t.sessionDone)
+
+	event := tracker.EventStarted
+	completed := t.completed
+	for {
+		wait, ok := t.announce(event)
+		// a failed event is sent again with the next announce
+		if ok {
+			event = tracker.EventNone
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			if event != tracker.EventStarted {
+				event = tracker.EventCompleted
+			}
+		case <-t.done:
+			timer.Stop()
+			// download may finish and stop the torrent before completed got announced
+			select {
+			case <-completed:
+				t.announce(tracker.EventCompleted)
+			default:
+			}
+			t.announce(tracker.EventStopped)
+			return
+		}
+	}
+}
+
+// announce to the DHT until the torrent is stopped, peers found on the way go to the download
+func (t *Torrent) runDhtSession() {
+	for {
+		peers, err := t.DHT.Announce(t.InfoHash, t.currentPeer.Port)
+		if err != nil {
+			log.Default().Printf("Failed to announce to the DHT: %v", err)
+		}
+		t.AddPeers(peers)
+
+		wait := dhtAnnounceInterval
+		if err != nil && len(peers) == 0 {
+			wait = announceRetryInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// announce once and feed the peers to the download
+// returns how long to wait before the next announce and whether any tracker answered
+func (t *Torrent) announce(event tracker.Event) (time.Duration, bool) {
+	response, err := t.Trackers.Announce(func(announceUrl string) (*tracker.TrackerResponse, error) {
+		announcer, err := t.announcer(announceUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		request := t.announceRequest(event)
+		request.TrackerId = t.trackerId(announceUrl)
+		response, err := announcer.Announce(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Warning != "" {
+			log.Default().Printf("Tracker %q warns: %s", announceUrl, response.Warning)
+		}
+		if response.TrackerId != "" {
+			t.setTrackerId(announceUrl, response.TrackerId)
+		}
+		return response, nil
+	})
+	if err != nil {
+		log.Default().Printf("Failed to announce %q event to trackers: %v", event, err)
+		return announceRetryInterval, false
+	}
+
+	if event != tracker.EventStopped {
+		t.AddPeers(response.Peers)
+	}
+
+	interval := time.Duration(response.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	// trackers refuse announces coming more often than min interval
+	minInterval := time.Duration(response.MinInterval) * time.Second
+	return max(interval, minInterval), true
+}
+
+// tracker id a tracker handed out in an earlier announce, empty if none
+func (t *Torrent) trackerId(announceUrl string) string {
+	t.trackerIdsMu.Lock()
+	defer t.trackerIdsMu.Unlock()
+	return t.trackerIds[announceUrl]
+}
+
+func (t *Torrent) setTrackerId(announceUrl, trackerId string) {
+	t.trackerIdsMu.Lock()
+	defer t.trackerIdsMu.Unlock()
+	if t.trackerIds == nil {
+		t.trackerIds = map[string]string{}
+	}
+	t.trackerIds[announceUrl] = trackerId
+}
+
+// announcer of a tracker url, created on first use
+func (t *Torrent) announcer(announceUrl string) (tracker.Announcer, error) {
+	t.announcersMu.Lock()
+	defer t.announcersMu.Unlock()
+	if announcer, ok := t.announcers[announceUrl]; ok {
+		return announcer, nil
+	}
+
+	announcer, err := t.NewAnnouncer(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	if t.announcers == nil {
+		t.announcers = map[string]tracker.Announcer{}
+	}
+	t.announcers[announceUrl] = announcer
+	return announcer, nil
+}
+
+func (t *Torrent) closeAnnouncers() {
+	t.announcersMu.Lock()
+	defer t.announcersMu.Unlock()
+	for announceUrl, announcer := range t.announcers {
+		err := announcer.Close()
+		if err != nil {
+			log.Default().Printf("Failed to close tracker %q: %v", announceUrl, err)
+		}
+	}
+	t.announcers = nil
+}
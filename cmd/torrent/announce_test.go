@@ -0,0 +1,182 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/dht"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker/trackertest"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// http tracker which records every announce and always hands out the same peer
+type recordingTracker struct {
+	mu        sync.Mutex
+	announces []url.Values
+}
+
+func (r *recordingTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.announces = append(r.announces, req.URL.Query())
+	r.mu.Unlock()
+	w.Write([]byte("d8:intervali1800e12:min intervali60e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"))
+}
+
+func (r *recordingTracker) get() []url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]url.Values(nil), r.announces...)
+}
+
+func newSessionTorrent(t *testing.T, announce string) *Torrent {
+	peer := types.Peer{ID: "aaaaaaaaaaaaaaaaaaaa", IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	torrent := New(peer, &torrent_file.TorrentFile{
+		Announce:    announce,
+		Length:      120,
+		PieceLength: 20,
+	})
+	return torrent
+}
+
+func TestTrackerSession(t *testing.T) {
+	recorder := &recordingTracker{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	torrent := newSessionTorrent(t, server.URL+"/announce")
+	torrent.sessionDone = make(chan struct{})
+	go torrent.runTrackerSession()
+
+	require.Eventually(t, func() bool { return len(recorder.get()) == 1 }, time.Second, 5*time.Millisecond)
+	// peer from the tracker is waiting for the download to pick it up
+	peers := torrent.takePendingPeers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, "10.0.0.1", peers[0].IP.String())
+
+	torrent.downloaded.Add(120)
+	torrent.left.Add(-120)
+	torrent.markCompleted()
+	require.Eventually(t, func() bool { return len(recorder.get()) == 2 }, time.Second, 5*time.Millisecond)
+
+	torrent.Stop()
+	announces := recorder.get()
+	require.Len(t, announces, 3)
+
+	assert.Equal(t, "started", announces[0].Get("event"))
+	assert.Equal(t, "120", announces[0].Get("left"))
+	assert.Equal(t, "0", announces[0].Get("downloaded"))
+
+	assert.Equal(t, "completed", announces[1].Get("event"))
+	assert.Equal(t, "0", announces[1].Get("left"))
+	assert.Equal(t, "120", announces[1].Get("downloaded"))
+
+	assert.Equal(t, "stopped", announces[2].Get("event"))
+	// same key is sent with every announce of a torrent
+	assert.NotEmpty(t, announces[0].Get("key"))
+	assert.Equal(t, announces[0].Get("key"), announces[2].Get("key"))
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	recorder := &recordingTracker{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	torrent := newSessionTorrent(t, server.URL+"/announce")
+	wait, ok := torrent.announce(tracker.EventNone)
+	require.True(t, ok)
+	assert.Equal(t, 1800*time.Second, wait)
+
+	t.Run("failed announce is retried", func(t *testing.T) {
+		torrent := newSessionTorrent(t, "http://127.0.0.1:1/announce")
+		wait, ok := torrent.announce(tracker.EventNone)
+		assert.False(t, ok)
+		assert.Equal(t, announceRetryInterval, wait)
+	})
+}
+
+func TestAddPeersSkipsKnownPeers(t *testing.T) {
+	torrent := newSessionTorrent(t, "")
+	peer := &types.Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	torrent.AddPeers([]*types.Peer{peer})
+	torrent.AddPeers([]*types.Peer{{IP: net.ParseIP("10.0.0.1"), Port: 6881}})
+
+	assert.Len(t, torrent.takePendingPeers(), 1)
+	assert.Empty(t, torrent.takePendingPeers())
+}
+
+func TestAnnounceWithScriptedTracker(t *testing.T) {
+	fake := trackertest.NewFake().
+		Fail(errors.New("tracker is down")).
+		Respond(&tracker.TrackerResponse{Interval: 600}).
+		Respond(&tracker.TrackerResponse{Interval: 900, MinInterval: 1200, TrackerId: "abc", Peers: []*types.Peer{
+			{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		}})
+	torrent := newSessionTorrent(t, "http://tracker.local/announce")
+	torrent.NewAnnouncer = trackertest.Trackers{"http://tracker.local/announce": fake}.NewAnnouncer
+
+	wait, ok := torrent.announce(tracker.EventStarted)
+	assert.False(t, ok)
+	assert.Equal(t, announceRetryInterval, wait)
+
+	// empty peer list
+	wait, ok = torrent.announce(tracker.EventStarted)
+	assert.True(t, ok)
+	assert.Equal(t, 600*time.Second, wait)
+	assert.Empty(t, torrent.takePendingPeers())
+
+	// interval changed, min interval wins when it is bigger
+	wait, ok = torrent.announce(tracker.EventNone)
+	assert.True(t, ok)
+	assert.Equal(t, 1200*time.Second, wait)
+	assert.Len(t, torrent.takePendingPeers(), 1)
+
+	fake.Default = &tracker.TrackerResponse{Interval: 1800}
+	torrent.announce(tracker.EventNone)
+	requests := fake.Requests()
+	require.Len(t, requests, 4)
+	assert.Equal(t, tracker.EventStarted, requests[0].Event)
+	assert.Equal(t, tracker.EventStarted, requests[1].Event)
+	assert.Equal(t, "", requests[2].TrackerId)
+	assert.Equal(t, "abc", requests[3].TrackerId)
+
+	torrent.Stop()
+	assert.True(t, fake.Closed())
+}
+
+func TestDhtSessionFeedsPeers(t *testing.T) {
+	seed, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer seed.Close()
+	node, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{seed.Addr().String()}})
+	require.NoError(t, err)
+	defer node.Close()
+
+	torrent := newSessionTorrent(t, "")
+	torrent.InfoHash = [20]byte{1, 2, 3}
+	_, err = seed.Announce(torrent.InfoHash, 6882)
+	require.Error(t, err, "seed knows no other node to announce to")
+	require.NoError(t, node.Bootstrap())
+	_, err = seed.Announce(torrent.InfoHash, 6882)
+	require.NoError(t, err)
+
+	torrent.DHT = node
+	go torrent.runDhtSession()
+	defer torrent.Stop()
+
+	require.Eventually(t, func() bool {
+		torrent.peersMu.Lock()
+		defer torrent.peersMu.Unlock()
+		return len(torrent.remotePeers) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 6882, torrent.remotePeers[0].Port)
+}
@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+)
+
+const (
+	// peers unchoked for their rate, one more peer gets the optimistic unchoke
+	DefaultUploadSlots = 4
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	// peers connected for less than newPeerAge are newPeerWeight times as likely to get the optimistic unchoke
+	// they have no pieces to trade yet
+	newPeerAge    = time.Minute
+	newPeerWeight = 3
+)
+
+// tit-for-tat choker, the peers giving us the most are given the most
+type choker struct {
+	mu             sync.Mutex
+	lastRound      time.Time
+	lastOptimistic time.Time
+	optimistic     *connection
+	random         func(n int) int
+}
+
+func newChoker() *choker {
+	return &choker{random: rand.Intn}
+}
+
+func (t *Torrent) uploadSlots() int {
+	if t.UploadSlots > 0 {
+		return t.UploadSlots
+	}
+	return DefaultUploadSlots
+}
+
+// rechoke every chokeInterval until the torrent is stopped
+func (t *Torrent) runChoker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			t.rechoke(now)
+		}
+	}
+}
+
+// one choking round, messages are only sent to peers whose state changes
+func (t *Torrent) rechoke(now time.Time) {
+	conns := t.allConnections()
+	t.choker.mu.Lock()
+	unchoke := t.choker.choose(conns, t.uploadSlots(), t.complete(), now)
+	t.choker.mu.Unlock()
+
+	for _, conn := range conns {
+		if unchoke[conn] {
+			t.unchoke(conn)
+		} else {
+			t.choke(conn)
+		}
+	}
+}
+
+// interested peers are unchoked by the best download rate they give us, or upload rate we reach to them while seeding
+// the optimistic unchoke moves to another interested peer every optimisticInterval
+func (ch *choker) choose(conns []*connection, slots int, seeding bool, now time.Time) map[*connection]bool {
+	elapsed := chokeInterval.Seconds()
+	if !ch.lastRound.IsZero() && now.After(ch.lastRound) {
+		elapsed = now.Sub(ch.lastRound).Seconds()
+	}
+	ch.lastRound = now
+
+	interested := []*connection{}
+	for _, conn := range conns {
+		uploaded, downloaded := conn.uploaded.Load(), conn.downloaded.Load()
+		conn.uploadRate = float64(uploaded-conn.lastUploaded) / elapsed
+		conn.downloadRate = float64(downloaded-conn.lastDownloaded) / elapsed
+		conn.lastUploaded, conn.lastDownloaded = uploaded, downloaded
+
+		if conn.peerInterested.Load() {
+			interested = append(interested, conn)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		if seeding {
+			return interested[i].uploadRate > interested[j].uploadRate
+		}
+		return interested[i].downloadRate > interested[j].downloadRate
+	})
+
+	unchoke := map[*connection]bool{}
+	regular := min(slots, len(interested))
+	for _, conn := range interested[:regular] {
+		unchoke[conn] = true
+	}
+
+	if ch.optimistic == nil || !ch.optimistic.peerInterested.Load() || !contains(conns, ch.optimistic) ||
+		now.Sub(ch.lastOptimistic) >= optimisticInterval {
+		ch.optimistic = ch.pickOptimistic(interested[regular:], now)
+		ch.lastOptimistic = now
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	return unchoke
+}
+
+// random candidate, new peers weighted higher
+func (ch *choker) pickOptimistic(candidates []*connection, now time.Time) *connection {
+	weight := func(conn *connection) int {
+		if now.Sub(conn.connectedAt) < newPeerAge {
+			return newPeerWeight
+		}
+		return 1
+	}
+
+	total := 0
+	for _, conn := range candidates {
+		total += weight(conn)
+	}
+	if total == 0 {
+		return nil
+	}
+	n := ch.random(total)
+	for _, conn := range candidates {
+		n -= weight(conn)
+		if n < 0 {
+			return conn
+		}
+	}
+	return nil
+}
+
+func contains(conns []*connection, conn *connection) bool {
+	for _, c := range conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// peers becoming interested take a free upload slot without waiting for the next round
+func (t *Torrent) setInterested(c *client.Client, interested bool) error {
+	conn := t.connection(c.Peer)
+	if conn == nil {
+		return nil
+	}
+	conn.peerInterested.Store(interested)
+	if !interested || !conn.amChoking.Load() {
+		return nil
+	}
+
+	unchoked := 0
+	for _, other := range t.allConnections() {
+		if !other.amChoking.Load() && other.peerInterested.Load() {
+			unchoked++
+		}
+	}
+	if unchoked >= t.uploadSlots() {
+		return nil
+	}
+	return t.unchoke(conn)
+}
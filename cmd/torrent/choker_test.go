@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+)
+
+// interested peer which connected long ago and gave us downloaded bytes, took uploaded bytes from us
+func chokerConnection(downloaded, uploaded int64, now time.Time) *connection {
+	conn := &connection{connectedAt: now.Add(-time.Hour)}
+	conn.amChoking.Store(true)
+	conn.peerInterested.Store(true)
+	conn.downloaded.Store(downloaded)
+	conn.uploaded.Store(uploaded)
+	return conn
+}
+
+func unchoked(result map[*connection]bool, conns []*connection) []int {
+	indexes := []int{}
+	for i, conn := range conns {
+		if result[conn] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func TestChokerUnchokesFastestPeers(t *testing.T) {
+	now := time.Now()
+	conns := []*connection{
+		chokerConnection(100, 0, now),
+		chokerConnection(500, 0, now),
+		chokerConnection(300, 0, now),
+		chokerConnection(900, 0, now),
+		chokerConnection(0, 0, now),
+	}
+	// not interested, it's rate doesn't matter
+	conns[4].peerInterested.Store(false)
+	conns[4].downloaded.Store(10000)
+
+	ch := newChoker()
+	ch.random = func(n int) int { return 0 }
+	result := ch.choose(conns, 2, false, now)
+	assert.ElementsMatch(t, []int{1, 2, 3}, unchoked(result, conns), "two fastest peers and the optimistic unchoke")
+	assert.Equal(t, conns[2], ch.optimistic)
+	assert.Equal(t, 90.0, conns[3].downloadRate)
+}
+
+func TestChokerRanksByUploadRateWhileSeeding(t *testing.T) {
+	now := time.Now()
+	conns := []*connection{
+		chokerConnection(900, 100, now),
+		chokerConnection(0, 700, now),
+		chokerConnection(0, 300, now),
+	}
+
+	ch := newChoker()
+	ch.random = func(n int) int { return n - 1 }
+	result := ch.choose(conns, 1, true, now)
+	assert.True(t, result[conns[1]])
+	assert.Len(t, result, 2)
+}
+
+func TestOptimisticUnchokeRotates(t *testing.T) {
+	now := time.Now()
+	conns := []*connection{
+		chokerConnection(0, 0, now),
+		chokerConnection(0, 0, now),
+		chokerConnection(0, 0, now),
+	}
+	ch := newChoker()
+	picks := 0
+	ch.random = func(n int) int {
+		picks++
+		return picks % n
+	}
+
+	ch.choose(conns, 0, false, now)
+	first := ch.optimistic
+	require.NotNil(t, first)
+
+	ch.choose(conns, 0, false, now.Add(chokeInterval))
+	assert.Same(t, first, ch.optimistic, "optimistic unchoke is kept between rounds")
+
+	ch.choose(conns, 0, false, now.Add(optimisticInterval))
+	assert.NotSame(t, first, ch.optimistic)
+
+	// a peer losing interest loses the optimistic unchoke right away
+	second := ch.optimistic
+	second.peerInterested.Store(false)
+	result := ch.choose(conns, 0, false, now.Add(optimisticInterval+chokeInterval))
+	assert.NotSame(t, second, ch.optimistic)
+	assert.False(t, result[second])
+}
+
+func TestNewPeersWeightedHigher(t *testing.T) {
+	now := time.Now()
+	old := chokerConnection(0, 0, now)
+	recent := chokerConnection(0, 0, now)
+	recent.connectedAt = now.Add(-time.Second)
+
+	ch := newChoker()
+	totals := []int{}
+	ch.random = func(n int) int {
+		totals = append(totals, n)
+		return 1
+	}
+	assert.Same(t, recent, ch.pickOptimistic([]*connection{old, recent}, now))
+	assert.Equal(t, []int{1 + newPeerWeight}, totals)
+	assert.Nil(t, ch.pickOptimistic(nil, now))
+}
+
+func TestInterestedPeerTakesFreeSlot(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	torrent.UploadSlots = 1
+
+	first, firstRemote := pexClient(t, "10.0.0.1", 6881)
+	torrent.addConnection(first)
+	second, _ := pexClient(t, "10.0.0.2", 6881)
+	secondConn := torrent.addConnection(second)
+
+	go torrent.setInterested(first, true)
+	assert.Equal(t, message.MsgUnChoke, readMessage(t, firstRemote).Id)
+
+	require.NoError(t, torrent.setInterested(second, true))
+	assert.True(t, secondConn.amChoking.Load(), "every slot is taken")
+	assert.True(t, secondConn.peerInterested.Load())
+}
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/pex"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// connection to a remote peer, the peers we are connected to are exchanged with the other ones
+// pex state is only touched by the goroutine serving the connection
+type connection struct {
+	client   *client.Client
+	peer     pex.Peer
+	pex      *pex.State
+	incoming bool // peer connected to us, we don't know the port it listens on
+
+	amChoking      atomic.Bool  // we don't answer the requests of the peer
+	allowedFast    map[int]bool // pieces the peer may request while choked, never changed after addConnection
+	peerInterested atomic.Bool  // peer wants pieces we have
+	uploads        *uploadQueue
+	haves          *haveQueue
+	uploaded       atomic.Int64 // bytes sent to the peer
+	downloaded     atomic.Int64 // bytes of blocks received from the peer
+	connectedAt    time.Time
+
+	// rates of the last choking round, only touched by the choker
+	lastUploaded   int64
+	lastDownloaded int64
+	uploadRate     float64
+	downloadRate   float64
+}
+
+func (t *Torrent) addConnection(c *client.Client) *connection {
+	conn := &connection{
+		client:      c,
+		peer:        pex.Peer{Peer: c.Peer},
+		pex:         pex.NewState(),
+		incoming:    c.Incoming,
+		uploads:     newUploadQueue(),
+		haves:       newHaveQueue(),
+		connectedAt: time.Now(),
+		allowedFast: t.allowedFastSet(c),
+	}
+	conn.amChoking.Store(true)
+	// we reached the peer, so it accepts connections
+	if !c.Incoming {
+		conn.peer.Flags |= pex.FlagConnectable
+	}
+	if t.hasAllPieces(c) {
+		conn.peer.Flags |= pex.FlagSeed
+	}
+
+	t.connectionsMu.Lock()
+	defer t.connectionsMu.Unlock()
+	t.connections[common.PeerAdress(c.Peer)] = conn
+	return conn
+}
+
+func (t *Torrent) removeConnection(peer types.Peer) {
+	t.connectionsMu.Lock()
+	defer t.connectionsMu.Unlock()
+	delete(t.connections, common.PeerAdress(peer))
+}
+
+// connection to peer, nil when we are not connected to it
+func (t *Torrent) connection(peer types.Peer) *connection {
+	t.connectionsMu.Lock()
+	defer t.connectionsMu.Unlock()
+	return t.connections[common.PeerAdress(peer)]
+}
+
+func (t *Torrent) allConnections() []*connection {
+	t.connectionsMu.Lock()
+	defer t.connectionsMu.Unlock()
+
+	conns := []*connection{}
+	for _, conn := range t.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// peers we are connected to and could connect to again, except the given one
+func (t *Torrent) connectedPeers(except types.Peer) []pex.Peer {
+	t.connectionsMu.Lock()
+	defer t.connectionsMu.Unlock()
+
+	peers := []pex.Peer{}
+	for address, conn := range t.connections {
+		if address != common.PeerAdress(except) && !conn.incoming {
+			peers = append(peers, conn.peer)
+		}
+	}
+	return peers
+}
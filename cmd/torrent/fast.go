@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// pieces a peer may request from us while we choke it
+const allowedFastCount = 10
+
+// allowed fast set of a peer speaking the fast extension, nil for the others
+func (t *Torrent) allowedFastSet(c *client.Client) map[int]bool {
+	if !c.SupportsFast {
+		return nil
+	}
+	set := map[int]bool{}
+	for _, index := range message.AllowedFastSet(allowedFastCount, len(t.PieceHashes), c.Peer.IP, t.InfoHash) {
+		set[index] = true
+	}
+	return set
+}
+
+// peers speaking the fast extension get have all or have none when they fit
+func (t *Torrent) sendBitField(c *client.Client) error {
+	bitField := t.BitField()
+	if c.SupportsFast {
+		pieces := 0
+		for index := range t.PieceHashes {
+			if bitField.HasPiece(index) {
+				pieces++
+			}
+		}
+		switch pieces {
+		case len(t.PieceHashes):
+			return c.SendHaveAll()
+		case 0:
+			return c.SendHaveNone()
+		}
+	}
+	return c.SendBitField(bitField)
+}
+
+// the pieces of the allowed fast set we have, so a new peer can download before we unchoke it
+func (t *Torrent) sendAllowedFast(conn *connection) error {
+	for index := range conn.allowedFast {
+		if !t.hasPiece(index) {
+			continue
+		}
+		err := conn.client.SendAllowedFast(index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a have none bitfield is empty, it has to fit every piece for the have messages which follow
+func (t *Torrent) sizeBitField(c *client.Client) {
+	size := (len(t.PieceHashes) + 7) / 8
+	if !c.HaveAll && len(c.BitField) < size {
+		c.BitField = append(c.BitField, make(message.BitField, size-len(c.BitField))...)
+	}
+}
+
+// tell a peer speaking the fast extension we won't answer it's request, the others notice on their own
+func (t *Torrent) reject(c *client.Client, request message.RequestMessage) error {
+	if !c.SupportsFast {
+		return nil
+	}
+	return c.SendReject(request.PieceIndex, request.Begin, request.Length)
+}
+
+func (t *Torrent) handleAllowedFast(c *client.Client, msg *message.Message) error {
+	if !c.SupportsFast {
+		return fmt.Errorf("peer sent %s without the fast extension", message.FindMessagebyId(msg.Id))
+	}
+	index, err := message.ParsePieceIndex(msg)
+	if err != nil {
+		return err
+	}
+	// allowed fast for pieces the torrent doesn't have are ignored
+	if index >= len(t.PieceHashes) {
+		return nil
+	}
+	if c.AllowedFast == nil {
+		c.AllowedFast = map[int]bool{}
+	}
+	c.AllowedFast[index] = true
+	return nil
+}
+
+// a rejected request leaves a hole in the piece we download, it is given up and downloaded again
+func (t *Torrent) handleReject(c *client.Client, msg *message.Message, state *types.DownloadingState) error {
+	if !c.SupportsFast {
+		return fmt.Errorf("peer sent %s without the fast extension", message.FindMessagebyId(msg.Id))
+	}
+	_, err := message.ParseRequestMessage(msg)
+	if err != nil {
+		return err
+	}
+	state.Rejected = true
+	state.Backlog--
+	return nil
+}
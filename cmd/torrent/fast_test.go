@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// connection of a peer speaking the fast extension which may only request piece 0 while choked
+func fastConnection(t *testing.T, torrent *Torrent) (*connection, net.Conn) {
+	c, remote := pexClient(t, "10.0.0.1", 6881)
+	c.SupportsFast = true
+	conn := torrent.addConnection(c)
+	conn.allowedFast = map[int]bool{0: true}
+	return conn, remote
+}
+
+// run f while the remote end reads what it writes
+func inBackground(f func() error) <-chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- f() }()
+	return errs
+}
+
+func readReject(t *testing.T, remote net.Conn) message.RequestMessage {
+	msg := readMessage(t, remote)
+	require.Equal(t, message.MsgRejectRequest, msg.Id)
+	request, err := message.ParseRequestMessage(msg)
+	require.NoError(t, err)
+	return request
+}
+
+func TestRequestsWhileChoked(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	conn, remote := fastConnection(t, torrent)
+
+	errs := inBackground(func() error { return torrent.handleRequest(conn.client, message.FormatRequestMessage(1, 0, 4)) })
+	assert.Equal(t, message.RequestMessage{PieceIndex: 1, Begin: 0, Length: 4}, readReject(t, remote))
+	require.NoError(t, <-errs)
+
+	require.NoError(t, torrent.handleRequest(conn.client, message.FormatRequestMessage(0, 0, 4)))
+	assert.Equal(t, 1, conn.uploads.len(), "allowed fast requests are served while choked")
+}
+
+func TestRejectRequestForMissingPiece(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	conn, remote := fastConnection(t, torrent)
+	torrent.have = make(message.BitField, 1)
+
+	errs := inBackground(func() error { return torrent.handleRequest(conn.client, message.FormatRequestMessage(0, 0, 4)) })
+	assert.Equal(t, 0, readReject(t, remote).PieceIndex)
+	require.NoError(t, <-errs)
+	assert.Zero(t, conn.uploads.len())
+}
+
+func TestChokeRejectsQueuedRequests(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	conn, remote := fastConnection(t, torrent)
+	conn.amChoking.Store(false)
+	require.NoError(t, torrent.handleRequest(conn.client, message.FormatRequestMessage(0, 0, 4)))
+	require.NoError(t, torrent.handleRequest(conn.client, message.FormatRequestMessage(1, 0, 4)))
+
+	errs := inBackground(func() error { return torrent.choke(conn) })
+	assert.Equal(t, message.MsgChoke, readMessage(t, remote).Id)
+	assert.Equal(t, 1, readReject(t, remote).PieceIndex)
+	require.NoError(t, <-errs)
+
+	request, ok := conn.uploads.pop()
+	require.True(t, ok, "allowed fast request is kept")
+	assert.Equal(t, 0, request.PieceIndex)
+}
+
+func TestCancelIsAnsweredWithReject(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	conn, remote := fastConnection(t, torrent)
+	conn.amChoking.Store(false)
+	require.NoError(t, torrent.handleRequest(conn.client, message.FormatRequestMessage(1, 0, 4)))
+
+	errs := inBackground(func() error { return torrent.handleCancel(conn.client, message.FormatCancelMessage(1, 0, 4)) })
+	assert.Equal(t, message.RequestMessage{PieceIndex: 1, Begin: 0, Length: 4}, readReject(t, remote))
+	require.NoError(t, <-errs)
+	assert.Zero(t, conn.uploads.len())
+}
+
+func TestMessagesOfTheFastExtensionFromPeer(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	c := &client.Client{SupportsFast: true}
+
+	require.NoError(t, torrent.handleAllowedFast(c, message.FormatAllowedFastMessage(2)))
+	require.NoError(t, torrent.handleAllowedFast(c, message.FormatAllowedFastMessage(99)))
+	assert.Equal(t, map[int]bool{2: true}, c.AllowedFast)
+
+	state := types.DownloadingState{}
+	require.NoError(t, torrent.handleReject(c, message.FormatRejectMessage(2, 0, 4), &state))
+	assert.True(t, state.Rejected)
+
+	withoutFast := &client.Client{}
+	assert.Error(t, torrent.handleAllowedFast(withoutFast, message.FormatAllowedFastMessage(2)))
+	assert.Error(t, torrent.handleReject(withoutFast, message.FormatRejectMessage(2, 0, 4), &state))
+}
+
+func TestBitFieldOfTheFastExtension(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	c, remote := pexClient(t, "10.0.0.1", 6881)
+
+	errs := inBackground(func() error { return torrent.sendBitField(c) })
+	assert.Equal(t, message.MsgBitfield, readMessage(t, remote).Id, "peers without the fast extension get a bitfield")
+	require.NoError(t, <-errs)
+
+	c.SupportsFast = true
+	errs = inBackground(func() error { return torrent.sendBitField(c) })
+	assert.Equal(t, message.MsgHaveAll, readMessage(t, remote).Id)
+	require.NoError(t, <-errs)
+
+	torrent.have = make(message.BitField, 1)
+	errs = inBackground(func() error { return torrent.sendBitField(c) })
+	assert.Equal(t, message.MsgHaveNone, readMessage(t, remote).Id)
+	require.NoError(t, <-errs)
+
+	// have messages after have none fit into the bitfield
+	c.BitField = message.BitField{}
+	torrent.sizeBitField(c)
+	c.BitField.SetPiece(2)
+	assert.True(t, c.HasPiece(2))
+}
+
+func TestAllowedFastOnlyForPiecesWeHave(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	conn, remote := fastConnection(t, torrent)
+	conn.allowedFast = map[int]bool{0: true, 1: true}
+	torrent.have = message.BitField{0b01000000}
+
+	errs := inBackground(func() error { return torrent.sendAllowedFast(conn) })
+	msg := readMessage(t, remote)
+	require.Equal(t, message.MsgAllowedFast, msg.Id)
+	index, err := message.ParsePieceIndex(msg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, index)
+	require.NoError(t, <-errs)
+}
@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/listener"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// listener on loopback which hands connections to torrent, returns it's port
+func startTorrentListener(t *testing.T, torrent *Torrent) int {
+	peerListener, err := listener.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { peerListener.Close() })
+	go peerListener.Serve()
+	peerListener.Add(torrent.InfoHash, torrent)
+	return peerListener.Port()
+}
+
+// seeder of a torrent with one piece which connects to us, it answers requests with the block asked for
+func connectSeeder(t *testing.T, addr string, infoHash [20]byte, data []byte) {
+	con, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { con.Close() })
+	con.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var peerId [20]byte
+	copy(peerId[:], "incoming-seeder-0000")
+	_, err = con.Write(client.NewHandShake(infoHash, peerId).Serialize())
+	require.NoError(t, err)
+	_, err = client.ReadHandShake(con)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			msg, err := message.Read(con)
+			if err != nil {
+				return
+			}
+			switch msg.Id {
+			// both sides speak the fast extension, so we start with have none
+			case message.MsgBitfield, message.MsgHaveNone:
+				con.Write((&message.Message{Id: message.MsgBitfield, Payload: []byte{0x80}}).Serialize())
+			case message.MsgInterested:
+				con.Write((&message.Message{Id: message.MsgUnChoke}).Serialize())
+			case message.MsgRequest:
+				request, err := message.ParseRequestMessage(msg)
+				if err != nil || request.Begin+request.Length > len(data) {
+					return
+				}
+				block := data[request.Begin : request.Begin+request.Length]
+				con.Write(message.FormatPieceMessage(request.PieceIndex, request.Begin, block).Serialize())
+			}
+		}
+	}()
+}
+
+func TestDownloadFromIncomingConnection(t *testing.T) {
+	data := []byte("a piece which comes to us")
+	peer := types.Peer{ID: "local-peer-012345678", IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	torrent := New(peer, &torrent_file.TorrentFile{
+		InfoHash:    [20]byte{7},
+		Name:        "incoming.txt",
+		Length:      len(data),
+		PieceLength: len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		Files:       []torrent_file.File{{Path: []string{"incoming.txt"}, Length: len(data)}},
+	})
+	torrent.OutputDir = t.TempDir()
+
+	port := startTorrentListener(t, torrent)
+
+	done := make(chan error, 1)
+	go func() { done <- torrent.Download() }()
+	require.Eventually(t, func() bool {
+		workerChan, _ := torrent.queues()
+		return workerChan != nil
+	}, time.Second, 5*time.Millisecond)
+
+	connectSeeder(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), torrent.InfoHash, data)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	written, err := os.ReadFile(filepath.Join(torrent.OutputDir, "incoming.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, written)
+	assert.Equal(t, message.BitField{0x80}, torrent.BitField())
+}
+
+func TestIncomingConnectionBeforeDownload(t *testing.T) {
+	torrent := newSessionTorrent(t, "")
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	assert.Error(t, torrent.ServeIncoming(c))
+}
@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/pex"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// peer exchange is off for private torrents, their peers must only come from their trackers
+func (t *Torrent) pexEnabled() bool {
+	return !t.Private
+}
+
+func (t *Torrent) hasAllPieces(c *client.Client) bool {
+	for index := range t.PieceHashes {
+		if !c.HasPiece(index) {
+			return false
+		}
+	}
+	return len(t.PieceHashes) > 0
+}
+
+// tell the remote peer about peers connected or dropped since the last message, at most once every pex.Interval
+func (t *Torrent) sendPex(c *client.Client, conn *connection) error {
+	if !t.pexEnabled() || conn == nil {
+		return nil
+	}
+	if _, ok := c.Extensions[pex.ExtensionName]; !ok {
+		return nil
+	}
+
+	msg := conn.pex.Next(t.connectedPeers(c.Peer), time.Now())
+	if msg == nil {
+		return nil
+	}
+	return c.SendExtended(pex.ExtensionName, msg.Serialize())
+}
+
+// peers added by the remote peer go to the peer pool, dropped ones are left alone as they may still be reachable
+func (t *Torrent) handlePex(c *client.Client, payload []byte) error {
+	if !t.pexEnabled() {
+		return nil
+	}
+	if conn := t.connection(c.Peer); conn != nil && !conn.pex.Receive(time.Now()) {
+		return nil
+	}
+
+	msg, err := pex.ParseMessage(payload)
+	if err != nil {
+		return fmt.Errorf("invalid %s message: %w", pex.ExtensionName, err)
+	}
+	added, err := msg.AddedPeers()
+	if err != nil {
+		return fmt.Errorf("invalid %s message: %w", pex.ExtensionName, err)
+	}
+
+	peers := []*types.Peer{}
+	for _, peer := range added[:min(len(added), pex.MaxPeers)] {
+		if peer.Port == 0 || common.PeerAdress(peer.Peer) == common.PeerAdress(*t.currentPeer) {
+			continue
+		}
+		learned := peer.Peer
+		peers = append(peers, &learned)
+	}
+	if len(peers) > 0 {
+		t.AddPeers(peers)
+	}
+	return nil
+}
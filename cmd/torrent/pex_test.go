@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/pex"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// client of a remote peer which wants ut_pex messages with id 5, what we send to it can be read from the returned end
+func pexClient(t *testing.T, ip string, port int) (*client.Client, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	return &client.Client{
+		Con:        local,
+		Peer:       types.Peer{IP: net.ParseIP(ip), Port: port},
+		Extensions: map[string]uint8{pex.ExtensionName: 5},
+	}, remote
+}
+
+func pexPayload(peers ...pex.Peer) *message.Message {
+	return message.FormatExtendedMessage(pex.LocalId, pex.NewMessage(peers, nil).Serialize())
+}
+
+func TestPexFeedsPeerPool(t *testing.T) {
+	torrent := newSessionTorrent(t, "")
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	assert.Contains(t, torrent.extendedHandshake(c).M, pex.ExtensionName)
+
+	learned := pex.Peer{Peer: types.Peer{IP: net.ParseIP("10.0.0.2"), Port: 6882}}
+	ourselves := pex.Peer{Peer: *torrent.currentPeer}
+	require.NoError(t, torrent.handleExtendedMessage(c, pexPayload(learned, ourselves)))
+
+	peers := torrent.takePendingPeers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, "10.0.0.2", peers[0].IP.String())
+}
+
+func TestPexDisabledForPrivateTorrents(t *testing.T) {
+	torrent := newSessionTorrent(t, "")
+	torrent.Private = true
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	assert.NotContains(t, torrent.extendedHandshake(c).M, pex.ExtensionName)
+
+	learned := pex.Peer{Peer: types.Peer{IP: net.ParseIP("10.0.0.2"), Port: 6882}}
+	require.NoError(t, torrent.handleExtendedMessage(c, pexPayload(learned)))
+	assert.Empty(t, torrent.takePendingPeers())
+
+	conn := torrent.addConnection(c)
+	assert.NoError(t, torrent.sendPex(c, conn), "nothing is sent, a write would block on the pipe")
+}
+
+func TestSendPex(t *testing.T) {
+	torrent := newSessionTorrent(t, "")
+	c, remote := pexClient(t, "10.0.0.1", 6881)
+	other, _ := pexClient(t, "2001:db8::1", 6882)
+	conn := torrent.addConnection(c)
+	torrent.addConnection(other)
+
+	received := make(chan *message.Message, 1)
+	go func() {
+		msg, err := message.Read(remote)
+		if err == nil {
+			received <- msg
+		}
+	}()
+	require.NoError(t, torrent.sendPex(c, conn))
+
+	id, payload, err := message.ParseExtendedMessage(<-received)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(5), id, "remote peer's id is used")
+	msg, err := pex.ParseMessage(payload)
+	require.NoError(t, err)
+	added, err := msg.AddedPeers()
+	require.NoError(t, err)
+	require.Len(t, added, 1, "remote peer is not told about itself")
+	assert.Equal(t, "2001:db8::1", added[0].IP.String())
+	assert.Equal(t, pex.FlagConnectable, added[0].Flags)
+
+	assert.NoError(t, torrent.sendPex(c, conn), "rate limit keeps it from writing again")
+}
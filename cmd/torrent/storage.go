@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+)
+
+// storage maps pieces of a torrent onto the files on disk
+type storage struct {
+	files       []*os.File
+	info        []torrent_file.File
+	pieceLength int
+}
+
+// create (or open) every file of the torrent under root directory
+func openStorage(root string, files []torrent_file.File, pieceLength int) (*storage, error) {
+	s := &storage{
+		info:        files,
+		pieceLength: pieceLength,
+	}
+
+	for _, file := range files {
+		path, err := safeJoin(root, file.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+
+		err = f.Truncate(int64(file.Length))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// paths come from the torrent file, so make sure they can't escape the root directory
+func safeJoin(root string, path []string) (string, error) {
+	for _, part := range path {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+			return "", fmt.Errorf("invalid file path %q in torrent", strings.Join(path, "/"))
+		}
+	}
+	return filepath.Join(append([]string{root}, path...)...), nil
+}
+
+// write a downloaded piece to every file it spans
+func (s *storage) WritePiece(index int, data []byte) error {
+	for _, span := range torrent_file.PieceSpans(s.info, index, s.pieceLength) {
+		if span.PieceOffset+span.Length > len(data) {
+			return fmt.Errorf("piece %d is shorter than expected", index)
+		}
+
+		chunk := data[span.PieceOffset : span.PieceOffset+span.Length]
+		_, err := s.files[span.FileIndex].WriteAt(chunk, int64(span.FileOffset))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read length bytes at offset begin of a piece, from every file the block spans
+func (s *storage) ReadBlock(index, begin, length int) ([]byte, error) {
+	block := make([]byte, length)
+	end := begin + length
+	read := 0
+	for _, span := range torrent_file.PieceSpans(s.info, index, s.pieceLength) {
+		// part of the span which lies inside the block
+		from := max(begin, span.PieceOffset)
+		to := min(end, span.PieceOffset+span.Length)
+		if from >= to {
+			continue
+		}
+
+		fileOffset := span.FileOffset + from - span.PieceOffset
+		_, err := s.files[span.FileIndex].ReadAt(block[from-begin:to-begin], int64(fileOffset))
+		if err != nil {
+			return nil, err
+		}
+		read += to - from
+	}
+	if read != length {
+		return nil, fmt.Errorf("block %d+%d is outside of piece %d", begin, length, index)
+	}
+	return block, nil
+}
+
+func (s *storage) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
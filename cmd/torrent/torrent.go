@@ -4,72 +4,204 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"log"
-	"net/url"
-	"strconv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/umair-hassan2/torrent-client/cmd/client"
 	"github.com/umair-hassan2/torrent-client/cmd/common"
+	"github.com/umair-hassan2/torrent-client/cmd/dht"
+	"github.com/umair-hassan2/torrent-client/cmd/lsd"
 	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/metadata"
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/cmd/pex"
 	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
 	"github.com/umair-hassan2/torrent-client/cmd/tracker"
 	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
+// version string sent in the extended handshake
+const p2pClientVersion = "zero-net 0.1"
+
 const (
-	MAX_BLOCK_SIZE                   = 100 * 1024 * 8
+	MAX_BLOCK_SIZE                   = message.MaxBlockLength
+	MAX_BACKLOG                      = 5 // unanswered requests to one peer
 	MAX_ALLOWED_RETRIES              = 5
 	MAX_ALLOWED_DOWNLOAD_CONNECTIONS = 40
 	MAX_ALLOWED_UPLOAD_CONNECTIONS   = 40
 )
 
-var open_download_con int
-var open_upload_con int
+// connections are opened and accepted from many goroutines
+var open_download_con atomic.Int64
+var open_upload_con atomic.Int64
 
 // Torrent represents one torrent file
 // It is responsible to perform every step to download it's specific file
 type Torrent struct {
-	Url         string
+	Trackers    *tracker.Tiers
+	DHT         *dht.Node    // finds peers without trackers, nil when the DHT is not used
+	LSD         *lsd.Service // finds peers on the local network, nil when it is not used
+	Private     bool         // private torrents only get peers from their trackers
 	InfoHash    [20]byte
 	PieceLength int
 	Length      int
 	PieceHashes [][20]byte
+	Name        string
+	Files       []torrent_file.File
+	OutputDir   string         // files are written under this directory
+	InfoBytes   []byte         // raw info dictionary, served to peers joining from a magnet link
+	Seed        bool           // keep uploading after the download finished, until Stop
+	UploadSlots int            // peers unchoked for their rate, DefaultUploadSlots when 0
+	Encryption  mse.Policy     // encryption of the connections we open
+	Dialer      *client.Dialer // opens connections to peers, tcp only when nil
 	currentPeer *types.Peer
-	remotePeers []*types.Peer
+
+	// peer pool, pending peers are the ones the download has not connected to yet
+	peersMu      sync.Mutex
+	remotePeers  []*types.Peer
+	knownPeers   map[string]bool
+	pendingPeers []*types.Peer
+	peerSignal   chan struct{}
+
+	// peers we are connected to by address
+	connectionsMu sync.Mutex
+	connections   map[string]*connection
+
+	// pieces we have verified
+	haveMu sync.Mutex
+	have   message.BitField
+
+	choker     *choker
+	extensions *client.ExtensionRegistry
+
+	// files of the torrent, open from the start of the download until Stop
+	storeMu sync.Mutex
+	store   *storage
+
+	// queues of the running download, connections remote peers open to us use them as well
+	queuesMu   sync.Mutex
+	workerChan chan types.PieceWork
+	resultChan chan types.PieceResult
+
+	// live statistics reported to trackers
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+
+	// creates the announcer of a tracker url, tracker.New unless replaced e.g. by a fake in tests
+	NewAnnouncer func(announceUrl string) (tracker.Announcer, error)
+	announcersMu sync.Mutex
+	announcers   map[string]tracker.Announcer // announcers created so far, closed on Stop
+
+	announceKey   uint32
+	trackerIdsMu  sync.Mutex
+	trackerIds    map[string]string // tracker id of every tracker which gave us one
+	completed     chan struct{}     // closed when the last piece is verified
+	completedOnce sync.Once
+	done          chan struct{} // closed when the torrent is stopped
+	stopOnce      sync.Once
+	sessionDone   chan struct{} // closed when the tracker session exits, nil if it never started
 }
 
 // Torrent is created from a torrent file data
 func New(peer types.Peer, torrentFile *torrent_file.TorrentFile) *Torrent {
-	return &Torrent{
-		Url:         torrentFile.Announce,
-		InfoHash:    torrentFile.InfoHash,
-		PieceLength: torrentFile.PieceLength,
-		Length:      torrentFile.Length,
-		PieceHashes: torrentFile.PieceHashes,
-		currentPeer: &peer,
+	t := &Torrent{
+		Trackers:     tracker.NewTiers(torrentFile.Announce, torrentFile.AnnounceList),
+		InfoHash:     torrentFile.InfoHash,
+		PieceLength:  torrentFile.PieceLength,
+		Length:       torrentFile.Length,
+		PieceHashes:  torrentFile.PieceHashes,
+		Name:         torrentFile.Name,
+		Files:        torrentFile.Files,
+		OutputDir:    ".",
+		InfoBytes:    torrentFile.InfoBytes,
+		Private:      torrentFile.Private,
+		currentPeer:  &peer,
+		NewAnnouncer: tracker.New,
+		knownPeers:   map[string]bool{},
+		peerSignal:   make(chan struct{}, 1),
+		connections:  map[string]*connection{},
+		choker:       newChoker(),
+		extensions:   client.NewExtensionRegistry(),
+		have:         make(message.BitField, (len(torrentFile.PieceHashes)+7)/8),
+		announceKey:  rand.Uint32(),
+		completed:    make(chan struct{}),
+		done:         make(chan struct{}),
 	}
+	t.left.Store(int64(torrentFile.Length))
+	t.registerExtensions()
+	return t
 }
 
 func (t *Torrent) ReadRemotePeerMessage(c *client.Client, peer *types.Peer, state *types.DownloadingState) error {
-	msg, err := message.Read(c.Con)
+	msg, err := c.ReadMessage()
 	if err != nil {
 		return err
 	}
+	// keep-alive
+	if msg == nil {
+		return nil
+	}
 	switch msg.Id {
 	case message.MsgUnChoke:
 		c.Choked = false
 	case message.MsgChoke:
 		c.Choked = true
+		// without the fast extension a choke silently drops our requests, they are sent again after the unchoke
+		if !c.SupportsFast {
+			state.Requested, state.Backlog = state.Downloaded, 0
+		}
 	case message.MsgHave:
-		index := message.ParseHaveMessage(msg)
+		index, err := message.ParseHaveMessage(msg)
+		if err != nil {
+			return err
+		}
 		c.BitField.SetPiece(index)
 	case message.MsgPiece:
 		pieceMessage, err := message.ParsePieceMessage(msg)
 		if err != nil {
 			return err
 		}
-		// TODO: check if length of block data is equal to what we requested earlier in our request
+		// blocks of a piece we gave up on are thrown away
+		if state.Rejected && pieceMessage.PieceIndex == state.Index {
+			state.Backlog--
+			return nil
+		}
+		// answers come in the order of our requests, anything else wasn't asked for
+		expected := min(MAX_BLOCK_SIZE, state.Requested-state.Downloaded)
+		if pieceMessage.PieceIndex != state.Index || pieceMessage.Offset != state.Downloaded || expected <= 0 || len(pieceMessage.BlockData) != expected {
+			return &message.ParseError{
+				Id:     msg.Id,
+				Length: msg.Length,
+				Err:    fmt.Errorf("block %d+%d of piece %d was not requested", pieceMessage.Offset, len(pieceMessage.BlockData), pieceMessage.PieceIndex),
+			}
+		}
 		state.Result = append(state.Result, pieceMessage.BlockData...)
+		state.Downloaded += len(pieceMessage.BlockData)
+		state.Backlog--
+		t.downloaded.Add(int64(len(pieceMessage.BlockData)))
+		if conn := t.connection(c.Peer); conn != nil {
+			conn.downloaded.Add(int64(len(pieceMessage.BlockData)))
+		}
+	case message.MsgInterested:
+		return t.setInterested(c, true)
+	case message.MsgNotInterested:
+		return t.setInterested(c, false)
+	case message.MsgRequest:
+		return t.handleRequest(c, msg)
+	case message.MsgCancel:
+		return t.handleCancel(c, msg)
+	case message.MsgAllowedFast:
+		return t.handleAllowedFast(c, msg)
+	case message.MsgRejectRequest:
+		return t.handleReject(c, msg, state)
+	case message.MsgSuggest:
+		// only a hint, pieces are taken from the queue in order
+		doNothing()
+	case message.MsgExtended:
+		return t.handleExtendedMessage(c, msg)
 	default:
 		doNothing()
 	}
@@ -81,30 +213,114 @@ func doNothing() {
 
 }
 
-// TODO: Implement request pipelining to have at most 5-10 unfulfilled request in the piepline
-// TODO: Can we make it adaptable to improve performance ?
+// extended handshake we send to a peer speaking the extension protocol
+func (t *Torrent) extendedHandshake(c *client.Client) message.ExtendedHandshake {
+	handshake := message.ExtendedHandshake{
+		M:            t.extensions.M(),
+		MetadataSize: len(t.InfoBytes),
+		V:            p2pClientVersion,
+		P:            t.currentPeer.Port,
+		Reqq:         maxQueuedRequests,
+	}
+	if !t.pexEnabled() {
+		delete(handshake.M, pex.ExtensionName)
+	}
+	if ip := c.Peer.IP.To4(); ip != nil {
+		handshake.YourIp = string(ip)
+	} else if ip := c.Peer.IP.To16(); ip != nil {
+		handshake.YourIp = string(ip)
+	}
+	return handshake
+}
+
+// extensions every torrent speaks
+func (t *Torrent) registerExtensions() {
+	t.extensions.Register(metadata.ExtensionName, metadata.LocalId, t.serveMetadata)
+	t.extensions.Register(pex.ExtensionName, pex.LocalId, t.handlePex)
+}
+
+func (t *Torrent) handleExtendedMessage(c *client.Client, msg *message.Message) error {
+	return t.extensions.Handle(c, msg)
+}
+
+// serve our metadata to peers which joined from a magnet link
+func (t *Torrent) serveMetadata(c *client.Client, payload []byte) error {
+	request, err := metadata.ParseMessage(payload)
+	if err != nil {
+		return err
+	}
+	reply := metadata.Respond(t.InfoBytes, request)
+	if reply == nil {
+		return nil
+	}
+	return c.SendExtended(metadata.ExtensionName, reply.Serialize())
+}
+
+// add peers to the pool, a running download connects to them right away
+// peers which are already known are ignored
+func (t *Torrent) AddPeers(peers []*types.Peer) {
+	t.peersMu.Lock()
+	for _, peer := range peers {
+		address := common.PeerAdress(*peer)
+		if t.knownPeers[address] {
+			continue
+		}
+		t.knownPeers[address] = true
+		t.remotePeers = append(t.remotePeers, peer)
+		t.pendingPeers = append(t.pendingPeers, peer)
+	}
+	t.peersMu.Unlock()
+
+	select {
+	case t.peerSignal <- struct{}{}:
+	default:
+	}
+}
+
+// peers added since the last call
+func (t *Torrent) takePendingPeers() []*types.Peer {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	peers := t.pendingPeers
+	t.pendingPeers = nil
+	return peers
+}
+
+// blocks of MAX_BLOCK_SIZE are requested in order with at most MAX_BACKLOG of them unanswered
+// TODO: Can we make the backlog adaptable to improve performance ?
 func (t *Torrent) downloadAPiece(c *client.Client, piece *types.PieceWork, peer types.Peer) (*types.PieceResult, error) {
 	// set timer for connection
 	// reset the timer when this function returns
-	// always try to download 100KB block from remote peer
 	c.Con.SetDeadline(time.Now().Add(time.Second * 30))
 	defer c.Con.SetDeadline(time.Time{})
 
-	state := types.DownloadingState{}
+	state := types.DownloadingState{Index: piece.Index, Result: make([]byte, 0, piece.Length)}
+	conn := t.connection(peer)
 
 	// keep iterating until entire piece is downloaded
 	for state.Downloaded < piece.Length {
-		// check if peer is unchoked
-		if !c.Choked {
-			block := min(MAX_BLOCK_SIZE, piece.Length-state.Downloaded)
-			err := c.SendRequest(piece.Index, state.Downloaded+1, block)
+		err := t.sendPex(c, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// a rejected piece is given up once the requests still out are answered, they would be mistaken for blocks of the next piece
+		if state.Rejected && state.Backlog <= 0 {
+			return nil, fmt.Errorf("peer rejected a request for piece %d", piece.Index)
+		}
+
+		// check if peer is unchoked, pieces of the allowed fast set can be requested anyway
+		for !state.Rejected && (!c.Choked || c.AllowedFast[piece.Index]) && state.Backlog < MAX_BACKLOG && state.Requested < piece.Length {
+			block := min(MAX_BLOCK_SIZE, piece.Length-state.Requested)
+			err := c.SendRequest(piece.Index, state.Requested, block)
 			if err != nil {
 				return nil, err
 			}
-			state.Downloaded += block
+			state.Requested += block
+			state.Backlog++
 		}
 
-		err := t.ReadRemotePeerMessage(c, &peer, &state)
+		err = t.ReadRemotePeerMessage(c, &peer, &state)
 		if err != nil {
 			return nil, err
 		}
@@ -118,36 +334,109 @@ func (t *Torrent) downloadAPiece(c *client.Client, piece *types.PieceWork, peer
 
 func (t *Torrent) downloadFromPeer(peer types.Peer, workerChan *chan types.PieceWork, resultChan *chan types.PieceResult) error {
 	// check if this new connection is allowed as per settings
-	if open_download_con >= MAX_ALLOWED_DOWNLOAD_CONNECTIONS {
+	if open_download_con.Load() >= MAX_ALLOWED_DOWNLOAD_CONNECTIONS {
 		// return and don't perform furthur processing
 		return fmt.Errorf("attempt to open more than %v connections", MAX_ALLOWED_DOWNLOAD_CONNECTIONS)
 	}
 
-	var peerId [20]byte
-	copy(peerId[:], peer.ID[:20])
-	c, err := client.New(peer, peerId, t.InfoHash)
+	c, err := client.NewWith(t.dial(), peer, t.PeerId(), t.InfoHash, t.Encryption)
 	if err != nil {
 		return err
 	}
-	common.AddTo(&open_download_con, 1)
+	open_download_con.Add(1)
 	defer c.Con.Close()
-	defer common.DecFrom(&open_download_con, 1)
+	defer open_download_con.Add(-1)
+
+	err = t.sendBitField(c)
+	if err != nil {
+		return err
+	}
+
+	return t.exchangePieces(c, workerChan, resultChan)
+}
+
+func (t *Torrent) dial() client.DialFunc {
+	if t.Dialer == nil {
+		return client.DialTCP
+	}
+	return t.Dialer.Dial
+}
 
-	// client maps current peer to one remote peer
-	c.SendUnChoke()
+// serve a connection a remote peer opened to us, once bitfields are exchanged it downloads like the ones we open
+func (t *Torrent) ServeIncoming(c *client.Client) error {
+	if open_upload_con.Load() >= MAX_ALLOWED_UPLOAD_CONNECTIONS {
+		return fmt.Errorf("attempt to accept more than %v connections", MAX_ALLOWED_UPLOAD_CONNECTIONS)
+	}
+	workerChan, resultChan := t.queues()
+	if workerChan == nil && !t.complete() {
+		return fmt.Errorf("torrent is not downloading")
+	}
+	open_upload_con.Add(1)
+	defer open_upload_con.Add(-1)
+
+	err := t.sendBitField(c)
+	if err != nil {
+		return err
+	}
+	err = c.ReadBitField()
+	if err != nil {
+		return err
+	}
+	if workerChan == nil {
+		return t.exchangePieces(c, nil, nil)
+	}
+	return t.exchangePieces(c, &workerChan, &resultChan)
+}
+
+// download pieces from a connected peer until every piece is taken, then keep serving it's requests
+// blocks the peer asks for are uploaded from the start, nil queues only upload
+func (t *Torrent) exchangePieces(c *client.Client, workerChan *chan types.PieceWork, resultChan *chan types.PieceResult) error {
+	t.sizeBitField(c)
+	// messages from here on are batched, the rest of a batch goes out before the connection is closed
+	c.BufferWrites()
+	defer c.Flush()
+	conn := t.addConnection(c)
+	defer t.removeConnection(c.Peer)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.upload(conn, stop)
+	// a stopped torrent ends the connections blocked reading
+	go func() {
+		select {
+		case <-t.done:
+			c.Con.Close()
+		case <-stop:
+		}
+	}()
+
+	if c.SupportsExtensions {
+		c.SendExtendedHandshake(t.extendedHandshake(c))
+	}
+	t.sendAllowedFast(conn)
+
+	// peers start choked, the choker unchokes them once they are interested
 	c.SendInterested()
 
+	if workerChan == nil {
+		return t.seedTo(c)
+	}
 	for piece := range *workerChan {
 		// client does not have this piece so put it back to worker chan and we will try to download again in future (from this peer or some other peer)
-		if !c.BitField.HasPiece(piece.Index) {
+		if !c.HasPiece(piece.Index) {
 			(*workerChan) <- piece
 			continue
 		}
 
 		// attempt to donwload this piece
-		downloaded, err := t.downloadAPiece(c, &piece, peer)
+		downloaded, err := t.downloadAPiece(c, &piece, c.Peer)
+		// peers breaking the protocol are dropped, the piece is left to the others
+		if message.IsParseError(err) {
+			(*workerChan) <- piece
+			return fmt.Errorf("dropping peer %q: %w", c.Peer, err)
+		}
 		if err != nil {
-			log.Default().Printf("Failed to download piece %q, from peer %q", piece, peer)
+			log.Default().Printf("Failed to download piece %q, from peer %q", piece, c.Peer)
 			// TODO: Add retries and after max retries throw an error for this piece but keep other pieces
 			(*workerChan) <- piece
 			continue
@@ -155,87 +444,259 @@ func (t *Torrent) downloadFromPeer(peer types.Peer, workerChan *chan types.Piece
 
 		// perform integrity check of downloaded piece
 		if sha1.Sum(downloaded.Data) != t.PieceHashes[piece.Index] {
-			return fmt.Errorf("downloaded piece %q failed integriy check from remote peer %q", downloaded, peer)
+			return fmt.Errorf("downloaded piece %q failed integriy check from remote peer %q", downloaded, c.Peer)
 		}
 
 		(*resultChan) <- *downloaded
 	}
 
-	return nil
+	return t.seedTo(c)
+}
+
+// answer requests of a peer once there is nothing left to download from it
+// connections between two seeds are of no use and closed
+func (t *Torrent) seedTo(c *client.Client) error {
+	for {
+		select {
+		case <-t.done:
+			return nil
+		default:
+		}
+		if t.hasAllPieces(c) && t.complete() {
+			return nil
+		}
+
+		err := t.ReadRemotePeerMessage(c, &c.Peer, &types.DownloadingState{})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// our peer id, sent in handshakes
+func (t *Torrent) PeerId() [20]byte {
+	var peerId [20]byte
+	copy(peerId[:], t.currentPeer.ID)
+	return peerId
+}
+
+// pieces we have so far
+func (t *Torrent) BitField() message.BitField {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return append(message.BitField(nil), t.have...)
+}
+
+func (t *Torrent) setHave(index int) {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	t.have.SetPiece(index)
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return t.have.HasPiece(index)
+}
+
+// true when every piece is verified
+func (t *Torrent) complete() bool {
+	select {
+	case <-t.completed:
+		return true
+	default:
+		return false
+	}
+}
+
+// start and end offset of a piece in the torrent
+func (t *Torrent) pieceBounds(index int) (int, int) {
+	return common.CalculatePieceBounds(index, t.PieceLength, t.Length)
+}
+
+// tell every connected peer we have a new piece
+// haves are queued for the uploader of every connection, a slow peer must not hold up the others
+func (t *Torrent) broadcastHave(index int) {
+	for _, conn := range t.allConnections() {
+		conn.haves.push(index)
+	}
+}
+
+// files of the torrent, opened on first use
+func (t *Torrent) openStore() (*storage, error) {
+	t.storeMu.Lock()
+	defer t.storeMu.Unlock()
+	if t.store != nil {
+		return t.store, nil
+	}
+	store, err := openStorage(t.OutputDir, t.Files, t.PieceLength)
+	if err != nil {
+		return nil, err
+	}
+	t.store = store
+	return store, nil
 }
 
-func (t *Torrent) Download() {
+func (t *Torrent) closeStore() {
+	t.storeMu.Lock()
+	defer t.storeMu.Unlock()
+	if t.store != nil {
+		t.store.Close()
+		t.store = nil
+	}
+}
+
+// queues of the running download, nil while there is none
+func (t *Torrent) queues() (chan types.PieceWork, chan types.PieceResult) {
+	t.queuesMu.Lock()
+	defer t.queuesMu.Unlock()
+	return t.workerChan, t.resultChan
+}
+
+func (t *Torrent) Download() error {
+	// files stay open after the download, peers may want our pieces
+	store, err := t.openStore()
+	if err != nil {
+		return err
+	}
+
 	workerChan := make(chan types.PieceWork, len(t.PieceHashes))
 	resultChan := make(chan types.PieceResult, len(t.PieceHashes))
+	t.queuesMu.Lock()
+	t.workerChan, t.resultChan = workerChan, resultChan
+	t.queuesMu.Unlock()
 
 	for index, piece := range t.PieceHashes {
+		start, end := common.CalculatePieceBounds(index, t.PieceLength, t.Length)
 		work := types.PieceWork{
 			Index:  index,
 			Hash:   piece,
-			Length: t.PieceLength,
+			Length: end - start, // last piece can be shorter than the others
 		}
 
 		workerChan <- work
 	}
 
-	for _, peer := range t.remotePeers {
-		go t.downloadFromPeer(*peer, &workerChan, &resultChan)
-	}
-
 	// bytes which are dowonloaded so far
 	downloadedBytes := 0
 	percentage := 0
-	//gather downloaded piece and convert into a single file
-	file := make([]byte, t.Length)
-	for downloadedPiece := range resultChan {
-		downloadedBytes += len(downloadedPiece.Data)
-		percentage = (t.Length / downloadedBytes) * 100
-		fmt.Printf("%v percent downloaded, bytes = %v", percentage, downloadedBytes)
+	// write every downloaded piece to the files it belongs to
+	// peers learned while downloading are connected to as they arrive
+	for donePieces := 0; donePieces < len(t.PieceHashes); {
+		for _, peer := range t.takePendingPeers() {
+			go t.downloadFromPeer(*peer, &workerChan, &resultChan)
+		}
 
-		start, end := common.CalculatePieceBounds(downloadedPiece.Index, t.PieceLength, t.Length)
-		copy(file[start:end], downloadedPiece.Data[start:end])
+		select {
+		case <-t.peerSignal:
+			continue
+		case <-t.done:
+			return fmt.Errorf("torrent stopped before download finished")
+		case downloadedPiece := <-resultChan:
+			err := store.WritePiece(downloadedPiece.Index, downloadedPiece.Data)
+			if err != nil {
+				return err
+			}
+			t.setHave(downloadedPiece.Index)
+			t.broadcastHave(downloadedPiece.Index)
+
+			donePieces++
+			downloadedBytes += len(downloadedPiece.Data)
+			t.left.Add(-int64(len(downloadedPiece.Data)))
+			// torrents of empty files have no bytes to count
+			if t.Length > 0 {
+				percentage = downloadedBytes * 100 / t.Length
+			}
+			fmt.Printf("%v percent downloaded, bytes = %v\n", percentage, downloadedBytes)
+		}
 	}
+	close(workerChan)
+	t.markCompleted()
 	fmt.Println("FILE DOWNLOADED")
-	fmt.Println(string(file))
+	return nil
 }
 
 // entry point for a torrent communication
-func (t *Torrent) Start() {
-	open_download_con = 0
-	// get peer list from tracker server
-	trackerUrl, err := t.BuildTrackerUrl()
-	if err != nil {
-		panic(err)
+func (t *Torrent) Start() error {
+	open_download_con.Store(0)
+	// trackers are announced to in the background for the whole life of the torrent
+	// magnet links can come without a tracker, peers are given with the link then
+	if !t.Trackers.Empty() {
+		t.sessionDone = make(chan struct{})
+		go t.runTrackerSession()
+	}
+	// a dead tracker leaves the DHT as the only source of peers
+	if t.DHT != nil && !t.Private {
+		go t.runDhtSession()
+	}
+	go t.runChoker()
+	if t.LSD != nil && !t.Private {
+		t.LSD.Add(t.InfoHash, t.AddPeers)
+		defer t.LSD.Remove(t.InfoHash)
 	}
+	defer t.Stop()
 
-	trackerResponse, err := tracker.GetTrackerResponse(trackerUrl)
-	if err != nil {
-		panic(err)
+	// peers arrive from the tracker session while downloading
+	err := t.Download()
+	if err != nil || !t.Seed {
+		return err
 	}
+	<-t.done
+	return nil
+}
 
-	// after every response.Interval seconds ... get fresh list of remote peers from tracker server
-	// YET TO IMPLEMENT ^^^
-	copy(t.remotePeers[:], trackerResponse.Peers[:])
+// stop the torrent, trackers are told we are leaving
+func (t *Torrent) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
 
-	// Once you get remote peers start downloading from these peers
-	t.Download()
+	if t.sessionDone != nil {
+		select {
+		case <-t.sessionDone:
+		case <-time.After(stoppedAnnounceTimeout):
+		}
+	}
+	t.closeAnnouncers()
+	t.closeStore()
 }
 
-func (t *Torrent) BuildTrackerUrl() (string, error) {
-	trackerUrl, err := url.Parse(t.Url)
+func (t *Torrent) markCompleted() {
+	t.completedOnce.Do(func() {
+		close(t.completed)
+	})
+}
+
+// get peer list from the first working tracker of every tier
+func (t *Torrent) AnnounceToTracker() ([]*types.Peer, error) {
+	trackerResponse, err := t.Trackers.Announce(func(announceUrl string) (*tracker.TrackerResponse, error) {
+		announcer, err := t.announcer(announceUrl)
+		if err != nil {
+			return nil, err
+		}
+		return announcer.Announce(t.announceRequest(tracker.EventNone))
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return trackerResponse.Peers, nil
+}
 
-	params := url.Values{
-		"peer_id":    []string{string(t.currentPeer.ID[:])},
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"port":       []string{strconv.Itoa(t.currentPeer.Port)},
-		"left":       []string{"100"},
-		"downloaded": []string{"0"},
-		"uploaded":   []string{"0"},
-		"compact":    []string{"1"}, // tracket returns packages string instead of bencoded hash - https://www.bittorrent.org/beps/bep_0023.html
+func (t *Torrent) announceRequest(event tracker.Event) tracker.AnnounceRequest {
+	request := tracker.AnnounceRequest{
+		InfoHash:   t.InfoHash,
+		Port:       t.currentPeer.Port,
+		Left:       t.left.Load(),
+		Downloaded: t.downloaded.Load(),
+		Uploaded:   t.uploaded.Load(),
+		Event:      event,
+		Key:        t.announceKey,
 	}
-	trackerUrl.RawQuery = params.Encode()
-	return trackerUrl.String(), nil
+	copy(request.PeerId[:], t.currentPeer.ID)
+	return request
+}
+
+// url of an http announce to given tracker
+func (t *Torrent) BuildTrackerUrl(announceUrl string) (string, error) {
+	return tracker.BuildAnnounceUrl(announceUrl, t.announceRequest(tracker.EventNone))
 }
@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// seeder behind an in-memory listener of a torrent with one piece, it answers requests with the block asked for
+// pipes don't buffer, so it writes from a goroutine of it's own while reading
+func servePipeSeeder(t *testing.T, l net.Listener, infoHash [20]byte, data []byte) {
+	con, err := l.Accept()
+	if err != nil {
+		return
+	}
+	t.Cleanup(func() { con.Close() })
+	_, err = client.ReadHandShake(con)
+	if err != nil {
+		return
+	}
+
+	out := make(chan *message.Message, 16)
+	defer close(out)
+	go func() {
+		for msg := range out {
+			con.Write(msg.Serialize())
+		}
+	}()
+	var peerId [20]byte
+	copy(peerId[:], "pipe-seeder-00000000")
+	_, err = con.Write(client.NewHandShake(infoHash, peerId).Serialize())
+	if err != nil {
+		return
+	}
+	out <- &message.Message{Id: message.MsgBitfield, Payload: []byte{0x80}}
+
+	for {
+		msg, err := message.Read(con)
+		if err != nil {
+			return
+		}
+		switch msg.Id {
+		case message.MsgInterested:
+			out <- &message.Message{Id: message.MsgUnChoke}
+		case message.MsgRequest:
+			request, err := message.ParseRequestMessage(msg)
+			if err != nil || request.Begin+request.Length > len(data) {
+				return
+			}
+			block := data[request.Begin : request.Begin+request.Length]
+			out <- message.FormatPieceMessage(request.PieceIndex, request.Begin, block)
+		}
+	}
+}
+
+func TestDownloadOverPipeTransport(t *testing.T) {
+	data := []byte("a piece which never touches a socket")
+	peer := types.Peer{ID: "local-peer-012345678", IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	torrent := New(peer, &torrent_file.TorrentFile{
+		InfoHash:    [20]byte{8},
+		Name:        "pipe.txt",
+		Length:      len(data),
+		PieceLength: len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		Files:       []torrent_file.File{{Path: []string{"pipe.txt"}, Length: len(data)}},
+	})
+	torrent.OutputDir = t.TempDir()
+
+	pipes := client.NewPipeCon()
+	l, err := pipes.Listen("10.0.0.2:6881")
+	require.NoError(t, err)
+	defer l.Close()
+	go servePipeSeeder(t, l, torrent.InfoHash, data)
+
+	torrent.Dialer = client.NewDialer()
+	torrent.Dialer.Register(pipes, time.Second)
+	torrent.AddPeers([]*types.Peer{{IP: net.ParseIP("10.0.0.2"), Port: 6881}})
+
+	done := make(chan error, 1)
+	go func() { done <- torrent.Download() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	written, err := os.ReadFile(filepath.Join(torrent.OutputDir, "pipe.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, written)
+	assert.Equal(t, 1, torrent.Dialer.Stats()["pipe"].Connected)
+}
@@ -0,0 +1,258 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// requests of one peer waiting for an answer, peers asking for more are dropped
+const maxQueuedRequests = 256
+
+// peers drop connections which are silent for two minutes
+const keepAliveInterval = 90 * time.Second
+
+// blocks requested by a remote peer, answered in order by the uploader of it's connection
+type uploadQueue struct {
+	mu       sync.Mutex
+	requests []message.RequestMessage
+	signal   chan struct{}
+}
+
+func newUploadQueue() *uploadQueue {
+	return &uploadQueue{signal: make(chan struct{}, 1)}
+}
+
+func (q *uploadQueue) push(request message.RequestMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.requests) >= maxQueuedRequests {
+		return fmt.Errorf("peer has more than %d requests queued", maxQueuedRequests)
+	}
+	q.requests = append(q.requests, request)
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// drop a queued request, blocks which are sent already can't be taken back
+// returns false when the request wasn't queued
+func (q *uploadQueue) cancel(request message.RequestMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.requests {
+		if queued == request {
+			q.requests = append(q.requests[:i], q.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *uploadQueue) pop() (message.RequestMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.requests) == 0 {
+		return message.RequestMessage{}, false
+	}
+	request := q.requests[0]
+	q.requests = q.requests[1:]
+	return request, true
+}
+
+// choking a peer throws away what it asked for, except the requests keep returns true for
+// returns the requests thrown away
+func (q *uploadQueue) clear(keep func(message.RequestMessage) bool) []message.RequestMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept, dropped := []message.RequestMessage{}, []message.RequestMessage{}
+	for _, request := range q.requests {
+		if keep != nil && keep(request) {
+			kept = append(kept, request)
+		} else {
+			dropped = append(dropped, request)
+		}
+	}
+	q.requests = kept
+	return dropped
+}
+
+func (q *uploadQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.requests)
+}
+
+// pieces to announce to a peer, sent by the uploader of it's connection so a peer which doesn't read only stalls itself
+type haveQueue struct {
+	mu     sync.Mutex
+	pieces []int
+	signal chan struct{}
+}
+
+func newHaveQueue() *haveQueue {
+	return &haveQueue{signal: make(chan struct{}, 1)}
+}
+
+func (q *haveQueue) push(index int) {
+	q.mu.Lock()
+	q.pieces = append(q.pieces, index)
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *haveQueue) take() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pieces := q.pieces
+	q.pieces = nil
+	return pieces
+}
+
+// unchoke and choke only send a message when the state of the connection changes
+func (t *Torrent) unchoke(conn *connection) error {
+	if !conn.amChoking.CompareAndSwap(true, false) {
+		return nil
+	}
+	return conn.client.SendUnChoke()
+}
+
+// peers with the fast extension keep their allowed fast requests and are told about the others
+func (t *Torrent) choke(conn *connection) error {
+	if !conn.amChoking.CompareAndSwap(false, true) {
+		return nil
+	}
+	dropped := conn.uploads.clear(func(request message.RequestMessage) bool {
+		return conn.allowedFast[request.PieceIndex]
+	})
+	err := conn.client.SendChoke()
+	if err != nil {
+		return err
+	}
+	for _, request := range dropped {
+		err = t.reject(conn.client, request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue a block a remote peer asked for
+// malformed requests end the connection, requests for pieces we can't give are ignored
+func (t *Torrent) handleRequest(c *client.Client, msg *message.Message) error {
+	request, err := message.ParseRequestMessage(msg)
+	if err != nil {
+		return err
+	}
+	if request.Length <= 0 || request.Length > message.MaxBlockLength {
+		return fmt.Errorf("peer requested a block of %d bytes", request.Length)
+	}
+	if request.PieceIndex < 0 || request.PieceIndex >= len(t.PieceHashes) {
+		return fmt.Errorf("peer requested unknown piece %d", request.PieceIndex)
+	}
+	start, end := t.pieceBounds(request.PieceIndex)
+	if request.Begin < 0 || request.Begin+request.Length > end-start {
+		return fmt.Errorf("peer requested block %d+%d outside of piece %d", request.Begin, request.Length, request.PieceIndex)
+	}
+
+	conn := t.connection(c.Peer)
+	if conn == nil {
+		return nil
+	}
+	// requests sent before our choke arrived are not an error
+	if (conn.amChoking.Load() && !conn.allowedFast[request.PieceIndex]) || !t.hasPiece(request.PieceIndex) {
+		return t.reject(c, request)
+	}
+	return conn.uploads.push(request)
+}
+
+func (t *Torrent) handleCancel(c *client.Client, msg *message.Message) error {
+	request, err := message.ParseRequestMessage(msg)
+	if err != nil {
+		return err
+	}
+	// peers with the fast extension get a reject for every request which isn't answered with a piece
+	if conn := t.connection(c.Peer); conn != nil && conn.uploads.cancel(request) {
+		return t.reject(c, request)
+	}
+	return nil
+}
+
+// answer the requests of a connection with blocks read from disk until stop is closed
+// haves and a keep-alive every keepAliveInterval are sent in between
+func (t *Torrent) upload(conn *connection, stop <-chan struct{}) {
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-keepAlive.C:
+			if conn.client.SendKeepAlive() != nil {
+				return
+			}
+			continue
+		case <-conn.haves.signal:
+			for _, index := range conn.haves.take() {
+				if conn.client.SendHave(index) != nil {
+					return
+				}
+			}
+			continue
+		case <-conn.uploads.signal:
+		}
+
+		for {
+			request, ok := conn.uploads.pop()
+			if !ok {
+				break
+			}
+			block, err := t.readBlock(request)
+			if err != nil {
+				log.Default().Printf("Failed to read block %d+%d of piece %d: %v", request.Begin, request.Length, request.PieceIndex, err)
+				t.reject(conn.client, request)
+				continue
+			}
+
+			msg := message.FormatPieceMessage(request.PieceIndex, request.Begin, block)
+			err = conn.client.Send(msg)
+			if err != nil {
+				return
+			}
+			conn.uploaded.Add(int64(len(block)))
+			t.uploaded.Add(int64(len(block)))
+		}
+	}
+}
+
+// bytes uploaded to a connected peer, 0 when we are not connected to it
+func (t *Torrent) UploadedTo(peer types.Peer) int64 {
+	conn := t.connection(peer)
+	if conn == nil {
+		return 0
+	}
+	return conn.uploaded.Load()
+}
+
+func (t *Torrent) readBlock(request message.RequestMessage) ([]byte, error) {
+	t.storeMu.Lock()
+	store := t.store
+	t.storeMu.Unlock()
+	if store == nil {
+		return nil, fmt.Errorf("files of the torrent are not open")
+	}
+	return store.ReadBlock(request.PieceIndex, request.Begin, request.Length)
+}
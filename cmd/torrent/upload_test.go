@@ -0,0 +1,247 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/client"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+// torrent of two files whose second piece spans both of them, every piece is on disk already
+func newSeedingTorrent(t *testing.T) (*Torrent, []byte) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	return newSeedingTorrentOf(t, data, 16), data
+}
+
+// like newSeedingTorrent for any data of more than 20 bytes
+func newSeedingTorrentOf(t *testing.T, data []byte, pieceLength int) *Torrent {
+	hashes := [][20]byte{}
+	for start := 0; start < len(data); start += pieceLength {
+		hashes = append(hashes, sha1.Sum(data[start:min(start+pieceLength, len(data))]))
+	}
+
+	peer := types.Peer{ID: "local-peer-012345678", IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	torrent := New(peer, &torrent_file.TorrentFile{
+		Length:      len(data),
+		PieceLength: pieceLength,
+		PieceHashes: hashes,
+		Files: []torrent_file.File{
+			{Path: []string{"first"}, Length: 20},
+			{Path: []string{"second"}, Length: len(data) - 20},
+		},
+	})
+	torrent.OutputDir = t.TempDir()
+	store, err := torrent.openStore()
+	require.NoError(t, err)
+	t.Cleanup(torrent.closeStore)
+	for index := range hashes {
+		start, end := torrent.pieceBounds(index)
+		require.NoError(t, store.WritePiece(index, data[start:end]))
+		torrent.setHave(index)
+	}
+	return torrent
+}
+
+// connection of a remote peer which we unchoked, it's uploader runs until the test ends
+func uploadingConnection(t *testing.T, torrent *Torrent) (*connection, net.Conn) {
+	c, remote := pexClient(t, "10.0.0.1", 6881)
+	conn := torrent.addConnection(c)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go torrent.upload(conn, stop)
+	return conn, remote
+}
+
+func readMessage(t *testing.T, remote net.Conn) *message.Message {
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := message.Read(remote)
+	require.NoError(t, err)
+	return msg
+}
+
+func TestHaveDoesNotWaitForStalledPeer(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	_, remote := uploadingConnection(t, torrent)
+	// this peer never reads what we send
+	stalled, _ := pexClient(t, "10.0.0.2", 6881)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go torrent.upload(torrent.addConnection(stalled), stop)
+
+	done := make(chan struct{})
+	go func() {
+		torrent.broadcastHave(1)
+		torrent.broadcastHave(2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast waited for a peer which doesn't read")
+	}
+
+	for _, want := range []int{1, 2} {
+		index, err := message.ParseHaveMessage(readMessage(t, remote))
+		require.NoError(t, err)
+		assert.Equal(t, want, index)
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	torrent, data := newSeedingTorrent(t)
+	conn, remote := uploadingConnection(t, torrent)
+	go torrent.unchoke(conn)
+	assert.Equal(t, message.MsgUnChoke, readMessage(t, remote).Id)
+
+	// block of the second piece which starts in the first file and ends in the second
+	require.NoError(t, torrent.handleRequest(conn.client, message.FormatRequestMessage(1, 2, 6)))
+	piece, err := message.ParsePieceMessage(readMessage(t, remote))
+	require.NoError(t, err)
+	assert.Equal(t, 1, piece.PieceIndex)
+	assert.Equal(t, 2, piece.Offset)
+	assert.Equal(t, data[18:24], piece.BlockData)
+
+	// the uploader counts a block once it's write returned
+	assert.Eventually(t, func() bool { return torrent.UploadedTo(conn.client.Peer) == 6 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(6), torrent.uploaded.Load())
+}
+
+func TestInvalidRequests(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	conn := torrent.addConnection(c)
+	conn.amChoking.Store(false)
+
+	for _, request := range []*message.Message{
+		message.FormatRequestMessage(0, 0, message.MaxBlockLength+1),
+		message.FormatRequestMessage(0, 0, 0),
+		message.FormatRequestMessage(3, 0, 4),
+		message.FormatRequestMessage(2, 0, 5), // last piece is only 4 bytes
+		{Id: message.MsgRequest, Payload: []byte{0, 0, 0, 1}},
+	} {
+		assert.Error(t, torrent.handleRequest(c, request))
+	}
+	assert.Zero(t, conn.uploads.len())
+}
+
+func TestRequestsWhichAreNotAnswered(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	conn := torrent.addConnection(c)
+
+	require.NoError(t, torrent.handleRequest(c, message.FormatRequestMessage(0, 0, 4)))
+	assert.Zero(t, conn.uploads.len(), "peer is choked")
+
+	conn.amChoking.Store(false)
+	torrent.have = make(message.BitField, 1)
+	require.NoError(t, torrent.handleRequest(c, message.FormatRequestMessage(0, 0, 4)))
+	assert.Zero(t, conn.uploads.len(), "we don't have the piece")
+}
+
+func TestCancelRemovesQueuedRequest(t *testing.T) {
+	torrent, _ := newSeedingTorrent(t)
+	c, _ := pexClient(t, "10.0.0.1", 6881)
+	conn := torrent.addConnection(c)
+	conn.amChoking.Store(false)
+
+	require.NoError(t, torrent.handleRequest(c, message.FormatRequestMessage(0, 0, 4)))
+	require.NoError(t, torrent.handleRequest(c, message.FormatRequestMessage(0, 4, 4)))
+	require.NoError(t, torrent.handleCancel(c, message.FormatCancelMessage(0, 0, 4)))
+
+	request, ok := conn.uploads.pop()
+	require.True(t, ok)
+	assert.Equal(t, message.RequestMessage{PieceIndex: 0, Begin: 4, Length: 4}, request)
+	_, ok = conn.uploads.pop()
+	assert.False(t, ok)
+}
+
+func TestUploadQueueLimit(t *testing.T) {
+	queue := newUploadQueue()
+	for i := 0; i < maxQueuedRequests; i++ {
+		require.NoError(t, queue.push(message.RequestMessage{Begin: i}))
+	}
+	assert.Error(t, queue.push(message.RequestMessage{}))
+
+	queue.clear(nil)
+	assert.Zero(t, queue.len())
+}
+
+// two copies of our client, pieces span many blocks and two files
+func TestDownloadFromSeedingTorrent(t *testing.T) {
+	data := make([]byte, 2*128*1024+1000)
+	rand.Read(data)
+	seed := newSeedingTorrentOf(t, data, 128*1024)
+	seed.markCompleted()
+	port := startTorrentListener(t, seed)
+
+	leecher := New(types.Peer{ID: "leecher-012345678901", IP: net.ParseIP("127.0.0.1"), Port: 6882}, &torrent_file.TorrentFile{
+		InfoHash:    seed.InfoHash,
+		Length:      seed.Length,
+		PieceLength: seed.PieceLength,
+		PieceHashes: seed.PieceHashes,
+		Files:       seed.Files,
+	})
+	leecher.OutputDir = t.TempDir()
+	leecher.AddPeers([]*types.Peer{{IP: net.ParseIP("127.0.0.1"), Port: port}})
+
+	done := make(chan error, 1)
+	go func() { done <- leecher.Download() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	leecher.closeStore()
+
+	first, err := os.ReadFile(filepath.Join(leecher.OutputDir, "first"))
+	require.NoError(t, err)
+	second, err := os.ReadFile(filepath.Join(leecher.OutputDir, "second"))
+	require.NoError(t, err)
+	assert.Equal(t, data, append(first, second...))
+	assert.Equal(t, int64(len(data)), seed.uploaded.Load())
+}
+
+func TestSeedToDownloadingPeer(t *testing.T) {
+	torrent, data := newSeedingTorrent(t)
+	torrent.markCompleted()
+
+	port := startTorrentListener(t, torrent)
+	var peerId [20]byte
+	copy(peerId[:], "leecher-012345678901")
+	leecher, err := client.New(types.Peer{IP: net.ParseIP("127.0.0.1"), Port: port}, peerId, torrent.InfoHash)
+	require.NoError(t, err)
+	defer leecher.Con.Close()
+	assert.True(t, leecher.HaveAll, "seed sends have all")
+
+	// we don't have a piece yet
+	require.NoError(t, leecher.SendHaveNone())
+	leecher.SendInterested()
+	for leecher.Choked {
+		msg := readMessage(t, leecher.Con)
+		if msg != nil && msg.Id == message.MsgUnChoke {
+			leecher.Choked = false
+		}
+	}
+	require.NoError(t, leecher.SendRequest(2, 0, 4))
+	for {
+		msg := readMessage(t, leecher.Con)
+		if msg == nil || msg.Id != message.MsgPiece {
+			continue
+		}
+		piece, err := message.ParsePieceMessage(msg)
+		require.NoError(t, err)
+		assert.Equal(t, data[32:], piece.BlockData)
+		return
+	}
+}
@@ -1,46 +1,170 @@
 package torrent_file
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
 	"github.com/umair-hassan2/torrent-client/cmd/common"
 	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 type bencodeInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	PieceLength int           `bencode:"piece length"`
+	Pieces      string        `bencode:"pieces"`
+	Files       []bencodeFile `bencode:"files"` // only present in multi file torrents
+	Private     int           `bencode:"private"`
+	raw         []byte        // info dictionary exactly as it appeared in the file
 }
 
 type bencodeTorrentFile struct {
-	Announce string      `bencode:"announce"`
-	Comment  string      `bencode:"comment"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         bencodeInfo `bencode:"info"`
+	UrlList      urlList     `bencode:"url-list,omitempty"` // web seeds - https://www.bittorrent.org/beps/bep_0019.html
 }
 
+// url-list is either a single url or a list of urls
+type urlList []string
+
+// tracker responses come from the network, a response bigger than this is rejected
+const MaxTrackerResponseSize = 2 * 1024 * 1024
+
+// http tracker response - https://www.bittorrent.org/beps/bep_0003.html#trackers
+// a response with failure reason set carries nothing else worth reading
+// our own tracker server writes responses with the same types
 type BencodeCompactTrackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    []byte `bencode:"peers"`
+	FailureReason  string       `bencode:"failure reason,omitempty"`
+	WarningMessage string       `bencode:"warning message,omitempty"`
+	Interval       int          `bencode:"interval"`
+	MinInterval    int          `bencode:"min interval,omitempty"`
+	TrackerId      string       `bencode:"tracker id,omitempty"`
+	Complete       int          `bencode:"complete"`
+	Incomplete     int          `bencode:"incomplete"`
+	Peers          TrackerPeers `bencode:"peers"`
+	Peers6         []byte       `bencode:"peers6,omitempty"` // compact IPv6 peers - https://www.bittorrent.org/beps/bep_0007.html
+}
+
+// peers are either a compact string or a list of dictionaries, depending on what the tracker supports
+type TrackerPeers struct {
+	Compact []byte
+	Dicts   []BencodePeer // used instead of Compact when not nil
+}
+
+type BencodePeer struct {
+	Id   string `bencode:"peer id,omitempty"` // left out when the client asked for no_peer_id
+	Ip   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+// http scrape response - https://www.bittorrent.org/beps/bep_0048.html
+type BencodeScrapeResponse struct {
+	FailureReason string                       `bencode:"failure reason,omitempty"`
+	Files         map[string]BencodeScrapeFile `bencode:"files"`
+}
+
+type BencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
 }
 
 // decode .torrent file
 func DecodeFile(reader io.Reader) (*bencodeTorrentFile, error) {
 	torrentFile := bencodeTorrentFile{}
-	err := bencode.Unmarshal(reader, &torrentFile)
+	err := bencode.NewDecoder(reader).Decode(&torrentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if torrentFile.Info.raw == nil {
+		return nil, fmt.Errorf("torrent file has no info dictionary")
+	}
+
+	return &torrentFile, nil
+}
+
+// build a torrent file from an info dictionary fetched from peers, trackers come from the magnet link
+func FromInfo(info []byte, trackers []string) (*bencodeTorrentFile, error) {
+	torrentFile := bencodeTorrentFile{}
+	err := torrentFile.Info.UnmarshalBencode(info)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(trackers) > 0 {
+		torrentFile.Announce = trackers[0]
+	}
+	if len(trackers) > 1 {
+		// every tracker of a magnet link is a tier of it's own
+		for _, tracker := range trackers {
+			torrentFile.AnnounceList = append(torrentFile.AnnounceList, []string{tracker})
+		}
+	}
 	return &torrentFile, nil
 }
 
+// bencoded content of the .torrent file
+func (btf *bencodeTorrentFile) Encode() ([]byte, error) {
+	return bencode.Marshal(btf)
+}
+
+// keep the raw bytes of info dictionary while decoding it
+// the info hash must be computed over the dictionary as it appeared in the file,
+// re-encoding the decoded struct would drop unknown keys and produce a different hash
+func (bi *bencodeInfo) UnmarshalBencode(data []byte) error {
+	type plainInfo bencodeInfo
+	err := bencode.Unmarshal(data, (*plainInfo)(bi))
+	if err != nil {
+		return err
+	}
+	// pieces is a list of 20 byte hashes without anything in between
+	if len(bi.Pieces)%sha1.Size != 0 {
+		return fmt.Errorf("pieces of info dictionary is %d bytes, not a multiple of %d", len(bi.Pieces), sha1.Size)
+	}
+
+	bi.raw = data
+	return nil
+}
+
+// an info dictionary read from a file is written back unchanged so the info hash stays the same
+func (bi bencodeInfo) MarshalBencode() ([]byte, error) {
+	if bi.raw != nil {
+		return bi.raw, nil
+	}
+
+	type plainInfo bencodeInfo
+	return bencode.Marshal(plainInfo(bi))
+}
+
+func (ul *urlList) UnmarshalBencode(data []byte) error {
+	var url string
+	if bencode.Unmarshal(data, &url) == nil {
+		*ul = urlList{url}
+		return nil
+	}
+	return bencode.Unmarshal(data, (*[]string)(ul))
+}
+
+// SHA-1 hash of the raw info dictionary, this identifies the torrent everywhere
+func (btf *bencodeTorrentFile) InfoHash() [20]byte {
+	return sha1.Sum(btf.Info.raw)
+}
+
 // returns list of hashes of pieces in give .torrent file
 func (btf *bencodeTorrentFile) GetHashPieces() (hashPieces [][20]byte) {
 	pieces := []byte(btf.Info.Pieces)
@@ -51,10 +175,30 @@ func (btf *bencodeTorrentFile) GetHashPieces() (hashPieces [][20]byte) {
 	return hashPieces
 }
 
+// returns list of files in given .torrent file
+// single file torrents are treated as a multi file torrent with one file
+func (btf *bencodeTorrentFile) GetFiles() []File {
+	if len(btf.Info.Files) == 0 {
+		return []File{{Length: btf.Info.Length, Path: []string{btf.Info.Name}}}
+	}
+
+	files := make([]File, len(btf.Info.Files))
+	for i, file := range btf.Info.Files {
+		files[i] = File{
+			Length: file.Length,
+			Path:   append([]string{btf.Info.Name}, file.Path...),
+		}
+	}
+	return files
+}
+
 // parse tracker response
 func ParseTrackerResponse(response string) (BencodeCompactTrackerResponse, error) {
 	trackerResponse := BencodeCompactTrackerResponse{}
-	err := bencode.Unmarshal(strings.NewReader(response), &trackerResponse)
+	decoder := bencode.NewDecoder(strings.NewReader(response))
+	decoder.SetMaxSize(MaxTrackerResponseSize)
+	decoder.SetMaxDepth(8)
+	err := decoder.Decode(&trackerResponse)
 	if err != nil {
 		return BencodeCompactTrackerResponse{}, err
 	}
@@ -62,23 +206,76 @@ func ParseTrackerResponse(response string) (BencodeCompactTrackerResponse, error
 	return trackerResponse, nil
 }
 
-// load list of remote peers from compact tracker response
-func (btr *BencodeCompactTrackerResponse) GetRemotePeers() ([]*types.Peer, error) {
-	peerEntrySize := 6
-	totalPeers := len(btr.Peers) / peerEntrySize
-	if len(btr.Peers)%totalPeers != 0 {
-		return nil, fmt.Errorf("peer size is invalid")
+func (tp *TrackerPeers) UnmarshalBencode(data []byte) error {
+	if len(data) > 0 && data[0] == 'l' {
+		return bencode.Unmarshal(data, &tp.Dicts)
+	}
+	return bencode.Unmarshal(data, &tp.Compact)
+}
+
+func (tp TrackerPeers) MarshalBencode() ([]byte, error) {
+	if tp.Dicts != nil {
+		return bencode.Marshal(tp.Dicts)
+	}
+	if tp.Compact == nil {
+		return bencode.Marshal([]byte{})
 	}
+	return bencode.Marshal(tp.Compact)
+}
 
-	remotePeers := make([]*types.Peer, totalPeers)
+// compact form of peers, IPv4 peers go to the 4 byte form and IPv6 peers to the 16 byte form
+func CompactPeers(peers []*types.Peer) (peers4 []byte, peers6 []byte) {
+	for _, peer := range peers {
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(peer.Port))
+		if ip := peer.IP.To4(); ip != nil {
+			peers4 = append(append(peers4, ip...), port[:]...)
+		} else if ip := peer.IP.To16(); ip != nil {
+			peers6 = append(append(peers6, ip...), port[:]...)
+		}
+	}
+	return peers4, peers6
+}
 
+// load list of remote peers from tracker response, IPv4 and IPv6 peers together
+func (btr *BencodeCompactTrackerResponse) GetRemotePeers() ([]*types.Peer, error) {
 	// first 4 bytes = ip address
 	// last 2 bytes = port number
-	for i := 0; i < totalPeers; i++ {
-		offset := i * peerEntrySize
-		ipBytes := btr.Peers[offset : offset+4]
-		portBytes := btr.Peers[offset+4 : offset+6]
-		remotePeers[i] = common.NewPeer("", net.IP(ipBytes), int(binary.BigEndian.Uint16(portBytes)))
+	remotePeers, err := ParseCompactPeers(btr.Peers.Compact, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range btr.Peers.Dicts {
+		// ip can also be a dns name, such peers are skipped
+		ip := net.ParseIP(peer.Ip)
+		if ip == nil || peer.Port <= 0 || peer.Port > 65535 {
+			continue
+		}
+		remotePeers = append(remotePeers, common.NewPeer(peer.Id, ip, peer.Port))
+	}
+
+	peers6, err := ParseCompactPeers(btr.Peers6, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(remotePeers, peers6...), nil
+}
+
+// parse compact peer entries, ip address of ipLength bytes followed by a 2 byte port
+// ipLength is 4 for IPv4 peers and 16 for IPv6 peers
+func ParseCompactPeers(data []byte, ipLength int) ([]*types.Peer, error) {
+	entrySize := ipLength + 2
+	if len(data)%entrySize != 0 {
+		return nil, fmt.Errorf("compact peers of %d bytes are not a multiple of %d", len(data), entrySize)
+	}
+
+	peers := make([]*types.Peer, 0, len(data)/entrySize)
+	for offset := 0; offset < len(data); offset += entrySize {
+		ip := make(net.IP, ipLength)
+		copy(ip, data[offset:offset+ipLength])
+		port := int(binary.BigEndian.Uint16(data[offset+ipLength : offset+entrySize]))
+		peers = append(peers, common.NewPeer("", ip, port))
 	}
-	return remotePeers, nil
+	return peers, nil
 }
@@ -0,0 +1,229 @@
+package torrent_file
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+)
+
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	// piece length is picked to keep the number of pieces around this value
+	targetPieceCount = 1500
+)
+
+// CreateOptions describes a torrent to be created from a file or directory
+type CreateOptions struct {
+	Path         string // file or directory to share
+	Announce     string
+	AnnounceList [][]string // tiers of trackers - https://www.bittorrent.org/beps/bep_0012.html
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero value leaves the date out
+	Private      bool
+	WebSeeds     []string
+	PieceLength  int // 0 picks a piece length based on the content size
+	Workers      int // number of goroutines hashing pieces, 0 uses one per cpu
+}
+
+// info dictionary of a new torrent, single file torrents have length and multi file torrents have files
+type createdInfo struct {
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Length      *int          `bencode:"length,omitempty"`
+	Name        string        `bencode:"name"`
+	PieceLength int           `bencode:"piece length"`
+	Pieces      string        `bencode:"pieces"`
+	Private     int           `bencode:"private,omitempty"`
+}
+
+// build the bencoded content of a .torrent file
+func Create(opts CreateOptions) ([]byte, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info := createdInfo{Name: filepath.Base(root)}
+	var diskPaths []string
+	var files []File
+	if stat.IsDir() {
+		diskPaths, files, err = walkDirectory(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("directory %q has no files", opts.Path)
+		}
+
+		for _, file := range files {
+			info.Files = append(info.Files, bencodeFile{Length: file.Length, Path: file.Path[1:]})
+		}
+	} else {
+		length := int(stat.Size())
+		info.Length = &length
+		diskPaths = []string{root}
+		files = []File{{Length: length, Path: []string{info.Name}}}
+	}
+
+	totalLength := 0
+	for _, file := range files {
+		totalLength += file.Length
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = PickPieceLength(totalLength)
+	}
+	if info.PieceLength < MinPieceLength || info.PieceLength > MaxPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two between %d and %d", MinPieceLength, MaxPieceLength)
+	}
+
+	pieces, err := hashPieces(diskPaths, files, info.PieceLength, totalLength, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces = string(pieces)
+	if opts.Private {
+		info.Private = 1
+	}
+
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	torrentFile := bencodeTorrentFile{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		Info:         bencodeInfo{raw: rawInfo},
+		UrlList:      opts.WebSeeds,
+	}
+	if !opts.CreationDate.IsZero() {
+		torrentFile.CreationDate = opts.CreationDate.Unix()
+	}
+	return bencode.Marshal(torrentFile)
+}
+
+// smallest power of two which keeps the number of pieces near the target
+func PickPieceLength(totalLength int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// regular files under root in lexical order, paths start with the name of root
+func walkDirectory(root string) ([]string, []File, error) {
+	var diskPaths []string
+	var files []File
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(filepath.Dir(root), path)
+		if err != nil {
+			return err
+		}
+
+		diskPaths = append(diskPaths, path)
+		files = append(files, File{
+			Length: int(stat.Size()),
+			Path:   splitPath(relative),
+		})
+		return nil
+	})
+	return diskPaths, files, err
+}
+
+func splitPath(path string) []string {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		return []string{file}
+	}
+	return append(splitPath(filepath.Clean(dir)), file)
+}
+
+// SHA-1 of every piece, pieces are hashed by a pool of workers
+func hashPieces(diskPaths []string, files []File, pieceLength, totalLength, workers int) ([]byte, error) {
+	handles := make([]*os.File, len(diskPaths))
+	for i, path := range diskPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		handles[i] = f
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pieceCount := (totalLength + pieceLength - 1) / pieceLength
+	hashes := make([]byte, pieceCount*20)
+	indexChan := make(chan int)
+	errChan := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexChan {
+				length := 0
+				for _, span := range PieceSpans(files, index, pieceLength) {
+					_, err := handles[span.FileIndex].ReadAt(buf[span.PieceOffset:span.PieceOffset+span.Length], int64(span.FileOffset))
+					if err != nil {
+						errChan <- fmt.Errorf("failed to read %s: %w", diskPaths[span.FileIndex], err)
+						return
+					}
+					length = span.PieceOffset + span.Length
+				}
+
+				hash := sha1.Sum(buf[:length])
+				copy(hashes[index*20:], hash[:])
+			}
+		}()
+	}
+
+	var err error
+	for index := 0; index < pieceCount && err == nil; index++ {
+		select {
+		case indexChan <- index:
+		case err = <-errChan:
+		}
+	}
+	close(indexChan)
+	wg.Wait()
+
+	if err == nil && len(errChan) > 0 {
+		err = <-errChan
+	}
+	return hashes, err
+}
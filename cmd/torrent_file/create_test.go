@@ -0,0 +1,94 @@
+package torrent_file
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateMultiFile(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "bin"), 0755))
+
+	first := bytes.Repeat([]byte("a"), 20000)
+	second := bytes.Repeat([]byte("b"), 30000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "bin", "app"), first, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), second, 0644))
+
+	data, err := Create(CreateOptions{
+		Path:         root,
+		Announce:     "http://tracker.local/announce",
+		AnnounceList: [][]string{{"http://tracker.local/announce"}, {"udp://backup.local:6969"}},
+		Comment:      "nightly build",
+		CreatedBy:    "zero-net",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		WebSeeds:     []string{"http://mirror.local/"},
+		PieceLength:  MinPieceLength,
+		Workers:      3,
+	})
+	require.NoError(t, err)
+
+	btf, err := DecodeFile(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"http://tracker.local/announce"}, {"udp://backup.local:6969"}}, btf.AnnounceList)
+	assert.Equal(t, "nightly build", btf.Comment)
+	assert.Equal(t, "zero-net", btf.CreatedBy)
+	assert.Equal(t, int64(1700000000), btf.CreationDate)
+	assert.Equal(t, urlList{"http://mirror.local/"}, btf.UrlList)
+
+	torrentFile := FromBencodeToTorrentFile(btf)
+	assert.Equal(t, "release", torrentFile.Name)
+	assert.Equal(t, 50000, torrentFile.Length)
+	assert.True(t, torrentFile.Private)
+	assert.Equal(t, []File{
+		{Length: 20000, Path: []string{"release", "bin", "app"}},
+		{Length: 30000, Path: []string{"release", "notes.txt"}},
+	}, torrentFile.Files)
+
+	// pieces are hashed over the concatenation of files
+	content := append(first, second...)
+	require.Len(t, torrentFile.PieceHashes, 4)
+	for i, hash := range torrentFile.PieceHashes {
+		end := min((i+1)*MinPieceLength, len(content))
+		assert.Equal(t, sha1.Sum(content[i*MinPieceLength:end]), hash, "hash of piece %d", i)
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifact.bin")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+
+	data, err := Create(CreateOptions{Path: path, Announce: "http://tracker.local/announce"})
+	require.NoError(t, err)
+
+	btf, err := DecodeFile(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	torrentFile := FromBencodeToTorrentFile(btf)
+	assert.Equal(t, "artifact.bin", torrentFile.Name)
+	assert.Equal(t, 11, torrentFile.Length)
+	assert.Equal(t, MinPieceLength, torrentFile.PieceLength)
+	assert.Equal(t, [][20]byte{sha1.Sum([]byte("hello world"))}, torrentFile.PieceHashes)
+	assert.Equal(t, []File{{Length: 11, Path: []string{"artifact.bin"}}}, torrentFile.Files)
+}
+
+func TestCreateInvalidPieceLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifact.bin")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+
+	_, err := Create(CreateOptions{Path: path, PieceLength: 20000})
+	assert.Error(t, err)
+}
+
+func TestPickPieceLength(t *testing.T) {
+	assert.Equal(t, MinPieceLength, PickPieceLength(1024))
+	assert.Equal(t, 1024*1024, PickPieceLength(1024*1024*1024))
+	assert.Equal(t, MaxPieceLength, PickPieceLength(1<<40))
+}
@@ -1,23 +1,101 @@
 package torrent_file
 
+import "path/filepath"
+
 type TorrentFile struct {
-	Announce    string
-	Comment     string
+	Announce     string
+	AnnounceList [][]string // tiers of trackers, empty if torrent only has announce
+	Comment      string
+	Length       int
+	Name         string
+	PieceLength  int
+	InfoHash     [20]byte // SHA-1 hash of bencoded torrent file - fixed length of 20 bytes
+	PieceHashes  [][20]byte
+	Files        []File
+	InfoBytes    []byte // raw info dictionary, served to peers fetching metadata
+	Private      bool   // private torrents only get peers from their trackers - https://www.bittorrent.org/beps/bep_0027.html
+}
+
+// File is one file of the torrent content
+// Path is relative to the download directory, for multi file torrents it starts with the torrent name
+type File struct {
+	Length int
+	Path   []string
+}
+
+// FileSpan is the part of a piece which belongs to a single file
+type FileSpan struct {
+	FileIndex   int
+	FileOffset  int // offset inside the file
+	PieceOffset int // offset inside the piece
 	Length      int
-	Name        string
-	PieceLength int
-	InfoHash    [20]byte // SHA-1 hash of bencoded torrent file - fixed length of 20 bytes
-	PieceHashes [][20]byte
 }
 
 func FromBencodeToTorrentFile(bencodeTorrentFile *bencodeTorrentFile) *TorrentFile {
 	torrentFile := &TorrentFile{
-		Announce:    bencodeTorrentFile.Announce,
-		Length:      bencodeTorrentFile.Info.Length,
-		Name:        bencodeTorrentFile.Info.Name,
-		Comment:     bencodeTorrentFile.Comment,
-		PieceLength: bencodeTorrentFile.Info.PieceLength,
-		PieceHashes: bencodeTorrentFile.GetHashPieces(),
+		Announce:     bencodeTorrentFile.Announce,
+		AnnounceList: bencodeTorrentFile.AnnounceList,
+		Length:       bencodeTorrentFile.Info.Length,
+		Name:         bencodeTorrentFile.Info.Name,
+		Comment:      bencodeTorrentFile.Comment,
+		PieceLength:  bencodeTorrentFile.Info.PieceLength,
+		InfoHash:     bencodeTorrentFile.InfoHash(),
+		InfoBytes:    bencodeTorrentFile.Info.raw,
+		PieceHashes:  bencodeTorrentFile.GetHashPieces(),
+		Files:        bencodeTorrentFile.GetFiles(),
+		Private:      bencodeTorrentFile.Info.Private == 1,
+	}
+
+	// length of a multi file torrent is the sum of it's files
+	if len(bencodeTorrentFile.Info.Files) > 0 {
+		torrentFile.Length = 0
+		for _, file := range torrentFile.Files {
+			torrentFile.Length += file.Length
+		}
 	}
 	return torrentFile
 }
+
+// relative path of the file on disk
+func (f *File) DiskPath() string {
+	return filepath.Join(f.Path...)
+}
+
+// returns the spans of files covered by given piece
+// a piece can cross file boundaries so it may touch more than one file
+func (tf *TorrentFile) PieceSpans(pieceIndex int) []FileSpan {
+	return PieceSpans(tf.Files, pieceIndex, tf.PieceLength)
+}
+
+func PieceSpans(files []File, pieceIndex, pieceLength int) []FileSpan {
+	totalLength := 0
+	for _, file := range files {
+		totalLength += file.Length
+	}
+
+	pieceStart := pieceIndex * pieceLength
+	pieceEnd := min(pieceStart+pieceLength, totalLength)
+
+	spans := []FileSpan{}
+	fileStart := 0
+	for index, file := range files {
+		fileEnd := fileStart + file.Length
+		// overlap of [pieceStart, pieceEnd) and [fileStart, fileEnd)
+		start := max(pieceStart, fileStart)
+		end := min(pieceEnd, fileEnd)
+		if start < end {
+			spans = append(spans, FileSpan{
+				FileIndex:   index,
+				FileOffset:  start - fileStart,
+				PieceOffset: start - pieceStart,
+				Length:      end - start,
+			})
+		}
+
+		if fileEnd >= pieceEnd {
+			break
+		}
+		fileStart = fileEnd
+	}
+	return spans
+}
@@ -0,0 +1,117 @@
+package torrent_file
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceSpans(t *testing.T) {
+	// 3 files of 5, 10 and 3 bytes with pieces of 8 bytes
+	files := []File{
+		{Length: 5, Path: []string{"root", "a"}},
+		{Length: 10, Path: []string{"root", "b"}},
+		{Length: 3, Path: []string{"root", "c"}},
+	}
+
+	tests := []struct {
+		name       string
+		pieceIndex int
+		expected   []FileSpan
+	}{
+		{
+			name:       "piece crossing a file boundary",
+			pieceIndex: 0,
+			expected: []FileSpan{
+				{FileIndex: 0, FileOffset: 0, PieceOffset: 0, Length: 5},
+				{FileIndex: 1, FileOffset: 0, PieceOffset: 5, Length: 3},
+			},
+		},
+		{
+			name:       "piece crossing into the last file",
+			pieceIndex: 1,
+			expected: []FileSpan{
+				{FileIndex: 1, FileOffset: 3, PieceOffset: 0, Length: 7},
+				{FileIndex: 2, FileOffset: 0, PieceOffset: 7, Length: 1},
+			},
+		},
+		{
+			name:       "short last piece",
+			pieceIndex: 2,
+			expected: []FileSpan{
+				{FileIndex: 2, FileOffset: 1, PieceOffset: 0, Length: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, PieceSpans(files, tt.pieceIndex, 8))
+		})
+	}
+}
+
+func TestMultiFileTorrent(t *testing.T) {
+	btf := &bencodeTorrentFile{
+		Info: bencodeInfo{
+			Name:        "bundle",
+			PieceLength: 16,
+			Files: []bencodeFile{
+				{Length: 10, Path: []string{"docs", "readme.txt"}},
+				{Length: 20, Path: []string{"bin", "app"}},
+			},
+		},
+	}
+
+	torrentFile := FromBencodeToTorrentFile(btf)
+	assert.Equal(t, 30, torrentFile.Length)
+	assert.Equal(t, []File{
+		{Length: 10, Path: []string{"bundle", "docs", "readme.txt"}},
+		{Length: 20, Path: []string{"bundle", "bin", "app"}},
+	}, torrentFile.Files)
+}
+
+func TestDecodeMultiFile(t *testing.T) {
+	data := "d4:infod5:filesld6:lengthi3e4:pathl1:aeed6:lengthi4e4:pathl3:sub1:beee" +
+		"4:name3:dir12:piece lengthi4e6:pieces0:ee"
+
+	btf, err := DecodeFile(strings.NewReader(data))
+	assert.NoError(t, err)
+
+	torrentFile := FromBencodeToTorrentFile(btf)
+	assert.Equal(t, 7, torrentFile.Length)
+	assert.Equal(t, []File{
+		{Length: 3, Path: []string{"dir", "a"}},
+		{Length: 4, Path: []string{"dir", "sub", "b"}},
+	}, torrentFile.Files)
+}
+
+func TestFromInfo(t *testing.T) {
+	info := []byte("d6:lengthi7e4:name5:a.txt5:otheri1e12:piece lengthi16e6:pieces0:e")
+
+	btf, err := FromInfo(info, []string{"http://a/announce", "udp://b:80"})
+	require.NoError(t, err)
+	assert.Equal(t, sha1.Sum(info), btf.InfoHash())
+	assert.Equal(t, [][]string{{"http://a/announce"}, {"udp://b:80"}}, btf.AnnounceList)
+
+	// saved .torrent keeps the info dictionary byte for byte
+	data, err := btf.Encode()
+	assert.NoError(t, err)
+	decoded, err := DecodeFile(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, sha1.Sum(info), decoded.InfoHash())
+	assert.Equal(t, "http://a/announce", decoded.Announce)
+}
+
+func TestRejectTruncatedPieces(t *testing.T) {
+	info := "d6:lengthi7e4:name5:a.txt12:piece lengthi16e6:pieces21:" + strings.Repeat("x", 21) + "e"
+
+	_, err := FromInfo([]byte(info), nil)
+	assert.ErrorContains(t, err, "not a multiple of 20")
+	_, err = DecodeFile(strings.NewReader("d4:info" + info + "e"))
+	assert.ErrorContains(t, err, "not a multiple of 20")
+}
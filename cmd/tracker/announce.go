@@ -0,0 +1,84 @@
+package tracker
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// event reported with an announce, values match the ones of the udp tracker protocol
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// AnnounceRequest holds everything a tracker needs to know about us
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerId     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int    // number of peers we want, 0 lets the tracker decide
+	Key        uint32 // lets the tracker recognise us when our ip changes
+	TrackerId  string // tracker id returned by a previous announce to the same tracker
+}
+
+// announce to a tracker, the protocol is picked from the url scheme
+func Announce(announceUrl string, request AnnounceRequest) (*TrackerResponse, error) {
+	announcer, err := New(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer announcer.Close()
+	return announcer.Announce(request)
+}
+
+// url of an http announce request
+func BuildAnnounceUrl(announceUrl string, request AnnounceRequest) (string, error) {
+	trackerUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	params := trackerUrl.Query()
+	params.Set("peer_id", string(request.PeerId[:]))
+	params.Set("info_hash", string(request.InfoHash[:]))
+	params.Set("port", strconv.Itoa(request.Port))
+	params.Set("left", strconv.FormatInt(request.Left, 10))
+	params.Set("downloaded", strconv.FormatInt(request.Downloaded, 10))
+	params.Set("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	params.Set("compact", "1") // tracket returns packages string instead of bencoded hash - https://www.bittorrent.org/beps/bep_0023.html
+	if request.Event != EventNone {
+		params.Set("event", request.Event.String())
+	}
+	if request.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(request.NumWant))
+	}
+	if request.Key != 0 {
+		params.Set("key", strconv.FormatUint(uint64(request.Key), 16))
+	}
+	if request.TrackerId != "" {
+		params.Set("trackerid", request.TrackerId)
+	}
+	trackerUrl.RawQuery = params.Encode()
+	return trackerUrl.String(), nil
+}
@@ -0,0 +1,80 @@
+package tracker
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Announcer talks to one tracker
+type Announcer interface {
+	Announce(request AnnounceRequest) (*TrackerResponse, error)
+	// torrents the tracker doesn't know about are left out of the result
+	Scrape(infoHashes [][20]byte) ([]ScrapeResult, error)
+	Close() error
+}
+
+// announcer for the tracker at given url, the protocol is picked from the url scheme
+func New(announceUrl string) (Announcer, error) {
+	parsed, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return &HttpTracker{Url: announceUrl}, nil
+	case "udp":
+		return &UdpTracker{Url: announceUrl, Client: DefaultUdpClient}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", parsed.Scheme)
+	}
+}
+
+// HttpTracker announces over http, requests go through HttpClient
+type HttpTracker struct {
+	Url string
+}
+
+func (h *HttpTracker) Announce(request AnnounceRequest) (*TrackerResponse, error) {
+	trackerUrl, err := BuildAnnounceUrl(h.Url, request)
+	if err != nil {
+		return nil, err
+	}
+	return GetTrackerResponse(trackerUrl)
+}
+
+func (h *HttpTracker) Scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	scrapeUrl, err := BuildScrapeUrl(h.Url, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpGet(scrapeUrl)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScrapeResponse(body, infoHashes)
+}
+
+// http requests don't keep anything open between announces
+func (h *HttpTracker) Close() error {
+	return nil
+}
+
+// UdpTracker announces over udp, the connection id is kept by Client
+type UdpTracker struct {
+	Url    string
+	Client *UdpClient
+}
+
+func (u *UdpTracker) Announce(request AnnounceRequest) (*TrackerResponse, error) {
+	return u.Client.Announce(u.Url, request)
+}
+
+func (u *UdpTracker) Scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	return u.Client.Scrape(u.Url, infoHashes)
+}
+
+// sockets are opened per request, connection ids stay cached in Client for other announcers
+func (u *UdpTracker) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package tracker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+)
+
+// client used for every http tracker request, announces and scrapes alike
+var HttpClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// body of a successful http tracker response, bounded by MaxTrackerResponseSize
+func httpGet(trackerUrl string) ([]byte, error) {
+	resp, err := HttpClient.Get(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	// never trust the size of a response, read at most one byte more than allowed to detect oversized ones
+	body, err := io.ReadAll(io.LimitReader(resp.Body, torrent_file.MaxTrackerResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > torrent_file.MaxTrackerResponseSize {
+		return nil, fmt.Errorf("tracker response is bigger than %d bytes", torrent_file.MaxTrackerResponseSize)
+	}
+	return body, nil
+}
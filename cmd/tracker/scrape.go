@@ -0,0 +1,101 @@
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+)
+
+// tracker scrape convention - https://www.bittorrent.org/beps/bep_0048.html
+
+// ErrScrapeUnsupported is returned for http trackers whose announce url can't be turned into a scrape url
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// ScrapeResult is the state of one swarm as reported by a tracker
+type ScrapeResult struct {
+	InfoHash   [20]byte
+	Complete   int // number of seeders
+	Incomplete int // number of leechers
+	Downloaded int // number of times the torrent was downloaded completely
+}
+
+// ask a tracker about the swarms of given torrents, the protocol is picked from the url scheme
+// torrents the tracker doesn't know about are left out of the result
+func Scrape(announceUrl string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	announcer, err := New(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer announcer.Close()
+	return announcer.Scrape(infoHashes)
+}
+
+// scrape url is the announce url with "announce" in the last path segment replaced by "scrape"
+func ScrapeUrl(announceUrl string) (string, error) {
+	trackerUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	slash := strings.LastIndex(trackerUrl.Path, "/")
+	segment := trackerUrl.Path[slash+1:]
+	if !strings.HasPrefix(segment, "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	trackerUrl.Path = trackerUrl.Path[:slash+1] + "scrape" + strings.TrimPrefix(segment, "announce")
+	trackerUrl.RawPath = ""
+	return trackerUrl.String(), nil
+}
+
+// url of an http scrape request, info_hash is repeated once for every torrent
+func BuildScrapeUrl(announceUrl string, infoHashes [][20]byte) (string, error) {
+	scrapeUrl, err := ScrapeUrl(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	trackerUrl, err := url.Parse(scrapeUrl)
+	if err != nil {
+		return "", err
+	}
+	params := trackerUrl.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	trackerUrl.RawQuery = params.Encode()
+	return trackerUrl.String(), nil
+}
+
+// results for the asked info hashes, in the order they were asked for
+func ParseScrapeResponse(body []byte, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	response := torrent_file.BencodeScrapeResponse{}
+	decoder := bencode.NewDecoder(bytes.NewReader(body))
+	decoder.SetMaxSize(torrent_file.MaxTrackerResponseSize)
+	decoder.SetMaxDepth(8)
+	err := decoder.Decode(&response)
+	if err != nil {
+		return nil, &MalformedResponseError{Err: err}
+	}
+	if response.FailureReason != "" {
+		return nil, &FailureError{Reason: response.FailureReason}
+	}
+
+	results := []ScrapeResult{}
+	for _, infoHash := range infoHashes {
+		file, ok := response.Files[string(infoHash[:])]
+		if !ok {
+			continue
+		}
+		results = append(results, ScrapeResult{
+			InfoHash:   infoHash,
+			Complete:   file.Complete,
+			Incomplete: file.Incomplete,
+			Downloaded: file.Downloaded,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,64 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?passkey=secret", "http://example.com/scrape?passkey=secret"},
+	}
+	for _, test := range tests {
+		scrape, err := ScrapeUrl(test.announce)
+		require.NoError(t, err)
+		assert.Equal(t, test.scrape, scrape)
+	}
+
+	for _, announce := range []string{"http://example.com/a", "http://example.com/announce/x", "http://example.com/tracker"} {
+		_, err := ScrapeUrl(announce)
+		assert.ErrorIs(t, err, ErrScrapeUnsupported, announce)
+	}
+}
+
+func TestHttpScrape(t *testing.T) {
+	known := [20]byte{1}
+	unknown := [20]byte{2}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		requested = r.URL.Query()["info_hash"]
+		body, _ := bencode.Marshal(map[string]any{
+			"files": map[string]any{
+				string(known[:]): map[string]any{"complete": 7, "incomplete": 3, "downloaded": 42, "name": "test"},
+			},
+		})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	results, err := Scrape(server.URL+"/announce", [][20]byte{known, unknown})
+	require.NoError(t, err)
+	assert.Equal(t, []string{string(known[:]), string(unknown[:])}, requested)
+	assert.Equal(t, []ScrapeResult{{InfoHash: known, Complete: 7, Incomplete: 3, Downloaded: 42}}, results)
+}
+
+func TestScrapeFailureReason(t *testing.T) {
+	_, err := ParseScrapeResponse([]byte("d14:failure reason9:forbiddene"), [][20]byte{{1}})
+	var failure *FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "forbidden", failure.Reason)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+// serve /announce and /scrape, prefixed by the passkey when the server requires one
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action, ok := s.route(r.URL.Path)
+	if action != "announce" && action != "scrape" {
+		http.NotFound(w, r)
+		return
+	}
+	if !ok {
+		writeFailure(w, "invalid passkey")
+		return
+	}
+
+	if action == "announce" {
+		s.serveAnnounce(w, r)
+	} else {
+		s.serveScrape(w, r)
+	}
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	request, err := parseAnnounceParams(params)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	// ip parameter is not trusted, anybody could announce someone else
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, "unknown remote address")
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	response, err := s.Announce(request, ip)
+	if err != nil {
+		var failure *tracker.FailureError
+		if errors.As(err, &failure) {
+			writeFailure(w, failure.Reason)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoded := torrent_file.BencodeCompactTrackerResponse{
+		Interval:    response.Interval,
+		MinInterval: response.MinInterval,
+		Complete:    response.Complete,
+		Incomplete:  response.Incomplete,
+	}
+	// compact responses are the default, clients have to ask for dictionaries
+	if params.Get("compact") == "0" {
+		encoded.Peers.Dicts = []torrent_file.BencodePeer{}
+		for _, peer := range response.Peers {
+			dict := torrent_file.BencodePeer{Ip: peer.IP.String(), Port: peer.Port}
+			if params.Get("no_peer_id") != "1" {
+				dict.Id = peer.ID
+			}
+			encoded.Peers.Dicts = append(encoded.Peers.Dicts, dict)
+		}
+	} else {
+		encoded.Peers.Compact, encoded.Peers6 = torrent_file.CompactPeers(response.Peers)
+	}
+	writeBencode(w, encoded)
+}
+
+func parseAnnounceParams(params map[string][]string) (tracker.AnnounceRequest, error) {
+	request := tracker.AnnounceRequest{}
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	infoHash, peerId := get("info_hash"), get("peer_id")
+	if len(infoHash) != 20 {
+		return request, errors.New("invalid info_hash")
+	}
+	if len(peerId) != 20 {
+		return request, errors.New("invalid peer_id")
+	}
+	copy(request.InfoHash[:], infoHash)
+	copy(request.PeerId[:], peerId)
+
+	var err error
+	request.Port, err = strconv.Atoi(get("port"))
+	if err != nil {
+		return request, errors.New("invalid port")
+	}
+	for key, field := range map[string]*int64{"uploaded": &request.Uploaded, "downloaded": &request.Downloaded, "left": &request.Left} {
+		*field, err = strconv.ParseInt(get(key), 10, 64)
+		if err != nil || *field < 0 {
+			return request, errors.New("invalid " + key)
+		}
+	}
+	if numWant := get("numwant"); numWant != "" {
+		request.NumWant, _ = strconv.Atoi(numWant)
+	}
+
+	switch get("event") {
+	case "started":
+		request.Event = tracker.EventStarted
+	case "completed":
+		request.Event = tracker.EventCompleted
+	case "stopped":
+		request.Event = tracker.EventStopped
+	case "":
+	default:
+		return request, errors.New("invalid event")
+	}
+	return request, nil
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := [][20]byte{}
+	for _, value := range r.URL.Query()["info_hash"] {
+		if len(value) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, [20]byte([]byte(value)))
+	}
+
+	response := torrent_file.BencodeScrapeResponse{Files: map[string]torrent_file.BencodeScrapeFile{}}
+	for _, result := range s.Scrape(infoHashes) {
+		response.Files[string(result.InfoHash[:])] = torrent_file.BencodeScrapeFile{
+			Complete:   result.Complete,
+			Downloaded: result.Downloaded,
+			Incomplete: result.Incomplete,
+		}
+	}
+	writeBencode(w, response)
+}
+
+// tracker errors are sent with status 200, clients read the reason from the body
+// no other key may be present next to the reason
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]string{"failure reason": reason})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
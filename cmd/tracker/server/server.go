@@ -0,0 +1,243 @@
+// Package server implements a BitTorrent tracker for private swarms
+//
+// Announces and scrapes are served over http by ServeHTTP and over udp by ServeUDP, both share the same swarms.
+// Torrents can be limited to an allowlist and announces can be required to carry a passkey.
+package server
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+const (
+	DefaultInterval  = 30 * time.Minute
+	DefaultMaxPeers  = 50
+	DefaultMaxSwarms = 100000
+)
+
+type Config struct {
+	// how often peers are asked to announce, peers missing 1.5 intervals are dropped
+	Interval    time.Duration
+	MinInterval time.Duration
+	// torrents which can be tracked, nil allows every torrent
+	AllowedInfoHashes [][20]byte
+	// when not empty every announce url must start with one of these - http://host/<passkey>/announce
+	Passkeys []string
+	// most peers returned by one announce
+	MaxPeers int
+	// most torrents tracked at once, announces of new torrents are refused above it
+	MaxSwarms int
+}
+
+type Server struct {
+	config   Config
+	allowed  map[[20]byte]bool
+	passkeys map[string]bool
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	lastSweep time.Time
+
+	udpSecret [20]byte // connection ids of udp clients are derived from it
+	now       func() time.Time
+}
+
+type swarm struct {
+	peers      map[string]*peer // keyed by address
+	downloaded int              // number of completed events
+}
+
+type peer struct {
+	id       [20]byte
+	ip       net.IP
+	port     int
+	left     int64
+	lastSeen time.Time
+}
+
+func New(config Config) *Server {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.MaxPeers <= 0 {
+		config.MaxPeers = DefaultMaxPeers
+	}
+	if config.MaxSwarms <= 0 {
+		config.MaxSwarms = DefaultMaxSwarms
+	}
+
+	s := &Server{
+		config: config,
+		swarms: map[[20]byte]*swarm{},
+		now:    time.Now,
+	}
+	s.lastSweep = s.now()
+	if config.AllowedInfoHashes != nil {
+		s.allowed = map[[20]byte]bool{}
+		for _, infoHash := range config.AllowedInfoHashes {
+			s.allowed[infoHash] = true
+		}
+	}
+	if len(config.Passkeys) > 0 {
+		s.passkeys = map[string]bool{}
+		for _, passkey := range config.Passkeys {
+			s.passkeys[passkey] = true
+		}
+	}
+	rand.Read(s.udpSecret[:])
+	return s
+}
+
+// record an announce of peer at given ip and pick peers for it
+// peers of both address families are returned, callers which can't send some of them drop them
+func (s *Server) Announce(request tracker.AnnounceRequest, ip net.IP) (*tracker.TrackerResponse, error) {
+	if s.allowed != nil && !s.allowed[request.InfoHash] {
+		return nil, &tracker.FailureError{Reason: "torrent not registered"}
+	}
+	if request.Port <= 0 || request.Port > 65535 {
+		return nil, &tracker.FailureError{Reason: "invalid port"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= s.config.Interval {
+		s.sweep(now)
+	}
+	current := s.swarms[request.InfoHash]
+	if current == nil {
+		if len(s.swarms) >= s.config.MaxSwarms {
+			s.sweep(now)
+		}
+		if len(s.swarms) >= s.config.MaxSwarms {
+			return nil, &tracker.FailureError{Reason: "tracker is full"}
+		}
+		current = &swarm{peers: map[string]*peer{}}
+		s.swarms[request.InfoHash] = current
+	}
+	s.expire(current, now)
+
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(request.Port))
+	response := tracker.NewTrackerResponse(int(s.config.Interval/time.Second), nil)
+	response.MinInterval = int(s.config.MinInterval / time.Second)
+
+	if request.Event == tracker.EventStopped {
+		delete(current.peers, address)
+		response.Complete, response.Incomplete = current.count()
+		return response, nil
+	}
+	if request.Event == tracker.EventCompleted {
+		current.downloaded++
+	}
+	current.peers[address] = &peer{
+		id:       request.PeerId,
+		ip:       ip,
+		port:     request.Port,
+		left:     request.Left,
+		lastSeen: now,
+	}
+
+	numWant := s.config.MaxPeers
+	if request.NumWant > 0 {
+		numWant = min(numWant, request.NumWant)
+	}
+	// map order is random, so every announce gets a different part of a big swarm
+	for peerAddress, candidate := range current.peers {
+		if len(response.Peers) >= numWant {
+			break
+		}
+		if peerAddress == address {
+			continue
+		}
+		// seeders have nothing to get from each other
+		if request.Left == 0 && candidate.left == 0 {
+			continue
+		}
+		response.Peers = append(response.Peers, &types.Peer{
+			ID:   string(candidate.id[:]),
+			IP:   candidate.ip,
+			Port: candidate.port,
+		})
+	}
+	response.Complete, response.Incomplete = current.count()
+	return response, nil
+}
+
+// state of the asked swarms, torrents which are not tracked are left out
+func (s *Server) Scrape(infoHashes [][20]byte) []tracker.ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := []tracker.ScrapeResult{}
+	for _, infoHash := range infoHashes {
+		current := s.swarms[infoHash]
+		if current == nil || (s.allowed != nil && !s.allowed[infoHash]) {
+			continue
+		}
+		s.expire(current, s.now())
+		result := tracker.ScrapeResult{InfoHash: infoHash, Downloaded: current.downloaded}
+		result.Complete, result.Incomplete = current.count()
+		results = append(results, result)
+	}
+	return results
+}
+
+// drop peers which stopped announcing without saying so
+func (s *Server) expire(current *swarm, now time.Time) {
+	timeout := s.config.Interval * 3 / 2
+	for address, candidate := range current.peers {
+		if now.Sub(candidate.lastSeen) > timeout {
+			delete(current.peers, address)
+		}
+	}
+}
+
+// expire the peers of every swarm and forget swarms nobody is in, s.mu is held
+// swarms of allowed torrents are kept with their download count, there are only as many of them as the allowlist has
+func (s *Server) sweep(now time.Time) {
+	s.lastSweep = now
+	for infoHash, current := range s.swarms {
+		s.expire(current, now)
+		if len(current.peers) == 0 && s.allowed == nil {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+// number of seeders and leechers
+func (sw *swarm) count() (complete, incomplete int) {
+	for _, candidate := range sw.peers {
+		if candidate.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// split path of an announce or scrape url into the passkey and the action
+// the passkey is checked when the server requires one
+func (s *Server) route(path string) (action string, ok bool) {
+	path = strings.Trim(path, "/")
+	passkey, action, found := strings.Cut(path, "/")
+	if !found {
+		passkey, action = "", path
+	}
+
+	if s.passkeys != nil && !s.passkeys[passkey] {
+		return action, false
+	}
+	if s.passkeys == nil && passkey != "" {
+		return action, false
+	}
+	return action, true
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+var testInfoHash = [20]byte{1, 2, 3}
+
+func announceRequest(peerId string, port int, left int64, event tracker.Event) tracker.AnnounceRequest {
+	request := tracker.AnnounceRequest{InfoHash: testInfoHash, Port: port, Left: left, Event: event}
+	copy(request.PeerId[:], peerId)
+	return request
+}
+
+func startHttpServer(t *testing.T, config Config) (*Server, string) {
+	s := New(config)
+	httpServer := httptest.NewServer(s)
+	t.Cleanup(httpServer.Close)
+	return s, httpServer.URL
+}
+
+func TestHttpAnnounce(t *testing.T) {
+	_, url := startHttpServer(t, Config{Interval: 10 * time.Minute, MinInterval: time.Minute})
+	announcer := &tracker.HttpTracker{Url: url + "/announce"}
+
+	response, err := announcer.Announce(announceRequest("seeder-0123456789012", 6881, 0, tracker.EventStarted))
+	require.NoError(t, err)
+	assert.Equal(t, 600, response.Interval)
+	assert.Equal(t, 60, response.MinInterval)
+	assert.Empty(t, response.Peers, "nobody else is in the swarm yet")
+
+	response, err = announcer.Announce(announceRequest("leecher-012345678901", 6882, 100, tracker.EventStarted))
+	require.NoError(t, err)
+	assert.Equal(t, 1, response.Complete)
+	assert.Equal(t, 1, response.Incomplete)
+	require.Len(t, response.Peers, 1)
+	assert.Equal(t, "127.0.0.1", response.Peers[0].IP.String())
+	assert.Equal(t, 6881, response.Peers[0].Port)
+
+	t.Run("completed", func(t *testing.T) {
+		_, err := announcer.Announce(announceRequest("leecher-012345678901", 6882, 0, tracker.EventCompleted))
+		require.NoError(t, err)
+
+		results, err := announcer.Scrape([][20]byte{testInfoHash, {9}})
+		require.NoError(t, err)
+		assert.Equal(t, []tracker.ScrapeResult{{InfoHash: testInfoHash, Complete: 2, Downloaded: 1}}, results)
+	})
+
+	t.Run("seeders don't get seeders", func(t *testing.T) {
+		response, err := announcer.Announce(announceRequest("seeder-0123456789012", 6881, 0, tracker.EventNone))
+		require.NoError(t, err)
+		assert.Empty(t, response.Peers)
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		response, err := announcer.Announce(announceRequest("seeder-0123456789012", 6881, 0, tracker.EventStopped))
+		require.NoError(t, err)
+		assert.Equal(t, 1, response.Complete)
+	})
+}
+
+func TestHttpDictionaryPeers(t *testing.T) {
+	s, url := startHttpServer(t, Config{})
+	s.Announce(announceRequest("first-peer-012345678", 6881, 100, tracker.EventStarted), net.ParseIP("10.0.0.1").To4())
+	s.Announce(announceRequest("second-peer-01234567", 6882, 100, tracker.EventStarted), net.ParseIP("2001:db8::1"))
+
+	request := announceRequest("third-peer-012345678", 6883, 100, tracker.EventStarted)
+	announceUrl, err := tracker.BuildAnnounceUrl(url+"/announce", request)
+	require.NoError(t, err)
+
+	t.Run("compact", func(t *testing.T) {
+		response, err := tracker.GetTrackerResponse(announceUrl)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.1", "2001:db8::1"}, peerIps(response))
+	})
+
+	t.Run("dictionaries", func(t *testing.T) {
+		response, err := tracker.GetTrackerResponse(strings.Replace(announceUrl, "compact=1", "compact=0", 1))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.1", "2001:db8::1"}, peerIps(response))
+		for _, peer := range response.Peers {
+			assert.Len(t, peer.ID, 20, "dictionary peers carry peer ids")
+		}
+	})
+}
+
+func peerIps(response *tracker.TrackerResponse) []string {
+	ips := []string{}
+	for _, peer := range response.Peers {
+		ips = append(ips, peer.IP.String())
+	}
+	return ips
+}
+
+func TestAllowlistAndPasskey(t *testing.T) {
+	_, url := startHttpServer(t, Config{AllowedInfoHashes: [][20]byte{testInfoHash}, Passkeys: []string{"secret"}})
+
+	_, err := (&tracker.HttpTracker{Url: url + "/secret/announce"}).Announce(announceRequest("peer-012345678901234", 6881, 1, tracker.EventStarted))
+	assert.NoError(t, err)
+
+	for _, announceUrl := range []string{url + "/announce", url + "/wrong/announce"} {
+		_, err := (&tracker.HttpTracker{Url: announceUrl}).Announce(announceRequest("peer-012345678901234", 6881, 1, tracker.EventStarted))
+		var failure *tracker.FailureError
+		require.True(t, errors.As(err, &failure), announceUrl)
+		assert.Equal(t, "invalid passkey", failure.Reason)
+	}
+
+	request := announceRequest("peer-012345678901234", 6881, 1, tracker.EventStarted)
+	request.InfoHash = [20]byte{9}
+	_, err = (&tracker.HttpTracker{Url: url + "/secret/announce"}).Announce(request)
+	var failure *tracker.FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "torrent not registered", failure.Reason)
+}
+
+func TestPeerExpiry(t *testing.T) {
+	s := New(Config{Interval: time.Minute})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	s.Announce(announceRequest("first-peer-012345678", 6881, 100, tracker.EventStarted), net.ParseIP("10.0.0.1"))
+	now = now.Add(time.Minute)
+	response, _ := s.Announce(announceRequest("second-peer-01234567", 6882, 100, tracker.EventStarted), net.ParseIP("10.0.0.2"))
+	assert.Len(t, response.Peers, 1)
+
+	// first peer missed it's announce by more than half an interval
+	now = now.Add(time.Minute)
+	response, _ = s.Announce(announceRequest("second-peer-01234567", 6882, 100, tracker.EventNone), net.ParseIP("10.0.0.2"))
+	assert.Empty(t, response.Peers)
+}
+
+func TestSweepForgetsEmptySwarms(t *testing.T) {
+	s := New(Config{Interval: time.Minute, MaxSwarms: 2})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	other := announceRequest("other-peer-012345678", 6881, 100, tracker.EventStarted)
+	other.InfoHash = [20]byte{9}
+	_, err := s.Announce(other, net.ParseIP("10.0.0.1"))
+	require.NoError(t, err)
+	_, err = s.Announce(announceRequest("first-peer-012345678", 6881, 100, tracker.EventStarted), net.ParseIP("10.0.0.2"))
+	require.NoError(t, err)
+
+	third := announceRequest("third-peer-012345678", 6881, 100, tracker.EventStarted)
+	third.InfoHash = [20]byte{7}
+	_, err = s.Announce(third, net.ParseIP("10.0.0.3"))
+	var failure *tracker.FailureError
+	require.ErrorAs(t, err, &failure)
+	assert.Equal(t, "tracker is full", failure.Reason)
+
+	// the peers of both swarms stopped announcing
+	now = now.Add(2 * time.Minute)
+	_, err = s.Announce(third, net.ParseIP("10.0.0.3"))
+	require.NoError(t, err)
+	s.mu.Lock()
+	assert.Len(t, s.swarms, 1)
+	s.mu.Unlock()
+	assert.Empty(t, s.Scrape([][20]byte{testInfoHash, other.InfoHash}))
+}
+
+func startUdpServer(t *testing.T, config Config) (*Server, string) {
+	s := New(config)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go s.ServeUDP(conn)
+	return s, "udp://" + conn.LocalAddr().String()
+}
+
+func newUdpClient() *tracker.UdpClient {
+	client := tracker.NewUdpClient()
+	client.BaseTimeout = 100 * time.Millisecond
+	client.MaxRetries = 2
+	return client
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	s, url := startUdpServer(t, Config{Passkeys: []string{"secret"}})
+	s.Announce(announceRequest("first-peer-012345678", 6881, 0, tracker.EventStarted), net.ParseIP("10.0.0.1"))
+	s.Announce(announceRequest("second-peer-01234567", 6882, 100, tracker.EventStarted), net.ParseIP("2001:db8::1"))
+	client := newUdpClient()
+
+	response, err := client.Announce(url+"/secret/announce", announceRequest("third-peer-012345678", 6883, 100, tracker.EventStarted))
+	require.NoError(t, err)
+	assert.Equal(t, 1, response.Complete)
+	assert.Equal(t, 2, response.Incomplete)
+	assert.Equal(t, []string{"10.0.0.1"}, peerIps(response), "IPv6 peers don't fit in an IPv4 response")
+
+	_, err = client.Announce(url+"/announce", announceRequest("third-peer-012345678", 6883, 100, tracker.EventStarted))
+	var failure *tracker.FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "invalid passkey", failure.Reason)
+
+	_, err = client.Scrape(url+"/secret/announce", [][20]byte{testInfoHash})
+	assert.Error(t, err, "scrape can't carry a passkey")
+}
+
+func TestUdpScrape(t *testing.T) {
+	s, url := startUdpServer(t, Config{})
+	s.Announce(announceRequest("first-peer-012345678", 6881, 0, tracker.EventCompleted), net.ParseIP("10.0.0.1"))
+
+	results, err := newUdpClient().Scrape(url+"/announce", [][20]byte{testInfoHash, {9}})
+	require.NoError(t, err)
+	assert.Equal(t, []tracker.ScrapeResult{
+		{InfoHash: testInfoHash, Complete: 1, Downloaded: 1},
+		{InfoHash: [20]byte{9}},
+	}, results)
+}
+
+func TestUdpUnknownConnectionId(t *testing.T) {
+	s := New(Config{})
+	packet := make([]byte, 98)
+	packet[11] = byte(actionAnnounce)
+	assert.Nil(t, s.handlePacket(packet, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}))
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+// udp tracker protocol - https://www.bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolId = 0x41727101980
+
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+
+	// connection ids are valid for the current and the previous window
+	connectionIdWindow = time.Minute
+	maxScrapeHashes    = 74
+
+	// announce options - https://www.bittorrent.org/beps/bep_0041.html
+	optionEndOfOptions = 0x0
+	optionNop          = 0x1
+	optionUrlData      = 0x2
+)
+
+// answer udp tracker requests arriving at conn until it is closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		response := s.handlePacket(buf[:n], udpAddr)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// response to one packet, nil when the packet is dropped
+func (s *Server) handlePacket(packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == actionConnect {
+		if connectionId != udpProtocolId {
+			return nil
+		}
+		response := udpHeader(actionConnect, transactionId)
+		return binary.BigEndian.AppendUint64(response, s.connectionId(addr, s.now()))
+	}
+
+	// requests with unknown connection ids may come from spoofed addresses, they are never answered
+	if !s.validConnectionId(connectionId, addr) {
+		return nil
+	}
+
+	switch action {
+	case actionAnnounce:
+		return s.handleUdpAnnounce(packet, addr, transactionId)
+	case actionScrape:
+		return s.handleUdpScrape(packet, transactionId)
+	default:
+		return udpError(transactionId, "unknown action")
+	}
+}
+
+func (s *Server) handleUdpAnnounce(packet []byte, addr *net.UDPAddr, transactionId uint32) []byte {
+	if len(packet) < 98 {
+		return udpError(transactionId, "announce request is too short")
+	}
+
+	path, ok := parseUrlData(packet[98:])
+	if !ok {
+		return udpError(transactionId, "invalid announce options")
+	}
+	if _, ok := s.route(path); !ok {
+		return udpError(transactionId, "invalid passkey")
+	}
+
+	request := tracker.AnnounceRequest{
+		Downloaded: int64(binary.BigEndian.Uint64(packet[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(packet[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(packet[72:80])),
+		Event:      tracker.Event(binary.BigEndian.Uint32(packet[80:84])),
+		Key:        binary.BigEndian.Uint32(packet[88:92]),
+		NumWant:    int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		Port:       int(binary.BigEndian.Uint16(packet[96:98])),
+	}
+	copy(request.InfoHash[:], packet[16:36])
+	copy(request.PeerId[:], packet[36:56])
+	if request.Event > tracker.EventStopped {
+		return udpError(transactionId, "invalid event")
+	}
+
+	// peers of the other address family can't be sent in this response
+	ip, ipLength := addr.IP.To4(), net.IPv4len
+	if ip == nil {
+		ip, ipLength = addr.IP.To16(), net.IPv6len
+	}
+
+	response, err := s.Announce(request, ip)
+	if err != nil {
+		var failure *tracker.FailureError
+		if errors.As(err, &failure) {
+			return udpError(transactionId, failure.Reason)
+		}
+		return udpError(transactionId, err.Error())
+	}
+
+	reply := udpHeader(actionAnnounce, transactionId)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(response.Interval))
+	reply = binary.BigEndian.AppendUint32(reply, uint32(response.Incomplete))
+	reply = binary.BigEndian.AppendUint32(reply, uint32(response.Complete))
+	for _, peer := range response.Peers {
+		peerIp := peer.IP.To4()
+		if ipLength == net.IPv6len {
+			if peerIp != nil {
+				continue
+			}
+			peerIp = peer.IP.To16()
+		}
+		if peerIp == nil {
+			continue
+		}
+		reply = append(reply, peerIp...)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(peer.Port))
+	}
+	return reply
+}
+
+func (s *Server) handleUdpScrape(packet []byte, transactionId uint32) []byte {
+	// scrape requests can't carry url data, so there is no way to check a passkey
+	if s.passkeys != nil {
+		return udpError(transactionId, "scrape needs a passkey, use http")
+	}
+
+	hashes := packet[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > maxScrapeHashes {
+		return udpError(transactionId, "invalid scrape request")
+	}
+
+	infoHashes := make([][20]byte, len(hashes)/20)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], hashes[i*20:])
+	}
+	results := map[[20]byte]tracker.ScrapeResult{}
+	for _, result := range s.Scrape(infoHashes) {
+		results[result.InfoHash] = result
+	}
+
+	// every asked torrent gets an entry, unknown ones are all zeros
+	reply := udpHeader(actionScrape, transactionId)
+	for _, infoHash := range infoHashes {
+		result := results[infoHash]
+		reply = binary.BigEndian.AppendUint32(reply, uint32(result.Complete))
+		reply = binary.BigEndian.AppendUint32(reply, uint32(result.Downloaded))
+		reply = binary.BigEndian.AppendUint32(reply, uint32(result.Incomplete))
+	}
+	return reply
+}
+
+// path and query sent in url data options, "/" when there are none
+func parseUrlData(options []byte) (string, bool) {
+	path := []byte{}
+	for len(options) > 0 {
+		switch options[0] {
+		case optionEndOfOptions:
+			options = nil
+		case optionNop:
+			options = options[1:]
+		case optionUrlData:
+			if len(options) < 2 || len(options) < 2+int(options[1]) {
+				return "", false
+			}
+			path = append(path, options[2:2+int(options[1])]...)
+			options = options[2+int(options[1]):]
+		default:
+			return "", false
+		}
+	}
+	if len(path) == 0 {
+		return "/", true
+	}
+
+	// query is not needed to route the request
+	route, _, _ := strings.Cut(string(path), "?")
+	return route, true
+}
+
+// connection ids are derived from the client ip so nothing has to be stored per client
+// the port is left out, clients may open a new socket for every request and keep using the id
+func (s *Server) connectionId(addr *net.UDPAddr, now time.Time) uint64 {
+	mac := hmac.New(sha1.New, s.udpSecret[:])
+	mac.Write(addr.IP.To16())
+	binary.Write(mac, binary.BigEndian, now.Unix()/int64(connectionIdWindow/time.Second))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (s *Server) validConnectionId(connectionId uint64, addr *net.UDPAddr) bool {
+	now := s.now()
+	return connectionId == s.connectionId(addr, now) || connectionId == s.connectionId(addr, now.Add(-connectionIdWindow))
+}
+
+func udpHeader(action, transactionId uint32) []byte {
+	header := binary.BigEndian.AppendUint32(nil, action)
+	return binary.BigEndian.AppendUint32(header, transactionId)
+}
+
+func udpError(transactionId uint32, message string) []byte {
+	return append(udpHeader(actionError, transactionId), message...)
+}
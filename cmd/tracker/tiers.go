@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/umair-hassan2/torrent-client/cmd/common"
+)
+
+// Tiers is the announce-list of a torrent - https://www.bittorrent.org/beps/bep_0012.html
+// trackers are shuffled inside their tier once, and a tracker which answers is moved to the front of it's tier
+type Tiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// announce-list takes precedence over announce when a torrent has both
+func NewTiers(announce string, announceList [][]string) *Tiers {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		urls := []string{}
+		for _, url := range tier {
+			if url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+		tiers = append(tiers, urls)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+	return &Tiers{tiers: tiers}
+}
+
+func (t *Tiers) Empty() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tiers) == 0
+}
+
+// copy of the tiers in their current order
+func (t *Tiers) Urls() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	urls := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		urls[i] = append([]string(nil), tier...)
+	}
+	return urls
+}
+
+// announce to the first working tracker of every tier, peers of all tiers are merged
+// interval of the result is the smallest one returned so no tracker is announced to too late,
+// min interval is the biggest one so no tracker is announced to too early
+func (t *Tiers) Announce(announce func(url string) (*TrackerResponse, error)) (*TrackerResponse, error) {
+	var result *TrackerResponse
+	var errs []error
+	seen := map[string]bool{}
+
+	for tierIndex, tier := range t.Urls() {
+		for _, url := range tier {
+			response, err := announce(url)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("tracker %q: %w", url, err))
+				continue
+			}
+
+			t.promote(tierIndex, url)
+			if result == nil {
+				result = NewTrackerResponse(response.Interval, nil)
+			}
+			result.Interval = min(result.Interval, response.Interval)
+			result.MinInterval = max(result.MinInterval, response.MinInterval)
+			result.Complete = max(result.Complete, response.Complete)
+			result.Incomplete = max(result.Incomplete, response.Incomplete)
+			for _, peer := range response.Peers {
+				address := common.PeerAdress(*peer)
+				if !seen[address] {
+					seen[address] = true
+					result.Peers = append(result.Peers, peer)
+				}
+			}
+			break
+		}
+	}
+
+	if result == nil {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("torrent has no trackers")
+		}
+		return nil, errors.Join(errs...)
+	}
+	return result, nil
+}
+
+// move a working tracker to the front of it's tier
+func (t *Tiers) promote(tierIndex int, url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tiers[tierIndex]
+	for i, current := range tier {
+		if current == url {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = url
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+func peerAt(port int) *types.Peer {
+	return &types.Peer{IP: net.ParseIP("10.0.0.1"), Port: port}
+}
+
+func TestNewTiers(t *testing.T) {
+	t.Run("announce is used without announce-list", func(t *testing.T) {
+		tiers := NewTiers("http://a/announce", nil)
+		assert.Equal(t, [][]string{{"http://a/announce"}}, tiers.Urls())
+	})
+
+	t.Run("announce-list takes precedence", func(t *testing.T) {
+		tiers := NewTiers("http://a/announce", [][]string{{"http://b"}, {}, {"http://c", "http://d"}})
+		urls := tiers.Urls()
+		require.Len(t, urls, 2)
+		assert.Equal(t, []string{"http://b"}, urls[0])
+		assert.ElementsMatch(t, []string{"http://c", "http://d"}, urls[1])
+	})
+
+	t.Run("no trackers", func(t *testing.T) {
+		tiers := NewTiers("", nil)
+		assert.True(t, tiers.Empty())
+		_, err := tiers.Announce(func(url string) (*TrackerResponse, error) {
+			return nil, fmt.Errorf("should not be called")
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestTiersAnnounce(t *testing.T) {
+	tiers := NewTiers("", [][]string{{"http://dead", "http://alive"}, {"http://second"}})
+	// make order deterministic, dead tracker first
+	tiers.tiers[0] = []string{"http://dead", "http://alive"}
+
+	calls := []string{}
+	response, err := tiers.Announce(func(url string) (*TrackerResponse, error) {
+		calls = append(calls, url)
+		switch url {
+		case "http://alive":
+			return NewTrackerResponse(1800, []*types.Peer{peerAt(1), peerAt(2)}), nil
+		case "http://second":
+			return NewTrackerResponse(900, []*types.Peer{peerAt(2), peerAt(3)}), nil
+		}
+		return nil, fmt.Errorf("connection refused")
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"http://dead", "http://alive", "http://second"}, calls)
+	assert.Equal(t, 900, response.Interval)
+	assert.Equal(t, []*types.Peer{peerAt(1), peerAt(2), peerAt(3)}, response.Peers)
+	// working tracker is promoted to the front of it's tier
+	assert.Equal(t, [][]string{{"http://alive", "http://dead"}, {"http://second"}}, tiers.Urls())
+
+	t.Run("all trackers down", func(t *testing.T) {
+		_, err := tiers.Announce(func(url string) (*TrackerResponse, error) {
+			return nil, fmt.Errorf("connection refused")
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestSilentUdpTrackerDoesNotHoldUpNextTier(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer silent.Close()
+	mock := newMockUdpTracker(t)
+
+	client := NewInteractiveUdpClient()
+	client.BaseTimeout = 20 * time.Millisecond
+	tiers := NewTiers("", [][]string{{"udp://" + silent.LocalAddr().String()}, {mock.url("/announce")}})
+	start := time.Now()
+	response, err := tiers.Announce(func(url string) (*TrackerResponse, error) {
+		return client.Announce(url, testAnnounceRequest())
+	})
+	require.NoError(t, err)
+	assert.Len(t, response.Peers, 2)
+	// 20+40+80ms, the whole BEP 15 schedule would take 20ms*511
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, interactiveRetries, DefaultUdpClient.MaxRetries)
+}
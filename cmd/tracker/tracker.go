@@ -2,56 +2,83 @@ package tracker
 
 import (
 	"fmt"
-	"io"
-	"net/http"
 
 	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
 	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
-type Tracker struct {
-	url string
+// FailureError is returned when the tracker answers with an error instead of peers
+type FailureError struct {
+	Reason string
 }
 
-func NewTracker(url string) *Tracker {
-	return &Tracker{
-		url: url,
-	}
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
+
+// StatusError is returned when an http tracker answers with a status other than 200
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request failed with status code: %d", e.StatusCode)
+}
+
+// MalformedResponseError is returned when the tracker response can't be understood
+type MalformedResponseError struct {
+	Err error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed tracker response: %v", e.Err)
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
 }
 
 type TrackerResponse struct {
-	Interval int
-	Peers    []*types.Peer
+	Interval    int // seconds to wait between regular announces
+	MinInterval int // announces must never be more frequent than this, 0 if tracker has no limit
+	Peers       []*types.Peer
+	Complete    int    // seeders in the swarm
+	Incomplete  int    // leechers in the swarm
+	Warning     string // announce succeeded but the tracker wants us to know something
+	TrackerId   string // must be sent back with the next announces to the same tracker
 }
 
 func GetTrackerResponse(trackerUrl string) (*TrackerResponse, error) {
-	resp, err := http.Get(trackerUrl)
+	body, err := httpGet(trackerUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return ParseHttpResponse(body)
+}
 
+// parse the body of an http announce response
+func ParseHttpResponse(body []byte) (*TrackerResponse, error) {
 	parserResponse, err := torrent_file.ParseTrackerResponse(string(body))
-
 	if err != nil {
-		return nil, err
+		return nil, &MalformedResponseError{Err: err}
+	}
+	if parserResponse.FailureReason != "" {
+		return nil, &FailureError{Reason: parserResponse.FailureReason}
 	}
 
 	peers, err := parserResponse.GetRemotePeers()
 	if err != nil {
-		return nil, err
+		return nil, &MalformedResponseError{Err: err}
 	}
 
-	return NewTrackerResponse(parserResponse.Interval, peers), nil
+	trackerResponse := NewTrackerResponse(parserResponse.Interval, peers)
+	trackerResponse.MinInterval = parserResponse.MinInterval
+	trackerResponse.Complete = parserResponse.Complete
+	trackerResponse.Incomplete = parserResponse.Incomplete
+	trackerResponse.Warning = parserResponse.WarningMessage
+	trackerResponse.TrackerId = parserResponse.TrackerId
+	return trackerResponse, nil
 }
 
 func NewTrackerResponse(interval int, peers []*types.Peer) *TrackerResponse {
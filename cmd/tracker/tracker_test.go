@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/bencode"
+)
+
+func TestParseHttpResponse(t *testing.T) {
+	t.Run("compact peers", func(t *testing.T) {
+		body, _ := bencode.Marshal(map[string]any{
+			"interval":        1800,
+			"min interval":    60,
+			"complete":        7,
+			"incomplete":      3,
+			"tracker id":      "abc",
+			"warning message": "slow down",
+			"peers":           "\x0a\x00\x00\x01\x1a\xe1",
+			"peers6":          "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2",
+		})
+		response, err := ParseHttpResponse(body)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1800, response.Interval)
+		assert.Equal(t, 60, response.MinInterval)
+		assert.Equal(t, 7, response.Complete)
+		assert.Equal(t, 3, response.Incomplete)
+		assert.Equal(t, "abc", response.TrackerId)
+		assert.Equal(t, "slow down", response.Warning)
+		require.Len(t, response.Peers, 2)
+		assert.Equal(t, "10.0.0.1", response.Peers[0].IP.String())
+		assert.Equal(t, 6881, response.Peers[0].Port)
+		assert.Equal(t, "2001:db8::1", response.Peers[1].IP.String())
+		assert.Equal(t, 6882, response.Peers[1].Port)
+	})
+
+	t.Run("dictionary peers", func(t *testing.T) {
+		body, _ := bencode.Marshal(map[string]any{
+			"interval": 1800,
+			"peers": []any{
+				map[string]any{"peer id": "peer-id-012345678901", "ip": "10.0.0.1", "port": 6881},
+				map[string]any{"peer id": "peer-id-012345678902", "ip": "::1", "port": 6882},
+				map[string]any{"peer id": "peer-id-012345678903", "ip": "tracker.local", "port": 6883},
+			},
+		})
+		response, err := ParseHttpResponse(body)
+		require.NoError(t, err)
+
+		require.Len(t, response.Peers, 2)
+		assert.Equal(t, "peer-id-012345678901", response.Peers[0].ID)
+		assert.Equal(t, "10.0.0.1", response.Peers[0].IP.String())
+		assert.Equal(t, "::1", response.Peers[1].IP.String())
+	})
+
+	t.Run("no peers", func(t *testing.T) {
+		response, err := ParseHttpResponse([]byte("d8:intervali1800e5:peers0:e"))
+		require.NoError(t, err)
+		assert.Empty(t, response.Peers)
+	})
+
+	t.Run("failure reason", func(t *testing.T) {
+		_, err := ParseHttpResponse([]byte("d14:failure reason9:forbiddene"))
+		var failure *FailureError
+		require.True(t, errors.As(err, &failure))
+		assert.Equal(t, "forbidden", failure.Reason)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, body := range []string{"<html>", "d8:intervali1800e5:peers5:abcdee"} {
+			_, err := ParseHttpResponse([]byte(body))
+			var malformed *MalformedResponseError
+			assert.True(t, errors.As(err, &malformed), body)
+		}
+	})
+}
+
+func TestHttpStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := Announce(server.URL+"/announce", testAnnounceRequest())
+	var status *StatusError
+	require.True(t, errors.As(err, &status))
+	assert.Equal(t, http.StatusNotFound, status.StatusCode)
+}
+
+func TestBuildAnnounceUrlTrackerId(t *testing.T) {
+	request := testAnnounceRequest()
+	request.TrackerId = "abc"
+	announceUrl, err := BuildAnnounceUrl("http://tracker.local/announce", request)
+	require.NoError(t, err)
+	assert.Contains(t, announceUrl, "trackerid=abc")
+}
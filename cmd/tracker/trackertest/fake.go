@@ -0,0 +1,130 @@
+// Package trackertest provides an in-memory tracker whose answers follow a script
+package trackertest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+// one scripted answer to an announce
+type Step struct {
+	Response *tracker.TrackerResponse
+	Err      error
+}
+
+// Fake is a tracker.Announcer which answers announces from a script
+// once the script runs out every announce gets Default, or an error when Default is nil
+type Fake struct {
+	Default *tracker.TrackerResponse
+	// answered to every scrape
+	ScrapeResults []tracker.ScrapeResult
+	ScrapeErr     error
+
+	mu       sync.Mutex
+	script   []Step
+	requests []tracker.AnnounceRequest
+	closed   bool
+}
+
+var _ tracker.Announcer = &Fake{}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+// add an answer to the script
+func (f *Fake) Respond(response *tracker.TrackerResponse) *Fake {
+	return f.push(Step{Response: response})
+}
+
+// add a failing announce to the script
+func (f *Fake) Fail(err error) *Fake {
+	return f.push(Step{Err: err})
+}
+
+func (f *Fake) push(step Step) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, step)
+	return f
+}
+
+func (f *Fake) Announce(request tracker.AnnounceRequest) (*tracker.TrackerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, fmt.Errorf("announce to closed tracker")
+	}
+
+	f.requests = append(f.requests, request)
+	if len(f.script) > 0 {
+		step := f.script[0]
+		f.script = f.script[1:]
+		return copyResponse(step.Response), step.Err
+	}
+	if f.Default == nil {
+		return nil, fmt.Errorf("fake tracker has nothing to answer")
+	}
+	return copyResponse(f.Default), nil
+}
+
+func (f *Fake) Scrape(infoHashes [][20]byte) ([]tracker.ScrapeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ScrapeErr != nil {
+		return nil, f.ScrapeErr
+	}
+
+	results := []tracker.ScrapeResult{}
+	for _, infoHash := range infoHashes {
+		for _, result := range f.ScrapeResults {
+			if result.InfoHash == infoHash {
+				results = append(results, result)
+			}
+		}
+	}
+	return results, nil
+}
+
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// every announce received so far
+func (f *Fake) Requests() []tracker.AnnounceRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]tracker.AnnounceRequest(nil), f.requests...)
+}
+
+func (f *Fake) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// Trackers maps announce urls to fakes, it's NewAnnouncer can be injected in place of tracker.New
+type Trackers map[string]*Fake
+
+func (t Trackers) NewAnnouncer(announceUrl string) (tracker.Announcer, error) {
+	fake, ok := t[announceUrl]
+	if !ok {
+		return nil, fmt.Errorf("no fake tracker for %q", announceUrl)
+	}
+	return fake, nil
+}
+
+// callers may change the response they got, the script must stay intact
+func copyResponse(response *tracker.TrackerResponse) *tracker.TrackerResponse {
+	if response == nil {
+		return nil
+	}
+	copied := *response
+	copied.Peers = append(copied.Peers[:0:0], response.Peers...)
+	return &copied
+}
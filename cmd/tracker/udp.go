@@ -0,0 +1,317 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+)
+
+// udp tracker protocol - https://www.bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolId = 0x41727101980
+
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+
+	// a connection id can be used for one minute after it was received
+	connectionIdLifetime = time.Minute
+	// most info hashes which fit in one scrape packet
+	maxScrapeHashes = 74
+
+	// url data option carrying path and query of the announce url - https://www.bittorrent.org/beps/bep_0041.html
+	optionUrlData = 0x2
+
+	// BEP 15 retransmits up to 8 times, a dead tracker takes about two hours to give up on
+	maxRetries = 8
+	// announces somebody waits for give up after 15+30+60 seconds, so the next tracker gets it's turn
+	interactiveRetries = 2
+)
+
+type udpConnection struct {
+	id       uint64
+	received time.Time
+}
+
+// UdpClient talks to udp trackers, connection ids are cached per tracker address
+type UdpClient struct {
+	// request n is retransmitted after BaseTimeout * 2^n, up to MaxRetries times
+	BaseTimeout time.Duration
+	MaxRetries  int
+
+	mu          sync.Mutex
+	connections map[string]udpConnection
+}
+
+// client retransmitting for as long as BEP 15 says
+func NewUdpClient() *UdpClient {
+	return &UdpClient{
+		BaseTimeout: 15 * time.Second,
+		MaxRetries:  maxRetries,
+		connections: map[string]udpConnection{},
+	}
+}
+
+// client with the timeouts of BEP 15 which gives up after a few attempts, a dead tracker
+// listed first would otherwise hold up the trackers after it for hours
+func NewInteractiveUdpClient() *UdpClient {
+	client := NewUdpClient()
+	client.MaxRetries = interactiveRetries
+	return client
+}
+
+var DefaultUdpClient = NewInteractiveUdpClient()
+
+func (c *UdpClient) Announce(announceUrl string, request AnnounceRequest) (*TrackerResponse, error) {
+	trackerUrl, conn, err := c.dial(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	numWant := int32(-1)
+	if request.NumWant > 0 {
+		numWant = int32(request.NumWant)
+	}
+
+	response, err := c.exchange(conn, actionAnnounce, func(connectionId uint64, transactionId uint32) []byte {
+		packet := make([]byte, 98)
+		binary.BigEndian.PutUint64(packet[0:8], connectionId)
+		binary.BigEndian.PutUint32(packet[8:12], actionAnnounce)
+		binary.BigEndian.PutUint32(packet[12:16], transactionId)
+		copy(packet[16:36], request.InfoHash[:])
+		copy(packet[36:56], request.PeerId[:])
+		binary.BigEndian.PutUint64(packet[56:64], uint64(request.Downloaded))
+		binary.BigEndian.PutUint64(packet[64:72], uint64(request.Left))
+		binary.BigEndian.PutUint64(packet[72:80], uint64(request.Uploaded))
+		binary.BigEndian.PutUint32(packet[80:84], uint32(request.Event))
+		// ip address 0 means the tracker uses the sender address
+		binary.BigEndian.PutUint32(packet[88:92], request.Key)
+		binary.BigEndian.PutUint32(packet[92:96], uint32(numWant))
+		binary.BigEndian.PutUint16(packet[96:98], uint16(request.Port))
+		return append(packet, urlDataOption(trackerUrl)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// action 4, transaction id 4, interval 4, leechers 4, seeders 4, then peers
+	if len(response) < 20 {
+		return nil, fmt.Errorf("udp announce response is too short")
+	}
+
+	// trackers reached over IPv6 answer with IPv6 peers
+	ipLength := net.IPv4len
+	if remote, ok := conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+		ipLength = net.IPv6len
+	}
+	peers, err := torrent_file.ParseCompactPeers(response[20:], ipLength)
+	if err != nil {
+		return nil, err
+	}
+
+	trackerResponse := NewTrackerResponse(int(binary.BigEndian.Uint32(response[8:12])), peers)
+	trackerResponse.Incomplete = int(binary.BigEndian.Uint32(response[12:16]))
+	trackerResponse.Complete = int(binary.BigEndian.Uint32(response[16:20]))
+	return trackerResponse, nil
+}
+
+func (c *UdpClient) Scrape(announceUrl string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > maxScrapeHashes {
+		return nil, fmt.Errorf("udp scrape needs between 1 and %d info hashes", maxScrapeHashes)
+	}
+
+	_, conn, err := c.dial(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	response, err := c.exchange(conn, actionScrape, func(connectionId uint64, transactionId uint32) []byte {
+		packet := make([]byte, 16, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(packet[0:8], connectionId)
+		binary.BigEndian.PutUint32(packet[8:12], actionScrape)
+		binary.BigEndian.PutUint32(packet[12:16], transactionId)
+		for _, infoHash := range infoHashes {
+			packet = append(packet, infoHash[:]...)
+		}
+		return packet
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// seeders 4, completed 4, leechers 4 for every info hash in the order they were asked for
+	if len(response) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("udp scrape response is too short")
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		offset := 8 + i*12
+		results[i] = ScrapeResult{
+			InfoHash:   infoHash,
+			Complete:   int(binary.BigEndian.Uint32(response[offset : offset+4])),
+			Downloaded: int(binary.BigEndian.Uint32(response[offset+4 : offset+8])),
+			Incomplete: int(binary.BigEndian.Uint32(response[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
+
+func (c *UdpClient) dial(announceUrl string) (*url.URL, net.Conn, error) {
+	trackerUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trackerUrl.Scheme != "udp" {
+		return nil, nil, fmt.Errorf("%q is not a udp tracker", announceUrl)
+	}
+
+	conn, err := net.Dial("udp", trackerUrl.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return trackerUrl, conn, nil
+}
+
+// BEP 41 sends path and query of the url, split in chunks of at most 255 bytes
+func urlDataOption(trackerUrl *url.URL) []byte {
+	data := trackerUrl.RequestURI()
+	if data == "/" {
+		return nil
+	}
+
+	option := []byte{}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), 255)]
+		data = data[len(chunk):]
+		option = append(option, optionUrlData, byte(len(chunk)))
+		option = append(option, chunk...)
+	}
+	return option
+}
+
+func (c *UdpClient) timeout(attempt int) time.Duration {
+	return c.BaseTimeout * time.Duration(1<<attempt)
+}
+
+// send a request built for the current connection id and wait for it's response
+// requests are retransmitted on timeout, and the connection id is renewed when it expires
+func (c *UdpClient) exchange(conn net.Conn, action uint32, build func(connectionId uint64, transactionId uint32) []byte) ([]byte, error) {
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		connectionId, err := c.connectionId(conn, &attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		transactionId := randomTransactionId()
+		_, err = conn.Write(build(connectionId, transactionId))
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := c.receive(conn, action, transactionId, c.timeout(attempt))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			var failure *FailureError
+			if errors.As(err, &failure) {
+				// connection id might be the reason, get a fresh one next time
+				c.forget(conn)
+			}
+			return nil, err
+		}
+		return response, nil
+	}
+	return nil, fmt.Errorf("udp tracker %s did not respond", conn.RemoteAddr())
+}
+
+// cached connection id of the tracker or a new one from a connect request
+// retransmissions of the connect request use up attempts of the caller
+func (c *UdpClient) connectionId(conn net.Conn, attempt *int) (uint64, error) {
+	address := conn.RemoteAddr().String()
+	c.mu.Lock()
+	cached, ok := c.connections[address]
+	c.mu.Unlock()
+	if ok && time.Since(cached.received) < connectionIdLifetime {
+		return cached.id, nil
+	}
+
+	for ; *attempt <= c.MaxRetries; *attempt++ {
+		transactionId := randomTransactionId()
+		packet := make([]byte, 16)
+		binary.BigEndian.PutUint64(packet[0:8], udpProtocolId)
+		binary.BigEndian.PutUint32(packet[8:12], actionConnect)
+		binary.BigEndian.PutUint32(packet[12:16], transactionId)
+		_, err := conn.Write(packet)
+		if err != nil {
+			return 0, err
+		}
+
+		response, err := c.receive(conn, actionConnect, transactionId, c.timeout(*attempt))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(response) < 16 {
+			return 0, fmt.Errorf("udp connect response is too short")
+		}
+
+		id := binary.BigEndian.Uint64(response[8:16])
+		c.mu.Lock()
+		c.connections[address] = udpConnection{id: id, received: time.Now()}
+		c.mu.Unlock()
+		return id, nil
+	}
+	return 0, fmt.Errorf("udp tracker %s did not respond", address)
+}
+
+func (c *UdpClient) forget(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.connections, conn.RemoteAddr().String())
+}
+
+// wait for the response with our transaction id, packets belonging to other requests are dropped
+func (c *UdpClient) receive(conn net.Conn, action, transactionId uint32, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionId {
+			continue
+		}
+
+		switch responseAction := binary.BigEndian.Uint32(buf[0:4]); responseAction {
+		case actionError:
+			return nil, &FailureError{Reason: string(buf[8:n])}
+		case action:
+			return append([]byte(nil), buf[:n]...), nil
+		default:
+			return nil, fmt.Errorf("udp tracker answered action %d to action %d", responseAction, action)
+		}
+	}
+}
+
+func randomTransactionId() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
@@ -0,0 +1,244 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// udp tracker stand-in, answers connect, announce and scrape requests
+type mockUdpTracker struct {
+	conn *net.UDPConn
+
+	mu            sync.Mutex
+	dropPackets   int  // number of incoming packets to ignore, simulates packet loss
+	strayResponse bool // answer with a wrong transaction id before the real answer
+	failure       string
+	connects      int
+	announces     [][]byte
+}
+
+const mockConnectionId = 0xdeadbeef
+
+// configure runs before the tracker starts serving
+func newMockUdpTracker(t *testing.T, configure ...func(m *mockUdpTracker)) *mockUdpTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	m := &mockUdpTracker{conn: conn}
+	for _, c := range configure {
+		c(m)
+	}
+	go m.serve()
+	return m
+}
+
+func (m *mockUdpTracker) connectCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connects
+}
+
+func (m *mockUdpTracker) announcePackets() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.announces...)
+}
+
+func (m *mockUdpTracker) url(path string) string {
+	return "udp://" + m.conn.LocalAddr().String() + path
+}
+
+func (m *mockUdpTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+
+		m.mu.Lock()
+		if m.dropPackets > 0 {
+			m.dropPackets--
+			m.mu.Unlock()
+			continue
+		}
+		m.mu.Unlock()
+
+		response := m.handle(packet)
+		if response == nil {
+			continue
+		}
+
+		m.mu.Lock()
+		if m.strayResponse {
+			stray := append([]byte(nil), response...)
+			binary.BigEndian.PutUint32(stray[4:8], binary.BigEndian.Uint32(response[4:8])+1)
+			m.conn.WriteToUDP(stray, addr)
+		}
+		m.mu.Unlock()
+		m.conn.WriteToUDP(response, addr)
+	}
+}
+
+func (m *mockUdpTracker) handle(packet []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := packet[12:16]
+
+	response := make([]byte, 8)
+	binary.BigEndian.PutUint32(response[0:4], action)
+	copy(response[4:8], transactionId)
+
+	if action == actionConnect {
+		if connectionId != udpProtocolId {
+			return nil
+		}
+		m.connects++
+		return binary.BigEndian.AppendUint64(response, mockConnectionId)
+	}
+
+	if connectionId != mockConnectionId {
+		return nil
+	}
+	if m.failure != "" {
+		binary.BigEndian.PutUint32(response[0:4], actionError)
+		return append(response, m.failure...)
+	}
+
+	switch action {
+	case actionAnnounce:
+		m.announces = append(m.announces, packet)
+		response = binary.BigEndian.AppendUint32(response, 1800) // interval
+		response = binary.BigEndian.AppendUint32(response, 3)    // leechers
+		response = binary.BigEndian.AppendUint32(response, 7)    // seeders
+		response = append(response, 10, 0, 0, 1, 0x1a, 0xe1)     // 10.0.0.1:6881
+		response = append(response, 10, 0, 0, 2, 0x1a, 0xe2)     // 10.0.0.2:6882
+	case actionScrape:
+		for i := 16; i+20 <= len(packet); i += 20 {
+			response = binary.BigEndian.AppendUint32(response, uint32(packet[i])) // seeders
+			response = binary.BigEndian.AppendUint32(response, 100)               // completed
+			response = binary.BigEndian.AppendUint32(response, 5)                 // leechers
+		}
+	}
+	return response
+}
+
+func newTestUdpClient() *UdpClient {
+	client := NewUdpClient()
+	client.BaseTimeout = 20 * time.Millisecond
+	client.MaxRetries = 3
+	return client
+}
+
+func testAnnounceRequest() AnnounceRequest {
+	request := AnnounceRequest{Port: 6881, Left: 1000, Downloaded: 24, Uploaded: 12, Event: EventStarted, Key: 42}
+	copy(request.InfoHash[:], "info-hash-0123456789")
+	copy(request.PeerId[:], "peer-id-012345678901")
+	return request
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	mock := newMockUdpTracker(t)
+	client := newTestUdpClient()
+
+	response, err := client.Announce(mock.url("/announce?passkey=secret"), testAnnounceRequest())
+	require.NoError(t, err)
+
+	assert.Equal(t, 1800, response.Interval)
+	assert.Equal(t, 7, response.Complete)
+	assert.Equal(t, 3, response.Incomplete)
+	require.Len(t, response.Peers, 2)
+	assert.Equal(t, "10.0.0.1", response.Peers[0].IP.String())
+	assert.Equal(t, 6881, response.Peers[0].Port)
+	assert.Equal(t, 6882, response.Peers[1].Port)
+
+	announces := mock.announcePackets()
+	require.Len(t, announces, 1)
+	packet := announces[0]
+	assert.Equal(t, []byte("info-hash-0123456789"), packet[16:36])
+	assert.Equal(t, []byte("peer-id-012345678901"), packet[36:56])
+	assert.Equal(t, uint64(24), binary.BigEndian.Uint64(packet[56:64]))
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(packet[64:72]))
+	assert.Equal(t, uint64(12), binary.BigEndian.Uint64(packet[72:80]))
+	assert.Equal(t, uint32(EventStarted), binary.BigEndian.Uint32(packet[80:84]))
+	assert.Equal(t, uint16(6881), binary.BigEndian.Uint16(packet[96:98]))
+	// BEP 41 url data
+	urlData := "/announce?passkey=secret"
+	assert.Equal(t, append([]byte{optionUrlData, byte(len(urlData))}, urlData...), packet[98:])
+
+	t.Run("connection id is reused", func(t *testing.T) {
+		_, err := client.Announce(mock.url("/announce"), testAnnounceRequest())
+		require.NoError(t, err)
+		assert.Equal(t, 1, mock.connectCount())
+	})
+}
+
+func TestUdpRetransmission(t *testing.T) {
+	mock := newMockUdpTracker(t, func(m *mockUdpTracker) {
+		m.dropPackets = 2 // first connect and it's retransmission are lost
+	})
+	client := newTestUdpClient()
+
+	response, err := client.Announce(mock.url("/announce"), testAnnounceRequest())
+	require.NoError(t, err)
+	assert.Len(t, response.Peers, 2)
+}
+
+func TestUdpNoResponse(t *testing.T) {
+	mock := newMockUdpTracker(t, func(m *mockUdpTracker) { m.dropPackets = 100 })
+	client := newTestUdpClient()
+
+	_, err := client.Announce(mock.url("/announce"), testAnnounceRequest())
+	assert.Error(t, err)
+}
+
+func TestUdpStrayTransactionId(t *testing.T) {
+	mock := newMockUdpTracker(t, func(m *mockUdpTracker) { m.strayResponse = true })
+	client := newTestUdpClient()
+
+	response, err := client.Announce(mock.url("/announce"), testAnnounceRequest())
+	require.NoError(t, err)
+	assert.Len(t, response.Peers, 2)
+}
+
+func TestUdpErrorAction(t *testing.T) {
+	mock := newMockUdpTracker(t, func(m *mockUdpTracker) { m.failure = "torrent not registered" })
+	client := newTestUdpClient()
+
+	_, err := client.Announce(mock.url("/announce"), testAnnounceRequest())
+	var failure *FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "torrent not registered", failure.Reason)
+}
+
+func TestUdpScrape(t *testing.T) {
+	mock := newMockUdpTracker(t)
+	client := newTestUdpClient()
+
+	results, err := client.Scrape(mock.url("/announce"), [][20]byte{{1}, {2}})
+	require.NoError(t, err)
+	assert.Equal(t, []ScrapeResult{
+		{InfoHash: [20]byte{1}, Complete: 1, Downloaded: 100, Incomplete: 5},
+		{InfoHash: [20]byte{2}, Complete: 2, Downloaded: 100, Incomplete: 5},
+	}, results)
+}
+
+func TestAnnounceSelectsProtocol(t *testing.T) {
+	_, err := Announce("wss://tracker.local/announce", testAnnounceRequest())
+	assert.Error(t, err)
+}
@@ -0,0 +1,594 @@
+package utp
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payload of a packet, the datagram stays below the usual mtu with room for the headers
+	packetSize = 1382
+	// bytes of data received but not read yet which we accept
+	receiveBuffer = 1 << 20
+	// packets received after a missing one which are kept until it arrives
+	maxOutOfOrder = 1024
+	// at most this many packets after ack_nr + 1 are selectively acked
+	maxSackBits = 256
+
+	minWindow     = packetSize
+	initialWindow = 4 * packetSize
+	maxWindow     = receiveBuffer
+
+	// LEDBAT: the queuing delay we aim for and how much the window grows per round trip at most
+	targetDelay       = 100 * time.Millisecond
+	maxWindowIncrease = 3000
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// consecutive timeouts of the same packet before the connection is given up
+	maxTimeouts = 5
+	// duplicate acks or packets acked after a missing one before it's resent without waiting for the timeout
+	duplicateAcks = 3
+
+	keepAliveInterval = 29 * time.Second
+)
+
+var (
+	errReset   = fmt.Errorf("uTP connection reset by peer")
+	errTimeout = fmt.Errorf("uTP connection timed out: %w", os.ErrDeadlineExceeded)
+)
+
+// packet we sent which wasn't acked yet
+type outPacket struct {
+	typ           uint8
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	// timed out and waiting for room in the window to be sent again
+	lost bool
+}
+
+// Conn is a uTP connection, a net.Conn
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvId uint16
+	sendId uint16
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// closed when the connection is established or failed to be
+	established chan struct{}
+	initiator   bool
+	connected   bool
+	// Close was called
+	closed bool
+	// why the connection broke, e.g. a reset
+	err error
+
+	// sending
+	seqNr      uint16
+	outgoing   []*outPacket
+	inFlight   int     // payload bytes sent and not acked
+	window     float64 // congestion window in bytes
+	peerWindow int
+	lastAckNr  uint16
+	dupAcks    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	lastSent   time.Time
+	delays     delayHistory
+
+	// receiving
+	ackNr      uint16
+	readBuf    []byte
+	outOfOrder map[uint16]*packet
+	eof        bool
+	// echoed in timestamp_difference, the one way delay of the last packet of the peer
+	replyDelay uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvId, sendId uint16) *Conn {
+	c := &Conn{
+		s:           s,
+		raddr:       raddr,
+		recvId:      recvId,
+		sendId:      sendId,
+		established: make(chan struct{}),
+		window:      initialWindow,
+		peerWindow:  initialWindow,
+		rto:         initialTimeout,
+		outOfOrder:  make(map[uint16]*packet),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// send the SYN of a connection we open, c.mu is held
+func (c *Conn) connect() {
+	c.initiator = true
+	c.seqNr = 1
+	c.queue(stSyn, nil, time.Now())
+}
+
+// answer the SYN of a connection a peer opened, our first sequence number is random
+// the STATE doesn't use it up, it's the number of our first data packet, c.mu is held
+func (c *Conn) accept(syn *packet) {
+	now := time.Now()
+	c.seqNr = uint16(rand.Intn(1 << 16))
+	c.ackNr = syn.seqNr
+	c.lastAckNr = c.seqNr - 1
+	c.peerWindow = int(syn.wndSize)
+	c.replyDelay = timestamp(now) - syn.timestamp
+	c.connected = true
+	close(c.established)
+	c.sendState(now)
+}
+
+func (c *Conn) receive(p *packet) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	c.replyDelay = timestamp(now) - p.timestamp
+	c.peerWindow = int(p.wndSize)
+
+	switch {
+	case p.typ == stReset:
+		c.failLocked(errReset)
+	case p.typ == stSyn:
+		// our STATE was lost
+		if !c.initiator {
+			c.sendState(now)
+		}
+	case !c.connected && p.typ != stState:
+		// nothing but the STATE answering our SYN tells the sequence number of the peer
+	default:
+		if !c.connected {
+			c.connected = true
+			c.ackNr = p.seqNr - 1
+			close(c.established)
+		}
+		c.handleAck(p, now)
+		if p.typ == stData || p.typ == stFin {
+			c.handleData(p)
+			c.sendState(now)
+		}
+	}
+	c.cond.Broadcast()
+	done := c.finished()
+	c.mu.Unlock()
+	if done {
+		c.s.remove(c)
+	}
+}
+
+// selective ack bit of seq in a packet of the peer
+func sacked(p *packet, seq uint16) bool {
+	i := int(seq - p.ackNr - 2)
+	if i >= len(p.sack)*8 {
+		return false
+	}
+	return p.sack[i/8]&(1<<(i%8)) != 0
+}
+
+func (c *Conn) handleAck(p *packet, now time.Time) {
+	// acks of packets we didn't send yet are bogus
+	if seqLess(c.seqNr-1, p.ackNr) {
+		return
+	}
+
+	ackedBytes, ackedPackets, sackedAfter := 0, 0, 0
+	rttSample := time.Duration(-1)
+	kept := c.outgoing[:0]
+	for _, op := range c.outgoing {
+		if seqLess(p.ackNr, op.seqNr) && !sacked(p, op.seqNr) {
+			kept = append(kept, op)
+			continue
+		}
+		if seqLess(p.ackNr, op.seqNr) {
+			sackedAfter++
+		}
+		ackedPackets++
+		ackedBytes += len(op.payload)
+		if !op.lost {
+			c.inFlight -= len(op.payload)
+		}
+		// round trips of resent packets are ambiguous
+		if op.transmissions == 1 {
+			rttSample = now.Sub(op.sentAt)
+		}
+	}
+	clear(c.outgoing[len(kept):])
+	c.outgoing = kept
+
+	if rttSample >= 0 {
+		c.updateRtt(rttSample)
+	}
+	if ackedPackets > 0 {
+		c.timeouts = 0
+		if p.timestampDiff != 0 {
+			c.congestion(p.timestampDiff, ackedBytes, now)
+		}
+	}
+
+	// the first packet not acked is lost when later ones keep being acked
+	if p.ackNr == c.lastAckNr && p.typ == stState && len(c.outgoing) > 0 {
+		c.dupAcks++
+	} else if p.ackNr != c.lastAckNr {
+		c.dupAcks = 0
+	}
+	c.lastAckNr = p.ackNr
+	if len(c.outgoing) > 0 && (c.dupAcks == duplicateAcks || sackedAfter >= duplicateAcks) {
+		c.dupAcks = 0
+		c.window = max(c.window/2, minWindow)
+		first := c.outgoing[0]
+		if first.lost {
+			first.lost = false
+			c.inFlight += len(first.payload)
+		}
+		c.transmit(first, now)
+	}
+	c.flush(now)
+}
+
+// keep the payload of data packets in order, data after a FIN is dropped
+func (c *Conn) handleData(p *packet) {
+	if c.eof || !seqLess(c.ackNr, p.seqNr) || p.seqNr-c.ackNr > maxOutOfOrder {
+		return
+	}
+	c.outOfOrder[p.seqNr] = p
+	for {
+		next, ok := c.outOfOrder[c.ackNr+1]
+		if !ok {
+			return
+		}
+		delete(c.outOfOrder, c.ackNr+1)
+		c.ackNr++
+		if next.typ == stFin {
+			c.eof = true
+			clear(c.outOfOrder)
+			return
+		}
+		c.readBuf = append(c.readBuf, next.payload...)
+	}
+}
+
+// LEDBAT, the window grows while the queuing delay is below the target and shrinks above it
+func (c *Conn) congestion(delay uint32, ackedBytes int, now time.Time) {
+	c.delays.add(delay, now)
+	queuing := time.Duration(delay-c.delays.base()) * time.Microsecond
+	offTarget := max(float64(targetDelay-queuing)/float64(targetDelay), -1)
+	windowFactor := float64(ackedBytes) / max(c.window, float64(ackedBytes))
+	c.window += maxWindowIncrease * offTarget * windowFactor
+	c.window = min(max(c.window, minWindow), maxWindow)
+}
+
+func (c *Conn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, minTimeout)
+}
+
+// true when n more bytes fit into the windows, there's always room for one packet
+func (c *Conn) windowOpen(n int) bool {
+	return c.inFlight == 0 || c.inFlight+n <= min(int(c.window), c.peerWindow)
+}
+
+// send a new packet, it's kept until it's acked
+func (c *Conn) queue(typ uint8, payload []byte, now time.Time) {
+	op := &outPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	c.outgoing = append(c.outgoing, op)
+	c.inFlight += len(payload)
+	c.transmit(op, now)
+}
+
+// send the lost packets which fit into the window again
+func (c *Conn) flush(now time.Time) {
+	for _, op := range c.outgoing {
+		if !op.lost {
+			continue
+		}
+		if !c.windowOpen(len(op.payload)) {
+			return
+		}
+		op.lost = false
+		c.inFlight += len(op.payload)
+		c.transmit(op, now)
+	}
+}
+
+func (c *Conn) transmit(op *outPacket, now time.Time) {
+	connId := c.sendId
+	if op.typ == stSyn {
+		connId = c.recvId
+	}
+	op.sentAt = now
+	op.transmissions++
+	c.lastSent = now
+	c.s.send(&packet{
+		typ:           op.typ,
+		connId:        connId,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDelay,
+		wndSize:       c.receiveWindow(),
+		seqNr:         op.seqNr,
+		ackNr:         c.ackNr,
+		payload:       op.payload,
+	}, c.raddr)
+}
+
+// ack what we received, the sequence number isn't used up
+func (c *Conn) sendState(now time.Time) {
+	c.lastSent = now
+	c.s.send(&packet{
+		typ:           stState,
+		connId:        c.sendId,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDelay,
+		wndSize:       c.receiveWindow(),
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+		sack:          c.sack(),
+	}, c.raddr)
+}
+
+func (c *Conn) receiveWindow() uint32 {
+	return uint32(max(receiveBuffer-len(c.readBuf), 0))
+}
+
+// bitmask of the packets received after the missing one, in multiples of 4 bytes
+func (c *Conn) sack() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	bits := make([]byte, maxSackBits/8)
+	last := -1
+	for seq := range c.outOfOrder {
+		i := int(seq - c.ackNr - 2)
+		if i < maxSackBits {
+			bits[i/8] |= 1 << (i % 8)
+			last = max(last, i)
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	return bits[:(last/32+1)*4]
+}
+
+// resend packets which weren't acked in time
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+
+	var oldest *outPacket
+	for _, op := range c.outgoing {
+		if !op.lost {
+			oldest = op
+			break
+		}
+	}
+	switch {
+	case oldest != nil && now.Sub(oldest.sentAt) > c.rto:
+		c.timeouts++
+		if c.timeouts > maxTimeouts {
+			c.failLocked(errTimeout)
+			break
+		}
+		// everything in flight is considered lost and resent as the window allows
+		c.rto = min(c.rto*2, maxTimeout)
+		c.window = minWindow
+		for _, op := range c.outgoing {
+			op.lost = true
+		}
+		c.inFlight = 0
+		c.flush(now)
+	case c.connected && now.Sub(c.lastSent) > keepAliveInterval:
+		c.sendState(now)
+	}
+	done := c.finished()
+	c.mu.Unlock()
+	if done {
+		c.s.remove(c)
+	}
+}
+
+// the socket forgets connections which broke or were closed with everything acked
+func (c *Conn) finished() bool {
+	return c.err != nil || (c.closed && len(c.outgoing) == 0)
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+	c.s.remove(c)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	select {
+	case <-c.established:
+	default:
+		close(c.established)
+	}
+	c.outgoing = nil
+	c.inFlight = 0
+	c.cond.Broadcast()
+}
+
+// wait for a change of the connection until the deadline, c.mu is held
+func (c *Conn) wait(deadline time.Time) {
+	if deadline.IsZero() {
+		c.cond.Wait()
+		return
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	c.cond.Wait()
+	timer.Stop()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.readBuf) > 0:
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.readDeadline)
+	}
+}
+
+// Write returns once the data is sent, it waits for room in the window
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), packetSize)
+		switch {
+		case c.closed:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		case c.connected && c.windowOpen(n):
+			c.queue(stData, append([]byte{}, b[:n]...), time.Now())
+			b = b[n:]
+			written += n
+			continue
+		case expired(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+		c.wait(c.writeDeadline)
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the data written, it doesn't wait for it to be acked
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	if c.err == nil && c.connected {
+		c.queue(stFin, nil, time.Now())
+	}
+	c.cond.Broadcast()
+	done := c.finished()
+	c.mu.Unlock()
+	if done {
+		c.s.remove(c)
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// minimum of the one way delays in the last two minutes, the base the queuing delay is measured from
+// the clocks of the peers differ, the delays only make sense relative to each other
+type delayHistory struct {
+	start    time.Time
+	current  uint32
+	previous uint32
+}
+
+func (d *delayHistory) add(delay uint32, now time.Time) {
+	switch {
+	case d.start.IsZero():
+		d.start, d.current, d.previous = now, delay, delay
+	case now.Sub(d.start) >= time.Minute:
+		d.start, d.previous, d.current = now, d.current, delay
+	case int32(delay-d.current) < 0:
+		d.current = delay
+	}
+}
+
+func (d *delayHistory) base() uint32 {
+	if int32(d.previous-d.current) < 0 {
+		return d.previous
+	}
+	return d.current
+}
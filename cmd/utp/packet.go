@@ -0,0 +1,116 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// packet types
+const (
+	stData  uint8 = 0
+	stFin   uint8 = 1
+	stState uint8 = 2
+	stReset uint8 = 3
+	stSyn   uint8 = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// extension carrying selective acks
+	extensionSack = 1
+)
+
+// uTP packet:
+//
+//	0       4       8               16              24              32
+//	+-------+-------+---------------+---------------+---------------+
+//	| type  | ver   | extension     | connection_id                 |
+//	+-------+-------+---------------+---------------+---------------+
+//	| timestamp_microseconds                                        |
+//	+---------------+---------------+---------------+---------------+
+//	| timestamp_difference_microseconds                             |
+//	+---------------+---------------+---------------+---------------+
+//	| wnd_size                                                      |
+//	+---------------+---------------+---------------+---------------+
+//	| seq_nr                        | ack_nr                        |
+//	+---------------+---------------+---------------+---------------+
+//
+// followed by a linked list of extensions and the payload
+type packet struct {
+	typ           uint8
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// bitmask of packets received after ack_nr + 1, bit 0 is ack_nr + 2
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	buf := make([]byte, headerSize, headerSize+2+len(p.sack)+len(p.payload))
+	buf[0] = p.typ<<4 | version
+	if len(p.sack) > 0 {
+		buf[1] = extensionSack
+	}
+	binary.BigEndian.PutUint16(buf[2:], p.connId)
+	binary.BigEndian.PutUint32(buf[4:], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], p.wndSize)
+	binary.BigEndian.PutUint16(buf[16:], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:], p.ackNr)
+	if len(p.sack) > 0 {
+		buf = append(buf, 0, byte(len(p.sack)))
+		buf = append(buf, p.sack...)
+	}
+	return append(buf, p.payload...)
+}
+
+// true for datagrams which look like uTP, anything else on the socket is someone else's traffic
+func isPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if !isPacket(b) {
+		return nil, fmt.Errorf("not a uTP packet")
+	}
+	p := &packet{
+		typ:           b[0] >> 4,
+		connId:        binary.BigEndian.Uint16(b[2:]),
+		timestamp:     binary.BigEndian.Uint32(b[4:]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:]),
+		wndSize:       binary.BigEndian.Uint32(b[12:]),
+		seqNr:         binary.BigEndian.Uint16(b[16:]),
+		ackNr:         binary.BigEndian.Uint16(b[18:]),
+	}
+
+	// every extension starts with the type of the next one and it's length
+	extension, rest := b[1], b[headerSize:]
+	for extension != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("truncated extension %d", extension)
+		}
+		next, length := rest[0], int(rest[1])
+		if extension == extensionSack {
+			p.sack = rest[2 : 2+length]
+		}
+		extension, rest = next, rest[2+length:]
+	}
+	p.payload = rest
+	return p, nil
+}
+
+// microseconds of a clock shared by every connection, it wraps around like the header field
+func timestamp(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
+
+// sequence numbers wrap around, a is before b when it is less than half the space behind
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
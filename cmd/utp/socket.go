@@ -0,0 +1,346 @@
+// Package utp implements the micro transport protocol, reliable streams over udp which yield to other traffic
+// https://www.bittorrent.org/beps/bep_0029.html
+package utp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how often connections look for timed out packets
+	tickInterval = 50 * time.Millisecond
+	// connections not accepted yet, SYNs beyond these are reset
+	acceptBacklog = 32
+	// datagrams of other protocols waiting to be read from PacketConn
+	otherBacklog = 256
+	maxDatagram  = 64 * 1024
+)
+
+// connections are told apart by the address of the peer and the id their packets carry
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Socket multiplexes uTP connections over one udp socket, it's both the listener and the dialer
+// datagrams which aren't uTP are handed to the view returned by PacketConn, e.g. for the dht
+type Socket struct {
+	pc net.PacketConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	accepted chan *Conn
+	other    chan datagram
+	view     *packetConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// listen on a udp address such as ":6881"
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// run uTP on a socket which is already open, the socket is closed with the returned one
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:       pc,
+		conns:    make(map[connKey]*Conn),
+		accepted: make(chan *Conn, acceptBacklog),
+		other:    make(chan datagram, otherBacklog),
+		closed:   make(chan struct{}),
+	}
+	s.view = &packetConn{s: s, closed: make(chan struct{})}
+	go s.read()
+	go s.tick()
+	return s
+}
+
+// Accept waits for the next connection a peer opened to us
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// close the socket with every connection on it
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.mu.Unlock()
+		for _, conn := range conns {
+			conn.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// PacketConn is the socket for every other protocol, it reads the datagrams which aren't uTP
+// closing it only stops the reads, the socket stays open for uTP
+func (s *Socket) PacketConn() net.PacketConn {
+	return s.view
+}
+
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, 0)
+}
+
+// open a connection to a peer, a zero timeout waits until the SYN is given up on
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	// we receive on id and send on id + 1, both have to be free
+	var id uint16
+	for {
+		id = uint16(rand.Intn(1 << 16))
+		_, taken := s.conns[connKey{raddr.String(), id}]
+		_, takenNext := s.conns[connKey{raddr.String(), id + 1}]
+		if !taken && !takenNext {
+			break
+		}
+	}
+	conn := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = conn
+	s.mu.Unlock()
+
+	conn.mu.Lock()
+	conn.connect()
+	conn.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-conn.established:
+		conn.mu.Lock()
+		err = conn.err
+		conn.mu.Unlock()
+	case <-expired:
+		err = fmt.Errorf("dial %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+	if err != nil {
+		conn.fail(err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socket) read() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		data := append([]byte{}, buf[:n]...)
+		if !isPacket(data) {
+			select {
+			case s.other <- datagram{data, addr}:
+			default:
+				// nobody reads them fast enough, udp may drop them anyway
+			}
+			continue
+		}
+		p, err := parsePacket(data)
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, addr)
+	}
+}
+
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	s.mu.Lock()
+	var conn *Conn
+	switch p.typ {
+	case stSyn:
+		// a SYN carries the id the peer receives on, we receive on the one after it
+		key := connKey{addr.String(), p.connId + 1}
+		conn = s.conns[key]
+		if conn == nil {
+			conn = s.acceptSyn(key, p, addr)
+		}
+	case stReset:
+		// resets of connections the peer doesn't know carry the id we send on
+		for _, id := range []uint16{p.connId, p.connId - 1, p.connId + 1} {
+			candidate := s.conns[connKey{addr.String(), id}]
+			if candidate != nil && (id == p.connId || candidate.sendId == p.connId) {
+				conn = candidate
+				break
+			}
+		}
+	default:
+		conn = s.conns[connKey{addr.String(), p.connId}]
+	}
+	s.mu.Unlock()
+
+	switch {
+	case conn != nil:
+		conn.receive(p)
+	case p.typ != stReset && p.typ != stSyn:
+		s.send(&packet{typ: stReset, connId: p.connId, ackNr: p.seqNr, timestamp: timestamp(time.Now())}, addr)
+	}
+}
+
+// start a connection for a SYN, s.mu is held
+func (s *Socket) acceptSyn(key connKey, p *packet, addr net.Addr) *Conn {
+	if len(s.accepted) == cap(s.accepted) {
+		s.send(&packet{typ: stReset, connId: p.connId, ackNr: p.seqNr, timestamp: timestamp(time.Now())}, addr)
+		return nil
+	}
+	conn := newConn(s, addr, key.id, p.connId)
+	conn.accept(p)
+	s.conns[key] = conn
+	s.accepted <- conn
+	// the SYN was handled by accept
+	return nil
+}
+
+func (s *Socket) remove(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{conn.raddr.String(), conn.recvId}
+	if s.conns[key] == conn {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) error {
+	_, err := s.pc.WriteTo(p.marshal(), addr)
+	return err
+}
+
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, conn := range s.conns {
+				conns = append(conns, conn)
+			}
+			s.mu.Unlock()
+			for _, conn := range conns {
+				conn.tick(now)
+			}
+		}
+	}
+}
+
+// view of the socket for the datagrams which aren't uTP
+type packetConn struct {
+	s *Socket
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.deadline
+	p.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case d := <-p.s.other:
+		return copy(b, d.data), d.addr, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-p.s.closed:
+		return 0, nil, net.ErrClosed
+	case <-expired:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.s.pc.WriteTo(b, addr)
+}
+
+func (p *packetConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.s.pc.LocalAddr()
+}
+
+func (p *packetConn) SetDeadline(t time.Time) error {
+	p.SetWriteDeadline(t)
+	return p.SetReadDeadline(t)
+}
+
+// the deadline applies to reads started after it was set
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	return nil
+}
+
+func (p *packetConn) SetWriteDeadline(t time.Time) error {
+	return p.s.pc.SetWriteDeadline(t)
+}
@@ -0,0 +1,232 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listen(t *testing.T) *Socket {
+	s, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// a connection dialed from one socket and accepted by another
+func connPair(t *testing.T, dialer, listener *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, err := listener.Accept()
+		if err == nil {
+			accepted <- con
+		}
+		close(accepted)
+	}()
+	dialed, err := dialer.DialTimeout(listener.Addr().String(), 5*time.Second)
+	require.NoError(t, err)
+	remote := <-accepted
+	require.NotNil(t, remote)
+
+	t.Cleanup(func() { dialed.Close(); remote.Close() })
+	dialed.SetDeadline(time.Now().Add(20 * time.Second))
+	remote.SetDeadline(time.Now().Add(20 * time.Second))
+	return dialed, remote
+}
+
+func randomData(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+// send data one way while reading it on the other end
+func transfer(t *testing.T, from, to net.Conn, data []byte) {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		errs <- err
+	}()
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(to, received)
+	require.NoError(t, err)
+	require.NoError(t, <-errs)
+	assert.True(t, bytes.Equal(data, received), "data arrives intact and in order")
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := &packet{
+		typ: stState, connId: 7, timestamp: 1, timestampDiff: 2, wndSize: 3,
+		seqNr: 4, ackNr: 5, sack: []byte{1, 0, 0, 0}, payload: []byte("payload"),
+	}
+	parsed, err := parsePacket(p.marshal())
+	require.NoError(t, err)
+	assert.Equal(t, p, parsed)
+
+	_, err = parsePacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"))
+	assert.Error(t, err, "dht messages aren't uTP")
+	truncated := p.marshal()[:headerSize+1]
+	_, err = parsePacket(truncated)
+	assert.Error(t, err)
+}
+
+func TestSequenceNumbersWrap(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.True(t, seqLess(65535, 0))
+	assert.False(t, seqLess(0, 65535))
+	assert.False(t, seqLess(3, 3))
+}
+
+func TestTransferBothWays(t *testing.T) {
+	dialed, remote := connPair(t, listen(t), listen(t))
+	transfer(t, dialed, remote, randomData(t, 1<<20))
+	transfer(t, remote, dialed, randomData(t, 100_000))
+}
+
+func TestCloseGivesEOF(t *testing.T) {
+	dialed, remote := connPair(t, listen(t), listen(t))
+	_, err := dialed.Write([]byte("last words"))
+	require.NoError(t, err)
+	require.NoError(t, dialed.Close())
+
+	received, err := io.ReadAll(remote)
+	require.NoError(t, err)
+	assert.Equal(t, "last words", string(received))
+
+	_, err = dialed.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestReadDeadline(t *testing.T) {
+	dialed, _ := connPair(t, listen(t), listen(t))
+	dialed.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestDialTimesOut(t *testing.T) {
+	// a udp socket which never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+
+	start := time.Now()
+	_, err = listen(t).DialTimeout(silent.LocalAddr().String(), 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestResetForUnknownConnection(t *testing.T) {
+	dialer, listener := listen(t), listen(t)
+	dialed, remote := connPair(t, dialer, listener)
+	// the listener forgets the connection, the next packet is answered with a reset
+	listener.remove(remote.(*Conn))
+
+	_, err := dialed.Write([]byte("anyone there?"))
+	require.NoError(t, err)
+	_, err = dialed.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, errReset)
+}
+
+// connection which drops some of the uTP packets it sends
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	sent int
+	// every nth packet is dropped
+	every int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent++
+	drop := isPacket(b) && c.sent%c.every == 0
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func lossySocket(t *testing.T, every int) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewSocket(&lossyConn{PacketConn: pc, every: every})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestLostPacketsAreResent(t *testing.T) {
+	dialed, remote := connPair(t, lossySocket(t, 7), lossySocket(t, 5))
+	transfer(t, dialed, remote, randomData(t, 200_000))
+	transfer(t, remote, dialed, randomData(t, 50_000))
+}
+
+func TestOtherTrafficOnTheSameSocket(t *testing.T) {
+	s, listener := listen(t), listen(t)
+	dialed, remote := connPair(t, s, listener)
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer other.Close()
+	ping := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	_, err = other.WriteTo(ping, s.Addr())
+	require.NoError(t, err)
+
+	pc := s.PacketConn()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, ping, buf[:n])
+	assert.Equal(t, other.LocalAddr().String(), from.String())
+
+	_, err = pc.WriteTo([]byte("d1:y1:re"), from)
+	require.NoError(t, err)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = other.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "d1:y1:re", string(buf[:n]))
+
+	// closing the view leaves uTP running
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(buf)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	transfer(t, dialed, remote, []byte("still connected"))
+}
+
+func TestDelayHistory(t *testing.T) {
+	start := time.Now()
+	d := delayHistory{}
+	d.add(500, start)
+	d.add(300, start.Add(time.Second))
+	d.add(400, start.Add(2*time.Second))
+	assert.Equal(t, uint32(300), d.base())
+
+	// the minimum of a minute is forgotten after two
+	d.add(700, start.Add(61*time.Second))
+	assert.Equal(t, uint32(300), d.base())
+	d.add(800, start.Add(122*time.Second))
+	assert.Equal(t, uint32(700), d.base())
+}
+
+func TestWindowShrinksAboveTargetDelay(t *testing.T) {
+	c := newConn(nil, nil, 0, 1)
+	now := time.Now()
+	c.congestion(1000, packetSize, now)
+	grown := c.window
+	assert.Greater(t, grown, float64(initialWindow), "no queuing delay, the window grows")
+
+	c.congestion(1000+uint32(2*targetDelay/time.Microsecond), packetSize, now)
+	assert.Less(t, c.window, grown)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/p2p"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+)
+
+// flag which can be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runCreate(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: <name>.torrent)")
+	announce := flags.String("a", "", "announce url of the main tracker")
+	var tiers, webSeeds stringList
+	flags.Var(&tiers, "tier", "comma separated tracker urls forming one announce-list tier (repeatable)")
+	flags.Var(&webSeeds, "web-seed", "web seed url (repeatable)")
+	comment := flags.String("c", "", "comment")
+	createdBy := flags.String("created-by", p2p.ClientId, "value of the created by field")
+	private := flags.Bool("private", false, "mark torrent as private")
+	noDate := flags.Bool("no-date", false, "leave the creation date out")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, a power of two (default: picked from content size)")
+	workers := flags.Int("workers", 0, "number of hashing goroutines (default: one per cpu)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: torrent-client create [flags] <file or directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	opts := torrent_file.CreateOptions{
+		Path:        flags.Arg(0),
+		Announce:    *announce,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		PieceLength: *pieceLength,
+		Workers:     *workers,
+	}
+	for _, tier := range tiers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	// clients without announce-list support only read announce, so fall back to the first tracker
+	if opts.Announce == "" && len(opts.AnnounceList) > 0 {
+		opts.Announce = opts.AnnounceList[0][0]
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	data, err := torrent_file.Create(opts)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	err = os.WriteFile(*output, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s\n", *output)
+	return nil
+}
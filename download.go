@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/umair-hassan2/torrent-client/cmd/mse"
+	"github.com/umair-hassan2/torrent-client/cmd/p2p"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent"
+)
+
+func runDownload(args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	saveTorrent := flags.String("save-torrent", "", "save metadata fetched for a magnet link as a .torrent file at this path")
+	listenAddr := flags.String("listen", p2p.DefaultListenAddr, "tcp address other peers connect to us on")
+	dhtAddr := flags.String("dht-addr", p2p.DefaultDhtAddr, "udp address of the DHT node")
+	dhtState := flags.String("dht-state", p2p.DefaultDhtStatePath(), "file the DHT routing table is kept in between runs")
+	noDht := flags.Bool("no-dht", false, "find peers only through trackers and the magnet link")
+	noLsd := flags.Bool("no-lsd", false, "don't look for peers on the local network")
+	uploadSlots := flags.Int("upload-slots", torrent.DefaultUploadSlots, "peers unchoked for their rate, one more is unchoked optimistically")
+	encryption := flags.String("encryption", mse.PreferEncrypted.String(), "encryption of peer connections: plaintext, prefer or require")
+	noUtp := flags.Bool("no-utp", false, "connect to peers and accept them over tcp only")
+	seed := flags.Bool("seed", false, "keep uploading after the download finished, until interrupted")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: torrent-client download [flags] <file.torrent | magnet link>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	policy, err := mse.ParsePolicy(*encryption)
+	if err != nil {
+		return err
+	}
+
+	p2p.BeginWithOptions(flags.Arg(0), p2p.Options{
+		SaveTorrentPath: *saveTorrent,
+		ListenAddr:      *listenAddr,
+		DhtAddr:         *dhtAddr,
+		DhtStatePath:    *dhtState,
+		DisableDHT:      *noDht,
+		DisableLSD:      *noLsd,
+		Seed:            *seed,
+		UploadSlots:     *uploadSlots,
+		Encryption:      policy,
+		DisableUTP:      *noUtp,
+	})
+	return nil
+}
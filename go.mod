@@ -4,10 +4,7 @@ go 1.21.4
 
 toolchain go1.23.5
 
-require (
-	github.com/jackpal/bencode-go v1.0.2
-	github.com/stretchr/testify v1.10.0
-)
+require github.com/stretchr/testify v1.10.0
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -1,4 +1,42 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: torrent-client <command> [arguments]
+
+commands:
+  download       download a torrent from a .torrent file or a magnet link
+  create         create a .torrent file from a file or directory
+  scrape         print swarm statistics of .torrent files reported by their trackers
+  tracker-serve  run a tracker for private swarms
+`
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "download":
+		err = runDownload(os.Args[2:])
+	case "create":
+		err = runCreate(os.Args[2:])
+	case "scrape":
+		err = runScrape(os.Args[2:])
+	case "tracker-serve":
+		err = runTrackerServe(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
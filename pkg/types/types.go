@@ -29,7 +29,11 @@ type PieceResult struct {
 }
 
 type DownloadingState struct {
+	Index      int // piece being downloaded
 	Downloaded int
+	Requested  int // bytes of the piece asked for so far, blocks are requested in order
+	Backlog    int // requests waiting for an answer
 	Retries    int
 	Result     []byte
+	Rejected   bool // remote peer refused one of our requests
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+)
+
+func runScrape(args []string) error {
+	flags := flag.NewFlagSet("scrape", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: torrent-client scrape <file.torrent>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	torrents := make([]*torrent_file.TorrentFile, flags.NArg())
+	for i, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		decoded, err := torrent_file.DecodeFile(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		torrents[i] = torrent_file.FromBencodeToTorrentFile(decoded)
+	}
+
+	// torrents sharing a tracker are scraped with one request
+	var trackerUrls []string
+	hashesByTracker := map[string][][20]byte{}
+	for _, tf := range torrents {
+		for _, tier := range tracker.NewTiers(tf.Announce, tf.AnnounceList).Urls() {
+			for _, trackerUrl := range tier {
+				if _, ok := hashesByTracker[trackerUrl]; !ok {
+					trackerUrls = append(trackerUrls, trackerUrl)
+				}
+				hashesByTracker[trackerUrl] = append(hashesByTracker[trackerUrl], tf.InfoHash)
+			}
+		}
+	}
+
+	resultsByHash := map[[20]byte][]string{}
+	for _, trackerUrl := range trackerUrls {
+		results, err := tracker.Scrape(trackerUrl, hashesByTracker[trackerUrl])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", trackerUrl, err)
+			continue
+		}
+		for _, result := range results {
+			line := fmt.Sprintf("  %s seeders=%d leechers=%d downloaded=%d", trackerUrl, result.Complete, result.Incomplete, result.Downloaded)
+			resultsByHash[result.InfoHash] = append(resultsByHash[result.InfoHash], line)
+		}
+	}
+
+	for i, tf := range torrents {
+		fmt.Printf("%s (%s) %s\n", tf.Name, hex.EncodeToString(tf.InfoHash[:]), flags.Arg(i))
+		lines := resultsByHash[tf.InfoHash]
+		if len(lines) == 0 {
+			fmt.Println("  no tracker answered")
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
@@ -1,65 +1,71 @@
 package tests
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
-	torrent "github.com/umair-hassan2/torrent-client/cmd"
+	"github.com/stretchr/testify/require"
+	"github.com/umair-hassan2/torrent-client/cmd/message"
 )
 
 func TestBitFieldHasPiece(t *testing.T) {
 	// Create test cases
 	testCases := []struct {
 		name       string
-		bitfield   torrent.BitField
+		bitfield   message.BitField
 		pieceIndex int
 		expected   bool
 	}{
 		{
 			name:       "First bit set",
-			bitfield:   torrent.BitField{0b10000000}, // Binary: 10000000
+			bitfield:   message.BitField{0b10000000}, // Binary: 10000000
 			pieceIndex: 0,
 			expected:   true,
 		},
 		{
 			name:       "First bit not set",
-			bitfield:   torrent.BitField{0b01000000}, // Binary: 01000000
+			bitfield:   message.BitField{0b01000000}, // Binary: 01000000
 			pieceIndex: 0,
 			expected:   false,
 		},
 		{
 			name:       "Middle bit set",
-			bitfield:   torrent.BitField{0b00100000}, // Binary: 00100000
+			bitfield:   message.BitField{0b00100000}, // Binary: 00100000
 			pieceIndex: 2,
 			expected:   true,
 		},
 		{
 			name:       "Last bit of first byte set",
-			bitfield:   torrent.BitField{0b00000001}, // Binary: 00000001
+			bitfield:   message.BitField{0b00000001}, // Binary: 00000001
 			pieceIndex: 7,
 			expected:   true,
 		},
 		{
 			name:       "First bit of second byte set",
-			bitfield:   torrent.BitField{0b00000000, 0b10000000}, // Binary: 00000000 10000000
+			bitfield:   message.BitField{0b00000000, 0b10000000}, // Binary: 00000000 10000000
 			pieceIndex: 8,
 			expected:   true,
 		},
 		{
 			name:       "Piece index out of range",
-			bitfield:   torrent.BitField{0b11111111}, // Binary: 11111111
+			bitfield:   message.BitField{0b11111111}, // Binary: 11111111
 			pieceIndex: 8,                            // Only have bits 0-7
 			expected:   false,
 		},
 		{
 			name:       "All bits set",
-			bitfield:   torrent.BitField{0b11111111}, // Binary: 11111111
+			bitfield:   message.BitField{0b11111111}, // Binary: 11111111
 			pieceIndex: 5,
 			expected:   true,
 		},
 		{
 			name:       "No bits set",
-			bitfield:   torrent.BitField{0b00000000}, // Binary: 00000000
+			bitfield:   message.BitField{0b00000000}, // Binary: 00000000
 			pieceIndex: 3,
 			expected:   false,
 		},
@@ -80,65 +86,65 @@ func TestBitFieldSetPiece(t *testing.T) {
 	// Create test cases
 	testCases := []struct {
 		name             string
-		initialBitfield  torrent.BitField
+		initialBitfield  message.BitField
 		pieceIndex       int
-		expectedBitfield torrent.BitField
+		expectedBitfield message.BitField
 		description      string
 	}{
 		{
 			name:             "Set first bit in empty field",
-			initialBitfield:  torrent.BitField{0b00000000},
+			initialBitfield:  message.BitField{0b00000000},
 			pieceIndex:       0,
-			expectedBitfield: torrent.BitField{0b10000000},
+			expectedBitfield: message.BitField{0b10000000},
 			description:      "Setting bit 0 in an empty byte should result in 10000000",
 		},
 		{
 			name:             "Set last bit in empty field",
-			initialBitfield:  torrent.BitField{0b00000000},
+			initialBitfield:  message.BitField{0b00000000},
 			pieceIndex:       7,
-			expectedBitfield: torrent.BitField{0b00000001},
+			expectedBitfield: message.BitField{0b00000001},
 			description:      "Setting bit 7 in an empty byte should result in 00000001",
 		},
 		{
 			name:             "Set middle bit in empty field",
-			initialBitfield:  torrent.BitField{0b00000000},
+			initialBitfield:  message.BitField{0b00000000},
 			pieceIndex:       3,
-			expectedBitfield: torrent.BitField{0b00010000},
+			expectedBitfield: message.BitField{0b00010000},
 			description:      "Setting bit 3 in an empty byte should result in 00010000",
 		},
 		{
 			name:             "Set bit that's already set",
-			initialBitfield:  torrent.BitField{0b10000000},
+			initialBitfield:  message.BitField{0b10000000},
 			pieceIndex:       0,
-			expectedBitfield: torrent.BitField{0b10000000},
+			expectedBitfield: message.BitField{0b10000000},
 			description:      "Setting a bit that's already set should not change the value",
 		},
 		{
 			name:             "Set bit in second byte",
-			initialBitfield:  torrent.BitField{0b00000000, 0b00000000},
+			initialBitfield:  message.BitField{0b00000000, 0b00000000},
 			pieceIndex:       8,
-			expectedBitfield: torrent.BitField{0b00000000, 0b10000000},
+			expectedBitfield: message.BitField{0b00000000, 0b10000000},
 			description:      "Setting bit 8 should change the first bit in the second byte",
 		},
 		{
 			name:             "Set bit in partially filled field",
-			initialBitfield:  torrent.BitField{0b10100000},
+			initialBitfield:  message.BitField{0b10100000},
 			pieceIndex:       3, // Changed from 2 to 3 (fourth bit from left)
-			expectedBitfield: torrent.BitField{0b10110000},
+			expectedBitfield: message.BitField{0b10110000},
 			description:      "Setting bit 3 in a partially filled byte should result in 10110000",
 		},
 		{
 			name:             "Set bit out of range",
-			initialBitfield:  torrent.BitField{0b00000000},
+			initialBitfield:  message.BitField{0b00000000},
 			pieceIndex:       8,
-			expectedBitfield: torrent.BitField{0b00000000},
+			expectedBitfield: message.BitField{0b00000000},
 			description:      "Setting a bit beyond the range should leave the bitfield unchanged",
 		},
 		{
 			name:             "Set bit in multi-byte field",
-			initialBitfield:  torrent.BitField{0b11111111, 0b00000000, 0b00000000},
+			initialBitfield:  message.BitField{0b11111111, 0b00000000, 0b00000000},
 			pieceIndex:       15,
-			expectedBitfield: torrent.BitField{0b11111111, 0b00000001, 0b00000000},
+			expectedBitfield: message.BitField{0b11111111, 0b00000001, 0b00000000},
 			description:      "Setting bit 15 should set the last bit in the second byte",
 		},
 	}
@@ -147,7 +153,7 @@ func TestBitFieldSetPiece(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Make a copy of the initial bitfield for testing to avoid modifying the test data
-			bitfield := make(torrent.BitField, len(tc.initialBitfield))
+			bitfield := make(message.BitField, len(tc.initialBitfield))
 			copy(bitfield, tc.initialBitfield)
 
 			// Call SetPiece
@@ -167,3 +173,210 @@ func TestBitFieldSetPiece(t *testing.T) {
 		})
 	}
 }
+
+func TestPieceMessage(t *testing.T) {
+	msg := message.FormatPieceMessage(3, 16384, []byte("block"))
+	read, err := message.Read(bytes.NewReader(msg.Serialize()))
+	require.NoError(t, err)
+
+	piece, err := message.ParsePieceMessage(read)
+	require.NoError(t, err)
+	assert.Equal(t, 3, piece.PieceIndex)
+	assert.Equal(t, 16384, piece.Offset)
+	assert.Equal(t, []byte("block"), piece.BlockData)
+}
+
+func TestRequestAndCancelMessages(t *testing.T) {
+	for _, msg := range []*message.Message{
+		message.FormatRequestMessage(1, 2, 3),
+		message.FormatCancelMessage(1, 2, 3),
+		message.FormatRejectMessage(1, 2, 3),
+	} {
+		request, err := message.ParseRequestMessage(msg)
+		require.NoError(t, err)
+		assert.Equal(t, message.RequestMessage{PieceIndex: 1, Begin: 2, Length: 3}, request)
+	}
+
+	_, err := message.ParseRequestMessage(&message.Message{Id: message.MsgRequest, Payload: []byte{1, 2, 3}})
+	assert.Error(t, err)
+	_, err = message.ParseRequestMessage(message.FormatHaveMessage(1))
+	assert.Error(t, err)
+}
+
+func TestReadKeepAlive(t *testing.T) {
+	msg, err := message.Read(bytes.NewReader([]byte{0, 0, 0, 0}))
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestFastExtensionMessages(t *testing.T) {
+	for _, msg := range []*message.Message{message.FormatHaveAllMessage(), message.FormatHaveNoneMessage()} {
+		read, err := message.Read(bytes.NewReader(msg.Serialize()))
+		require.NoError(t, err)
+		assert.Equal(t, msg.Id, read.Id)
+		assert.Empty(t, read.Payload)
+	}
+
+	for _, msg := range []*message.Message{message.FormatSuggestMessage(42), message.FormatAllowedFastMessage(42), message.FormatHaveMessage(42)} {
+		read, err := message.Read(bytes.NewReader(msg.Serialize()))
+		require.NoError(t, err)
+		index, err := message.ParsePieceIndex(read)
+		require.NoError(t, err)
+		assert.Equal(t, 42, index)
+	}
+
+	_, err := message.ParsePieceIndex(&message.Message{Id: message.MsgAllowedFast, Payload: []byte{1}})
+	assert.Error(t, err)
+	_, err = message.ParsePieceIndex(message.FormatHaveAllMessage())
+	assert.Error(t, err)
+}
+
+// vectors of https://www.bittorrent.org/beps/bep_0006.html
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ip := net.ParseIP("80.4.4.200")
+
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, message.AllowedFastSet(7, 1313, ip, infoHash))
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, message.AllowedFastSet(9, 1313, ip, infoHash))
+	// the last byte of the ip doesn't matter
+	assert.Equal(t, message.AllowedFastSet(7, 1313, ip, infoHash), message.AllowedFastSet(7, 1313, net.ParseIP("80.4.4.1"), infoHash))
+
+	assert.ElementsMatch(t, []int{0, 1, 2}, message.AllowedFastSet(10, 3, ip, infoHash))
+	assert.Empty(t, message.AllowedFastSet(10, 1313, net.ParseIP("2001:db8::1"), infoHash))
+}
+
+func TestDecoderReadsFramesInOrder(t *testing.T) {
+	stream := bytes.Buffer{}
+	stream.Write([]byte{0, 0, 0, 0})
+	stream.Write(message.FormatHaveMessage(7).Serialize())
+	stream.Write(message.FormatPieceMessage(1, 0, []byte("block")).Serialize())
+
+	decoder := message.NewDecoder(&stream)
+	msg, err := decoder.Decode()
+	require.NoError(t, err)
+	assert.Nil(t, msg, "keep-alive")
+
+	msg, err = decoder.Decode()
+	require.NoError(t, err)
+	index, err := message.ParseHaveMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, 7, index)
+	have := msg.Payload
+
+	msg, err = decoder.Decode()
+	require.NoError(t, err)
+	piece, err := message.ParsePieceMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("block"), piece.BlockData)
+	assert.Equal(t, &have[0], &msg.Payload[0], "buffer is reused")
+}
+
+func TestDecoderRefusesLongFrames(t *testing.T) {
+	decoder := message.NewDecoder(bytes.NewReader([]byte{0, 0, 1, 0, message.MsgPiece}))
+	decoder.MaxFrameLength = 255
+	_, err := decoder.Decode()
+	assert.ErrorIs(t, err, message.ErrFrameTooLong)
+	assert.True(t, message.IsParseError(err))
+
+	var parseError *message.ParseError
+	require.ErrorAs(t, err, &parseError)
+	assert.Equal(t, uint32(256), parseError.Length)
+}
+
+func TestDecoderValidatesPayloadLength(t *testing.T) {
+	for _, msg := range []*message.Message{
+		{Id: message.MsgHave, Payload: []byte{1, 2, 3}},
+		{Id: message.MsgChoke, Payload: []byte{1}},
+		{Id: message.MsgRequest, Payload: make([]byte, 13)},
+		{Id: message.MsgPiece, Payload: make([]byte, 7)},
+		{Id: message.MsgPort, Payload: []byte{1}},
+		{Id: message.MsgExtended},
+	} {
+		read, err := message.Read(bytes.NewReader(msg.Serialize()))
+		assert.Nil(t, read)
+		assert.ErrorIs(t, err, message.ErrPayloadLength, message.FindMessagebyId(msg.Id))
+		assert.True(t, message.IsParseError(err))
+	}
+
+	_, err := message.ParseHaveMessage(&message.Message{Id: message.MsgHave, Payload: []byte{1}})
+	assert.True(t, message.IsParseError(err))
+	_, err = message.ParsePieceMessage(&message.Message{Id: message.MsgPiece, Payload: []byte{1}})
+	assert.True(t, message.IsParseError(err))
+	assert.False(t, message.IsParseError(io.ErrUnexpectedEOF))
+
+	// unknown ids are left to the caller
+	read, err := message.Read(bytes.NewReader([]byte{0, 0, 0, 2, 99, 1}))
+	require.NoError(t, err)
+	assert.Equal(t, uint8(99), read.Id)
+}
+
+// writer which counts the writes it gets
+type countingWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes
+}
+
+func TestWriterBatchesMessages(t *testing.T) {
+	out := &countingWriter{}
+	writer := message.NewWriter(out)
+	writer.FlushSize = 64
+	writer.FlushInterval = time.Hour
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writer.WriteMessage(message.FormatHaveMessage(i)))
+	}
+	assert.Equal(t, 0, out.count(), "below the flush size")
+	require.NoError(t, writer.WriteMessage(message.FormatPieceMessage(0, 0, make([]byte, 64))))
+	assert.Equal(t, 1, out.count(), "flushed at the flush size")
+
+	require.NoError(t, writer.WriteMessage(message.FormatHaveMessage(3)))
+	require.NoError(t, writer.WriteKeepAlive())
+	assert.Equal(t, 2, out.count(), "keep-alives are written at once")
+
+	decoder := message.NewDecoder(&out.buf)
+	for i := 0; i < 3; i++ {
+		msg, err := decoder.Decode()
+		require.NoError(t, err)
+		index, err := message.ParseHaveMessage(msg)
+		require.NoError(t, err)
+		assert.Equal(t, i, index)
+	}
+	msg, err := decoder.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, message.MsgPiece, msg.Id)
+	msg, err = decoder.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, message.MsgHave, msg.Id)
+	msg, err = decoder.Decode()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestWriterFlushesAfterInterval(t *testing.T) {
+	out := &countingWriter{}
+	writer := message.NewWriter(out)
+	writer.FlushInterval = 10 * time.Millisecond
+
+	require.NoError(t, writer.WriteMessage(message.FormatHaveMessage(1)))
+	require.NoError(t, writer.WriteMessage(message.FormatHaveMessage(2)))
+	assert.Eventually(t, func() bool { return out.count() == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, writer.Flush())
+	assert.Equal(t, 1, out.count(), "nothing left to flush")
+}
@@ -1,11 +1,18 @@
 package tests
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	torrent "github.com/umair-hassan2/torrent-client/cmd"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
 )
 
 func TestDecodeFile(t *testing.T) {
@@ -16,7 +23,7 @@ func TestDecodeFile(t *testing.T) {
 	assert.NoError(t, err, "Failed to open test torrent file")
 	defer file.Close()
 
-	torrentFile, err := torrent.DecodeFile(file)
+	torrentFile, err := torrent_file.DecodeFile(file)
 
 	// Verify the results - Check if parsing succeeded
 	assert.NoError(t, err, "DecodeFile returned an error")
@@ -35,11 +42,11 @@ func TestFromBencodeToTorrentFile(t *testing.T) {
 	assert.NoError(t, err, "Failed to open test torrent file")
 	defer file.Close()
 
-	btf, err := torrent.DecodeFile(file)
+	btf, err := torrent_file.DecodeFile(file)
 	assert.NoError(t, err, "DecodeFile returned an error")
 	assert.NotNil(t, btf, "Torrent should not be nil")
 
-	torrentFile := torrent.FromBencodeToTorrentFile(btf)
+	torrentFile := torrent_file.FromBencodeToTorrentFile(btf)
 	assert.Equal(t, "udp://tracker.openbittorrent.com:80/announce", torrentFile.Announce)
 	assert.Equal(t, "bbb_sunflower_1080p_60fps_normal.mp4", torrentFile.Name)
 	assert.Equal(t, int(355856562), torrentFile.Length)   // Updated to cast to int
@@ -47,10 +54,40 @@ func TestFromBencodeToTorrentFile(t *testing.T) {
 	assert.Equal(t, int(679), len(torrentFile.PieceHashes))
 }
 
+func TestInfoHash(t *testing.T) {
+	t.Run("info hash of a known torrent", func(t *testing.T) {
+		file, err := os.Open("test_files/sample_2.torrent")
+		assert.NoError(t, err, "Failed to open test torrent file")
+		defer file.Close()
+
+		btf, err := torrent_file.DecodeFile(file)
+		assert.NoError(t, err, "DecodeFile returned an error")
+
+		torrentFile := torrent_file.FromBencodeToTorrentFile(btf)
+		assert.Equal(t, "565db305a27ffb321fcc7b064afd7bd73aedda2b", hex.EncodeToString(torrentFile.InfoHash[:]))
+	})
+
+	t.Run("unknown keys in info dictionary are part of the hash", func(t *testing.T) {
+		info := "d6:lengthi10e4:name5:a.txt12:piece lengthi16e6:pieces0:7:private" + "i1e6:sourcei42ee"
+		data := "d8:announce9:localhost4:info" + info + "e"
+
+		btf, err := torrent_file.DecodeFile(strings.NewReader(data))
+		assert.NoError(t, err, "DecodeFile returned an error")
+
+		torrentFile := torrent_file.FromBencodeToTorrentFile(btf)
+		assert.Equal(t, sha1.Sum([]byte(info)), torrentFile.InfoHash)
+	})
+
+	t.Run("torrent without info dictionary", func(t *testing.T) {
+		_, err := torrent_file.DecodeFile(strings.NewReader("d8:announce9:localhoste"))
+		assert.Error(t, err, "should fail without info dictionary")
+	})
+}
+
 func TestBuildTrackerUrl(t *testing.T) {
 	infoHash := "aaaaaaaaaaaaaaaaaaaa"
 	infoHashBytes := []byte(infoHash)
-	sampleTorrentFile := &torrent.TorrentFile{
+	sampleTorrentFile := &torrent_file.TorrentFile{
 		Announce:    "localhost/announce",
 		Length:      120,
 		Name:        "sample_1.txt",
@@ -60,13 +97,25 @@ func TestBuildTrackerUrl(t *testing.T) {
 	}
 
 	t.Run("should create tracker url", func(t *testing.T) {
-		peerId := [20]byte([]byte("aaaaaaaaaaaaaaaaaaaa"))
-		port := 6881
-		actualTrackerUrl, err := sampleTorrentFile.BuildTrackerUrl([20]byte(peerId), port)
+		peer := types.Peer{
+			ID:   "aaaaaaaaaaaaaaaaaaaa",
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 6881,
+		}
+		actualTrackerUrl, err := torrent.New(peer, sampleTorrentFile).BuildTrackerUrl(sampleTorrentFile.Announce)
 
 		assert.NoError(t, err, "should not raise erorr in tracker url creation")
 
-		expectTrackerUrl := "localhost/announce?compact=1&downloaded=0&info_hash=aaaaaaaaaaaaaaaaaaaa&left=100&peer_id=aaaaaaaaaaaaaaaaaaaa&port=6881&uploaded=0"
-		assert.Equal(t, expectTrackerUrl, actualTrackerUrl, "tracker url mismatch")
+		// key is random for every torrent, so it is only checked to be there
+		trackerUrl, err := url.Parse(actualTrackerUrl)
+		assert.NoError(t, err, "tracker url should be valid")
+		query := trackerUrl.Query()
+		assert.NotEmpty(t, query.Get("key"), "tracker url should carry a key")
+		query.Del("key")
+		trackerUrl.RawQuery = query.Encode()
+
+		// nothing is downloaded yet, so whole torrent is left
+		expectTrackerUrl := "localhost/announce?compact=1&downloaded=0&info_hash=aaaaaaaaaaaaaaaaaaaa&left=120&peer_id=aaaaaaaaaaaaaaaaaaaa&port=6881&uploaded=0"
+		assert.Equal(t, expectTrackerUrl, trackerUrl.String(), "tracker url mismatch")
 	})
 }
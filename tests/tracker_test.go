@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent"
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker/trackertest"
+	"github.com/umair-hassan2/torrent-client/pkg/types"
+)
+
+func TestAnnounceToScriptedTrackers(t *testing.T) {
+	sampleTorrentFile := &torrent_file.TorrentFile{
+		Announce:     "http://first.local/announce",
+		AnnounceList: [][]string{{"http://first.local/announce"}, {"udp://second.local:80/announce"}},
+		Length:       120,
+		PieceLength:  20,
+	}
+	peer := types.Peer{ID: "aaaaaaaaaaaaaaaaaaaa", IP: net.ParseIP("127.0.0.1"), Port: 6881}
+
+	first := trackertest.NewFake().
+		Fail(errors.New("tracker is down")).
+		Respond(&tracker.TrackerResponse{Interval: 1800, Peers: []*types.Peer{{IP: net.ParseIP("10.0.0.1"), Port: 6881}}})
+	second := trackertest.NewFake()
+	second.Default = &tracker.TrackerResponse{Interval: 900, Peers: []*types.Peer{
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.ParseIP("10.0.0.2"), Port: 6882},
+	}}
+	trackers := trackertest.Trackers{
+		"http://first.local/announce":    first,
+		"udp://second.local:80/announce": second,
+	}
+
+	t.Run("peers from working tiers are merged", func(t *testing.T) {
+		tr := torrent.New(peer, sampleTorrentFile)
+		tr.NewAnnouncer = trackers.NewAnnouncer
+
+		peers, err := tr.AnnounceToTracker()
+		assert.NoError(t, err, "second tier should answer")
+		assert.Len(t, peers, 2)
+
+		peers, err = tr.AnnounceToTracker()
+		assert.NoError(t, err)
+		assert.Len(t, peers, 2, "same peers from both tiers should be counted once")
+
+		tr.Stop()
+		assert.True(t, first.Closed(), "trackers should be closed when the torrent stops")
+		assert.Equal(t, int64(120), first.Requests()[0].Left)
+	})
+
+	t.Run("no tracker answers", func(t *testing.T) {
+		tr := torrent.New(peer, sampleTorrentFile)
+		tr.NewAnnouncer = trackertest.Trackers{
+			"http://first.local/announce":    trackertest.NewFake(),
+			"udp://second.local:80/announce": trackertest.NewFake(),
+		}.NewAnnouncer
+
+		_, err := tr.AnnounceToTracker()
+		assert.Error(t, err)
+	})
+}
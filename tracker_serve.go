@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/umair-hassan2/torrent-client/cmd/torrent_file"
+	"github.com/umair-hassan2/torrent-client/cmd/tracker/server"
+)
+
+func runTrackerServe(args []string) error {
+	flags := flag.NewFlagSet("tracker-serve", flag.ExitOnError)
+	httpAddress := flags.String("http", ":6969", "address to serve http announces on, empty disables http")
+	udpAddress := flags.String("udp", "", "address to serve udp announces on, empty disables udp")
+	interval := flags.Duration("interval", server.DefaultInterval, "how often peers should announce")
+	minInterval := flags.Duration("min-interval", 0, "how often peers may announce at most")
+	maxPeers := flags.Int("max-peers", server.DefaultMaxPeers, "most peers returned by one announce")
+	maxSwarms := flags.Int("max-swarms", server.DefaultMaxSwarms, "most torrents tracked at once")
+	var allowed, passkeys stringList
+	flags.Var(&allowed, "allow", "hex info hash or .torrent file which may be tracked (repeatable, default: any torrent)")
+	flags.Var(&passkeys, "passkey", "passkey announce urls must start with, e.g. /<passkey>/announce (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: torrent-client tracker-serve [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *httpAddress == "" && *udpAddress == "" {
+		return fmt.Errorf("nothing to serve, give an http or udp address")
+	}
+
+	config := server.Config{
+		Interval:    *interval,
+		MinInterval: *minInterval,
+		MaxPeers:    *maxPeers,
+		MaxSwarms:   *maxSwarms,
+		Passkeys:    passkeys,
+	}
+	for _, value := range allowed {
+		infoHash, err := parseAllowed(value)
+		if err != nil {
+			return err
+		}
+		config.AllowedInfoHashes = append(config.AllowedInfoHashes, infoHash)
+	}
+	trackerServer := server.New(config)
+
+	errs := make(chan error, 2)
+	if *udpAddress != "" {
+		conn, err := net.ListenPacket("udp", *udpAddress)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fmt.Printf("serving udp announces on %s\n", conn.LocalAddr())
+		go func() { errs <- trackerServer.ServeUDP(conn) }()
+	}
+	if *httpAddress != "" {
+		listener, err := net.Listen("tcp", *httpAddress)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("serving http announces on %s\n", listener.Addr())
+		httpServer := &http.Server{Handler: trackerServer, ReadHeaderTimeout: 10 * time.Second}
+		go func() { errs <- httpServer.Serve(listener) }()
+	}
+	return <-errs
+}
+
+// info hash given as hex or read from a .torrent file
+func parseAllowed(value string) ([20]byte, error) {
+	var infoHash [20]byte
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == 20 {
+		copy(infoHash[:], decoded)
+		return infoHash, nil
+	}
+
+	file, err := os.Open(value)
+	if err != nil {
+		return infoHash, fmt.Errorf("%q is neither a hex info hash nor a readable .torrent file", value)
+	}
+	defer file.Close()
+	decoded, err := torrent_file.DecodeFile(file)
+	if err != nil {
+		return infoHash, fmt.Errorf("%s: %w", value, err)
+	}
+	return decoded.InfoHash(), nil
+}